@@ -0,0 +1,175 @@
+package main
+
+import "bot/config"
+import "bot/engine"
+import "bot/logging"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "gopkg.in/yaml.v2"
+import "github.com/codegangsta/cli"
+
+func validateAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Usage: validate <config>", 2)
+	}
+	cfg, err := config.Load(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = engine.CheckConfig(cfg); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("%s: ok\n", cfg.Filename)
+	return nil
+}
+
+func pluginsAction(c *cli.Context) error {
+	for _, name := range engine.RegisteredPlugins() {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func feedTestAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Usage: feed test <url>", 2)
+	}
+	items, err := engine.PreviewFeed(c.Args().First(), c.String("template"), c.Int("max"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, item := range items {
+		fmt.Println(item)
+	}
+	return nil
+}
+
+func gemExportAction(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return cli.NewExitError("Usage: gem export <config> [file]", 2)
+	}
+	cfg, err := config.Load(c.Args().First())
+	if err == nil {
+		err = engine.PrepareConfig(cfg)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	store, err := engine.OpenGemStore(cfg)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer store.Close()
+	db, err := engine.OpenGemDB(store)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	b, err := yaml.Marshal(db)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if c.NArg() == 1 {
+		_, err = os.Stdout.Write(b)
+	} else {
+		err = ioutil.WriteFile(c.Args().Get(1), b, 0600)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func gemImportAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("Usage: gem import <config> <file>", 2)
+	}
+	cfg, err := config.Load(c.Args().First())
+	if err == nil {
+		err = engine.PrepareConfig(cfg)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	b, err := ioutil.ReadFile(c.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	src := &engine.GemDB{}
+	if err = yaml.Unmarshal(b, src); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	// the running bot would overwrite or interleave with the import
+	lock, err := engine.LockDataDir(cfg)
+	if err == engine.ErrDataDirLocked && c.Bool("force") {
+		fmt.Fprintln(os.Stderr, "Warning: the bot is running; it may lose the imported gems or damage its store")
+	} else if err != nil {
+		return cli.NewExitError(err.Error() + "; stop the bot first", 1)
+	}
+	defer lock.Unlock()
+	store, err := engine.OpenGemStore(cfg)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer store.Close()
+	db, err := engine.OpenGemDB(store)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	n, err := db.Import(src)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("Imported %d gems\n", n)
+	return nil
+}
+
+func loadOutbox(c *cli.Context) (*engine.Outbox, error) {
+	cfg, err := config.Load(c.Args().First())
+	if err == nil {
+		err = engine.PrepareConfig(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return engine.LoadOutbox(cfg)
+}
+
+func outboxListAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Usage: outbox list <config>", 2)
+	}
+	o, err := loadOutbox(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, msg := range o.DeadLetters() {
+		fmt.Printf("%d\t%s\t%d attempts\t%s\n", msg.ID, msg.Created.Format("02/01/2006 15:04 MST"), msg.Attempts, logging.Redact(msg.LastError))
+	}
+	return nil
+}
+
+func outboxReplayAction(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return cli.NewExitError("Usage: outbox replay <config> [id]", 2)
+	}
+	var id int64
+	if c.NArg() == 2 {
+		var err error
+		id, err = strconv.ParseInt(c.Args().Get(1), 10, 64)
+		if err != nil || id <= 0 {
+			return cli.NewExitError("Bad message id " + c.Args().Get(1), 2)
+		}
+	}
+	o, err := loadOutbox(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	n, err := o.Replay(id)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("Requeued %d messages\n", n)
+	return nil
+}
@@ -1,22 +1,145 @@
 package config
 
 import "io/ioutil"
+import "errors"
+import "fmt"
+import "reflect"
+import "net/url"
+import "regexp"
+import "strings"
+import "bot/tmpl"
 import "gopkg.in/yaml.v2"
 
+// TriggerConfig answers messages matching Regex with one of Responses,
+// picked at random.  Responses are templates (see package tmpl) that may
+// use ${user}, ${user.id}, ${channel}, ${channel.id}, ${request.<field>}
+// and the regex's groups as ${0}, ${1}... or ${name}.  A trigger with
+// Channels only fires there, and one with a cooldown fires at most once
+// per cooldown in each channel.
 type TriggerConfig struct {
 	Regex string
-	Command int
+	Responses []string
+	Channels []string
+	CooldownSeconds int
+	ResponseType string
+}
+
+// PluginConfig enables a plugin for a bot.  Plugins are dispatched in
+// ascending Priority, and in the order listed when priorities are equal.
+type PluginConfig struct {
+	Name string
+	Priority int
+	Settings map[string]interface{}
+}
+
+// OutboxConfig tunes delivery of outbound webhook posts.  Zero values
+// select the defaults.
+type OutboxConfig struct {
+	MaxAttempts int
+	RatePerMinute int
+	TimeoutSeconds int
+}
+
+// AuthRule sets the minimum role for a command path such as "gem remove",
+// covering its subcommands too, and optionally limits it to channels
+// given by ID or name.
+type AuthRule struct {
+	Command string
+	Role string
+	Channels []string
+}
+
+// AuthConfig grants roles by Mattermost user ID.
+type AuthConfig struct {
+	Admins []string
+	Moderators []string
+	Rules []AuthRule
+}
+
+// SlackConfig accepts slash commands from a Slack app, which signs its
+// requests with the app's signing secret rather than sending a token.
+type SlackConfig struct {
+	SigningSecret string
+	// MaxSkewSeconds is how old a signed request may be, 300 if zero.
+	MaxSkewSeconds int
+}
+
+// TLSConfig serves the bot's endpoints over HTTPS.
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files, reread when either changes.
+	CertFile string
+	KeyFile string
+	// ClientCAFile, if set, makes clients such as Mattermost present a
+	// certificate signed by one of the CAs in it.
+	ClientCAFile string
+	// RedirectPort, if set, serves plain HTTP redirecting to HTTPS.
+	RedirectPort int
+}
+
+// Enabled reports whether the bot serves HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// RateLimit is a token bucket refilled at PerMinute, holding up to Burst
+// requests.  A zero PerMinute disables the limit.
+type RateLimit struct {
+	PerMinute float64
+	Burst int
+}
+
+// RateLimitConfig throttles commands per user, per channel and per
+// command name.  Admins and the Exempt user IDs are never limited.
+type RateLimitConfig struct {
+	User RateLimit
+	Channel RateLimit
+	Command RateLimit
+	Exempt []string
+}
+
+var storageNames = map[string]bool{
+	"": true,
+	"yaml": true,
+	"log": true,
+}
+
+var triggerOrders = map[string]bool{
+	"": true,
+	"before": true,
+	"after": true,
+}
+
+var roleNames = map[string]bool{
+	"": true,
+	"user": true,
+	"moderator": true,
+	"admin": true,
 }
 
 type Config struct {
 	Username string
 	BaseURL string
+	MattermostURL string
 	IconURL string
+	// TemplateEnv lists the environment variables that templates in this
+	// config may read, as ${env.NAME}.
+	TemplateEnv []string
 	Port int
 	Token string
 	SlashStrictTokens bool
 	SlashTokens []string
 	DataDir string
+	Storage string
+	WatchSeconds int
+	Plugins []PluginConfig
+	Outbox OutboxConfig
+	Auth AuthConfig
+	RateLimit RateLimitConfig
+	Triggers []TriggerConfig
+	TriggerOrder string
+	Slack SlackConfig
+	TLS TLSConfig
+	Filename string `yaml:"-"`
 }
 
 func Load(filename string) (*Config, error) {
@@ -26,9 +149,175 @@ func Load(filename string) (*Config, error) {
 	}
 	cfg := &Config{}
 	err = yaml.Unmarshal(b, cfg)
+	cfg.Filename = filename
 	return cfg, err
 }
 
+// Validate checks that the fields a bot cannot run without are present.
+func (c *Config) Validate() error {
+	if c.Username == "" {
+		return errors.New("UserName required")
+	}
+	if c.Token == "" {
+		return errors.New("Mattermost webhook token required")
+	}
+	// zero is allowed for bots on a shared listener; Bot.Start rejects it
+	if c.Port < 0 {
+		return errors.New("Port must not be negative")
+	}
+	if c.WatchSeconds < 0 {
+		return errors.New("WatchSeconds must not be negative")
+	}
+	if c.MattermostURL != "" {
+		if u, err := url.Parse(c.MattermostURL); err != nil || u.Host == "" {
+			return fmt.Errorf("MattermostURL %q is not a URL", c.MattermostURL)
+		}
+	}
+	if err := tmpl.Check(c.IconURL); err != nil {
+		return fmt.Errorf("IconURL: %v", err)
+	}
+	if !storageNames[c.Storage] {
+		return fmt.Errorf("Unknown storage %s", c.Storage)
+	}
+	seen := make(map[string]bool)
+	for _, pc := range c.Plugins {
+		if pc.Name == "" {
+			return errors.New("Plugin name required")
+		}
+		if seen[pc.Name] {
+			return fmt.Errorf("Plugin %s listed twice", pc.Name)
+		}
+		seen[pc.Name] = true
+	}
+	for _, r := range c.Auth.Rules {
+		if r.Command == "" {
+			return errors.New("Auth rule command required")
+		}
+		if !roleNames[strings.ToLower(r.Role)] {
+			return fmt.Errorf("Auth rule for %s has unknown role %s", r.Command, r.Role)
+		}
+	}
+	for _, t := range c.Triggers {
+		if _, err := regexp.Compile(t.Regex); err != nil {
+			return fmt.Errorf("Trigger %q: %v", t.Regex, err)
+		}
+		if len(t.Responses) == 0 {
+			return fmt.Errorf("Trigger %q has no responses", t.Regex)
+		}
+		for _, r := range t.Responses {
+			if err := tmpl.Check(r); err != nil {
+				return fmt.Errorf("Trigger %q: %v", t.Regex, err)
+			}
+		}
+		if t.CooldownSeconds < 0 {
+			return fmt.Errorf("Trigger %q cooldown must not be negative", t.Regex)
+		}
+	}
+	if c.Slack.MaxSkewSeconds < 0 {
+		return errors.New("Slack MaxSkewSeconds must not be negative")
+	}
+	if err := c.TLS.Validate(c.Port); err != nil {
+		return err
+	}
+	if !triggerOrders[c.TriggerOrder] {
+		return fmt.Errorf("TriggerOrder must be before or after, not %s", c.TriggerOrder)
+	}
+	return nil
+}
+
+// Validate checks t for a listener on port.
+func (t TLSConfig) Validate(port int) error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("TLS needs both CertFile and KeyFile")
+	}
+	if !t.Enabled() && (t.ClientCAFile != "" || t.RedirectPort != 0) {
+		return errors.New("TLS ClientCAFile and RedirectPort need CertFile")
+	}
+	if t.RedirectPort < 0 || (t.RedirectPort != 0 && t.RedirectPort == port) {
+		return fmt.Errorf("TLS RedirectPort %d is not a free port", t.RedirectPort)
+	}
+	return nil
+}
+
+// secretFields are reported as changed without showing their values.
+var secretFields = map[string]bool{
+	"Token": true,
+	"SlashTokens": true,
+	"Slack": true,
+}
+
+// Diff describes, one line per field, how c differs from old.  Plugin
+// settings and the user IDs in Auth may hold secrets or personal data,
+// so only which of them changed is reported.
+func (c *Config) Diff(old *Config) []string {
+	out := make([]string, 0)
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(c).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		name := nv.Type().Field(i).Name
+		a := ov.Field(i).Interface()
+		b := nv.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		switch {
+		case secretFields[name]:
+			out = append(out, fmt.Sprintf("%s changed", strings.ToLower(name)))
+		case name == "Plugins":
+			out = append(out, diffPlugins(old.Plugins, c.Plugins)...)
+		case name == "Auth":
+			out = append(out, diffAuth(old.Auth, c.Auth)...)
+		default:
+			out = append(out, fmt.Sprintf("%s: %v -> %v", strings.ToLower(name), a, b))
+		}
+	}
+	return out
+}
+
+func diffPlugins(old []PluginConfig, cur []PluginConfig) []string {
+	out := make([]string, 0)
+	prev := make(map[string]PluginConfig)
+	for _, pc := range old {
+		prev[pc.Name] = pc
+	}
+	for _, pc := range cur {
+		o, ok := prev[pc.Name]
+		delete(prev, pc.Name)
+		switch {
+		case !ok:
+			out = append(out, fmt.Sprintf("plugins: %s added", pc.Name))
+		case o.Priority != pc.Priority:
+			out = append(out, fmt.Sprintf("plugins: %s priority %d -> %d", pc.Name, o.Priority, pc.Priority))
+		}
+		if ok && !reflect.DeepEqual(o.Settings, pc.Settings) {
+			out = append(out, fmt.Sprintf("plugins: %s settings changed", pc.Name))
+		}
+	}
+	for _, pc := range old {
+		if _, ok := prev[pc.Name]; ok {
+			out = append(out, fmt.Sprintf("plugins: %s removed", pc.Name))
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, "plugins: order changed")
+	}
+	return out
+}
+
+func diffAuth(old AuthConfig, cur AuthConfig) []string {
+	out := make([]string, 0)
+	if !reflect.DeepEqual(old.Admins, cur.Admins) {
+		out = append(out, fmt.Sprintf("auth: admins changed, %d -> %d", len(old.Admins), len(cur.Admins)))
+	}
+	if !reflect.DeepEqual(old.Moderators, cur.Moderators) {
+		out = append(out, fmt.Sprintf("auth: moderators changed, %d -> %d", len(old.Moderators), len(cur.Moderators)))
+	}
+	if !reflect.DeepEqual(old.Rules, cur.Rules) {
+		out = append(out, fmt.Sprintf("auth: rules %v -> %v", old.Rules, cur.Rules))
+	}
+	return out
+}
+
 func (c *Config) IsTokenValid( isSlash bool, token string ) bool {
 	if !isSlash {
 		return token == c.Token
@@ -46,4 +335,4 @@ func (c *Config) IsTokenValid( isSlash bool, token string ) bool {
 
 func (c *Config) GetDataPath(filename string) string {
 	return c.DataDir + "/" + filename
-}
\ No newline at end of file
+}
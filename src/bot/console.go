@@ -0,0 +1,105 @@
+package main
+
+import "bot/config"
+import "bot/engine"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "github.com/codegangsta/cli"
+
+func consoleAction(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return cli.NewExitError("Usage: console <config> [transcript]", 2)
+	}
+	cfg, err := config.Load(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = engine.PrepareConfig(cfg); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	// never touch the data of a bot that may be running; work on a copy
+	// unless told otherwise
+	if dir := c.String("datadir"); dir != "" {
+		cfg.DataDir = dir
+	} else {
+		scratch, err := ioutil.TempDir("", "retrobot-console-")
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer os.RemoveAll(scratch)
+		if err = copyDir(cfg.DataDir, scratch); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		cfg.DataDir = scratch
+	}
+	bot, err := engine.NewOffline(cfg, engine.WithoutBackground())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer bot.Done()
+
+	con := &engine.Console{
+		Bot: bot,
+		UserName: c.String("user"),
+		UserID: c.String("user-id"),
+		ChannelName: c.String("channel"),
+		ChannelID: c.String("channel-id"),
+	}
+	if con.UserID == "" {
+		con.UserID = con.UserName
+	}
+	if con.ChannelID == "" {
+		con.ChannelID = con.ChannelName
+	}
+
+	var in io.Reader = os.Stdin
+	if c.NArg() == 2 {
+		f, err := os.Open(c.Args().Get(1))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer f.Close()
+		in = f
+		con.Echo = true
+	} else if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		con.Interactive = true
+	} else {
+		con.Echo = true
+	}
+	if err = con.Run(in, os.Stdout); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+// copyDir copies the files under src into dst, which must exist.  A
+// missing src is an empty one.
+func copyDir(src string, dst string) error {
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, b, 0600)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
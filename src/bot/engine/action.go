@@ -0,0 +1,366 @@
+package engine
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+import "github.com/gorilla/mux"
+
+const actionKey = "_action"
+const actionSigKey = "_sig"
+const actionChannelKey = "_channel_id"
+const actionExpiresKey = "_expires"
+const actionSelectedKey = "selected_option"
+const actionMaxBody = 1 << 20
+
+// actionExpiry is how long buttons and menus keep working.
+const actionExpiry = 7 * 24 * time.Hour
+
+var ErrActionSignature = errors.New("Action has a bad signature")
+var ErrActionUnknown = errors.New("Action has no handler")
+var ErrActionExpired = errors.New("This button has expired.")
+
+// ActionContext is data a plugin attaches to an action and gets back
+// when it is clicked.  Values come back as decoded from JSON, so numbers
+// are float64; use ActionRequest.Int to read them.
+type ActionContext map[string]interface{}
+
+// AttachmentAction is a button or select menu on an attachment, in
+// Mattermost's interactive message format.  Build them with Bot.Button
+// and Bot.Menu so that clicks find their way back.
+type AttachmentAction struct {
+	ID string `json:"id,omitempty"`
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	// Style is one of default, primary, success, good, warning, danger.
+	Style string `json:"style,omitempty"`
+	// DataSource fills a menu with "users" or "channels" instead of Options.
+	DataSource string `json:"data_source,omitempty"`
+	Options []*ActionOption `json:"options,omitempty"`
+	Integration *ActionIntegration `json:"integration,omitempty"`
+}
+
+type ActionOption struct {
+	Text string `json:"text"`
+	Value string `json:"value"`
+}
+
+type ActionIntegration struct {
+	URL string `json:"url"`
+	Context ActionContext `json:"context,omitempty"`
+}
+
+// ActionRequest is a click on an action, routed to the plugin that made
+// the action.
+type ActionRequest struct {
+	// Request says who clicked and where.  Its Text is empty.
+	Request *BotRequest
+	ID string
+	Context ActionContext
+	// Selected is the value picked from a menu.
+	Selected string
+}
+
+// String returns a context value as a string.
+func (a *ActionRequest) String(key string) string {
+	v, ok := a.Context[key]
+	if !ok {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// Int returns a context value as an int, or 0.
+func (a *ActionRequest) Int(key string) int {
+	return int(contextInt(a.Context, key))
+}
+
+// contextInt reads a number from ctx, whether or not it has been through
+// JSON.
+func contextInt(ctx ActionContext, key string) int64 {
+	switch v := ctx[key].(type) {
+	case float64:
+		return int64(v)
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	}
+	return 0
+}
+
+// ActionResponse answers a click.  Update, if set, replaces the message
+// holding the action; Ephemeral is shown only to the user who clicked.
+type ActionResponse struct {
+	Update *BotResponse
+	Ephemeral string
+}
+
+// ActionHandler is implemented by plugins that attach actions to their
+// responses.
+type ActionHandler interface {
+	HandleAction(b *Bot, act *ActionRequest) *ActionResponse
+}
+
+// URL returns the address at which the bot serves path, which is under
+// /{username} when the bot shares a host.
+func (b *Bot) URL(path string) string {
+	return fmt.Sprintf("%s://%s:%d%s%s", b.Scheme(), b.Config().BaseURL, b.Port(), b.prefix, path)
+}
+
+// Scheme returns https if the bot, or its host, serves TLS.
+func (b *Bot) Scheme() string {
+	tc := b.Config().TLS
+	if b.host != nil {
+		tc = b.host.tls
+	}
+	if tc.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// Port returns the port the bot is reached on: its own, or its host's.
+func (b *Bot) Port() int {
+	if b.host != nil {
+		b.host.m.Lock()
+		defer b.host.m.Unlock()
+		return b.host.port
+	}
+	return b.Config().Port
+}
+
+// Button returns a button whose clicks are passed to p's HandleAction
+// with id and ctx.  It works only in channelID, unless that is empty as
+// for posts to incoming webhooks, and for actionExpiry.
+func (b *Bot) Button(p Plugin, channelID string, id string, label string, ctx ActionContext) *AttachmentAction {
+	return b.action(p, channelID, id, label, "button", ctx)
+}
+
+// Menu returns a select menu of options whose choices are passed to p's
+// HandleAction with id and ctx, and the chosen value as Selected.  Like
+// a button, it is bound to channelID.
+func (b *Bot) Menu(p Plugin, channelID string, id string, label string, options []*ActionOption, ctx ActionContext) *AttachmentAction {
+	a := b.action(p, channelID, id, label, "select", ctx)
+	a.Options = options
+	return a
+}
+
+func (b *Bot) action(p Plugin, channelID string, id string, label string, kind string, ctx ActionContext) *AttachmentAction {
+	route := p.Name() + "/" + id
+	signed := ActionContext{
+		actionKey: route,
+		actionChannelKey: channelID,
+		actionExpiresKey: b.Now().Add(actionExpiry).Unix(),
+	}
+	for k, v := range ctx {
+		signed[k] = v
+	}
+	signed[actionSigKey] = b.signAction(signed)
+	return &AttachmentAction{
+		ID: actionID(route),
+		Name: label,
+		Type: kind,
+		Integration: &ActionIntegration{
+			URL: b.URL("/actions/" + route),
+			Context: signed,
+		},
+	}
+}
+
+// actionID makes the alphanumeric id Mattermost wants for an action.
+func actionID(route string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, route)
+}
+
+// signAction returns the HMAC of ctx, without any signature or menu
+// choice it carries, keyed by the bot's token.  Marshalling a map sorts
+// its keys, so the encoding is the same after a round trip through
+// Mattermost.
+func (b *Bot) signAction(ctx ActionContext) string {
+	plain := make(ActionContext, len(ctx))
+	for k, v := range ctx {
+		if k != actionSigKey && k != actionSelectedKey {
+			plain[k] = v
+		}
+	}
+	bb, _ := json.Marshal(plain)
+	mac := hmac.New(sha256.New, []byte(b.Config().Token))
+	mac.Write([]byte("retrobot action\n"))
+	mac.Write(bb)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAction checks the signature of a clicked action's context and
+// returns its route, plugin/id.
+func (b *Bot) verifyAction(ctx ActionContext) (string, error) {
+	sig, _ := ctx[actionSigKey].(string)
+	route, _ := ctx[actionKey].(string)
+	if sig == "" || route == "" || !hmac.Equal([]byte(sig), []byte(b.signAction(ctx))) {
+		return "", ErrActionSignature
+	}
+	return route, nil
+}
+
+// HandleAction routes a click to the plugin that made the action.  The
+// context must carry the signature given to it by Button or Menu, and be
+// clicked in the channel it was made for.  An expired action is answered
+// with ErrActionExpired for the user.
+func (b *Bot) HandleAction(act *ActionRequest) (*ActionResponse, error) {
+	route, err := b.verifyAction(act.Context)
+	if err != nil {
+		return nil, err
+	}
+	if ch, _ := act.Context[actionChannelKey].(string); ch != "" && ch != act.Request.ChannelID {
+		return nil, ErrActionSignature
+	}
+	if b.Now().Unix() > contextInt(act.Context, actionExpiresKey) {
+		return &ActionResponse{Ephemeral: ErrActionExpired.Error()}, nil
+	}
+	name, id := route, ""
+	if i := strings.Index(route, "/"); i >= 0 {
+		name, id = route[:i], route[i+1:]
+	}
+	if act.ID != "" && act.ID != id {
+		return nil, ErrActionSignature
+	}
+	act.ID = id
+	if s, ok := act.Context[actionSelectedKey].(string); ok && act.Selected == "" {
+		act.Selected = s
+	}
+	for _, p := range b.activePlugins() {
+		if p.Name() != name {
+			continue
+		}
+		h, ok := p.(ActionHandler)
+		if !ok {
+			break
+		}
+		b.metrics.requests.Inc("action", name, id)
+		resp := h.HandleAction(b, act)
+		if resp == nil {
+			resp = &ActionResponse{}
+		}
+		if resp.Update != nil {
+			b.decorate(resp.Update)
+		}
+		return resp, nil
+	}
+	return nil, ErrActionUnknown
+}
+
+// Click acts on a from an answer to req, as if the user had clicked it,
+// choosing selected from a menu.
+func (b *Bot) Click(a *AttachmentAction, req *BotRequest, selected string) (*ActionResponse, error) {
+	if a.Integration == nil {
+		return nil, ErrActionUnknown
+	}
+	r := *req
+	r.Text = ""
+	return b.HandleAction(&ActionRequest{
+		Request: &r,
+		Context: a.Integration.Context,
+		Selected: selected,
+	})
+}
+
+// mattermostAction is the payload of an integration action callback.
+type mattermostAction struct {
+	UserID string `json:"user_id"`
+	UserName string `json:"user_name"`
+	ChannelID string `json:"channel_id"`
+	ChannelName string `json:"channel_name"`
+	TeamID string `json:"team_id"`
+	TeamDomain string `json:"team_domain"`
+	PostID string `json:"post_id"`
+	TriggerID string `json:"trigger_id"`
+	Context ActionContext `json:"context"`
+}
+
+type mattermostActionReply struct {
+	Update *mattermostUpdate `json:"update,omitempty"`
+	EphemeralText string `json:"ephemeral_text,omitempty"`
+}
+
+type mattermostUpdate struct {
+	Message string `json:"message"`
+	Props map[string]interface{} `json:"props"`
+}
+
+// Action serves Mattermost's callbacks for clicks on /actions/{plugin}/{id}.
+func (b *Bot) Action( w http.ResponseWriter, r *http.Request ) {
+	if r.Method != "POST" {
+		b.Log().Warnf("Invalid request method: %s", r.Method)
+		return
+	}
+	in := &mattermostAction{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, actionMaxBody)).Decode(in); err != nil {
+		b.Log().Warnf("Failed to decode action: %v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	vars := mux.Vars(r)
+	if route, _ := in.Context[actionKey].(string); route != vars["plugin"]+"/"+vars["id"] {
+		b.Log().Warnf("Ignoring action for %s posted to %s/%s", route, vars["plugin"], vars["id"])
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	resp, err := b.HandleAction(&ActionRequest{
+		Request: &BotRequest{
+			ChannelID: in.ChannelID,
+			ChannelName: in.ChannelName,
+			PostID: in.PostID,
+			TeamDomain: in.TeamDomain,
+			TeamID: in.TeamID,
+			TriggerID: in.TriggerID,
+			UserID: in.UserID,
+			UserName: in.UserName,
+		},
+		ID: vars["id"],
+		Context: in.Context,
+	})
+	if err != nil {
+		b.Log().Warnf("Ignoring action from %s: %v", r.RemoteAddr, err)
+		if err == ErrActionSignature {
+			b.metrics.tokenRejections.Inc("action")
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	reply := &mattermostActionReply{
+		EphemeralText: resp.Ephemeral,
+	}
+	if u := resp.Update; u != nil {
+		reply.Update = &mattermostUpdate{
+			Message: u.Text,
+			Props: map[string]interface{}{
+				"attachments": u.Attachments,
+			},
+		}
+	}
+	bb, err := json.Marshal(reply)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bb)
+	}
+}
@@ -0,0 +1,106 @@
+package engine
+
+import "bot/config"
+import "errors"
+import "fmt"
+import "strings"
+
+// Role orders what a user may do.  Each role includes the ones below it.
+type Role int
+
+const (
+	RoleUser Role = iota
+	RoleModerator
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleModerator:
+		return "moderator"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "user"
+}
+
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(s) {
+	case "", "user":
+		return RoleUser, nil
+	case "moderator":
+		return RoleModerator, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return RoleUser, fmt.Errorf("Unknown role %s", s)
+}
+
+var ErrForbidden = errors.New("You are not allowed to do that.")
+var ErrWrongChannel = errors.New("That command is not available in this channel.")
+
+// RoleOf returns the role the bot config grants to a Mattermost user ID.
+func (b *Bot) RoleOf(userID string) Role {
+	if userID == "" {
+		return RoleUser
+	}
+	auth := b.Config().Auth
+	for _, id := range auth.Admins {
+		if id == userID {
+			return RoleAdmin
+		}
+	}
+	for _, id := range auth.Moderators {
+		if id == userID {
+			return RoleModerator
+		}
+	}
+	return RoleUser
+}
+
+// HasRole reports whether the user holds at least role r.
+func (b *Bot) HasRole(userID string, r Role) bool {
+	return b.RoleOf(userID) >= r
+}
+
+// Authorize checks whether req may run command, a space separated
+// command path.  The most specific configured rule overrides min, the
+// role the plugin asks for by default, if it names a role; a rule that
+// only limits channels keeps min.
+func (b *Bot) Authorize(req *BotRequest, command string, min Role) error {
+	if rule := matchRule(b.Config().Auth.Rules, command); rule != nil {
+		if len(rule.Channels) > 0 && !inChannels(req, rule.Channels) {
+			return ErrWrongChannel
+		}
+		if rule.Role != "" {
+			min, _ = ParseRole(rule.Role)
+		}
+	}
+	if !b.HasRole(req.UserID, min) {
+		b.Log().Infof("Denied %s to user %s (%s)", command, req.UserName, req.UserID)
+		return ErrForbidden
+	}
+	return nil
+}
+
+func matchRule(rules []config.AuthRule, command string) *config.AuthRule {
+	var best *config.AuthRule
+	for i, r := range rules {
+		if command != r.Command && !strings.HasPrefix(command, r.Command + " ") {
+			continue
+		}
+		if best == nil || len(r.Command) > len(best.Command) {
+			best = &rules[i]
+		}
+	}
+	return best
+}
+
+func inChannels(req *BotRequest, channels []string) bool {
+	for _, c := range channels {
+		if c == req.ChannelID || c == req.ChannelName {
+			return true
+		}
+	}
+	return false
+}
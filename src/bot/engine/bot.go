@@ -1,238 +1,466 @@
 package engine
 
 import "os"
+import "strings"
+import "errors"
+import "context"
 import "bot/config"
 import "net/http"
 import "fmt"
-import "log"
-import "io/ioutil"
-import "strconv"
+import "bot/logging"
+import "bot/tmpl"
 import "github.com/gorilla/mux"
 import "encoding/json"
-import "errors"
-import "strings"
-import "regexp"
+import "time"
 
 func New(cfg *config.Config) (*Bot, error) {
-	if cfg.Username == "" {
-		return nil, errors.New("UserName required")
+	bot, err := NewOffline(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := bot.Start(); err != nil {
+		bot.Done()
+		return nil, err
+	}
+	bot.startWatch()
+	return bot, nil
+}
+
+// NewHosted is New for a bot served under /{username}/ by a shared host
+// rather than on its own port.
+func NewHosted(cfg *config.Config, h *Host) (*Bot, error) {
+	bot, err := NewOffline(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Mount(bot); err != nil {
+		bot.Done()
+		return nil, err
+	}
+	bot.startWatch()
+	return bot, nil
+}
+
+func (b *Bot) startWatch() {
+	if s := b.Config().WatchSeconds; s > 0 {
+		go b.watch(time.Duration(s) * time.Second)
+	}
+}
+
+// NewOffline starts a bot's plugins, outbox and scheduler without
+// listening for requests, for callers that pass requests to
+// HandleRequest themselves.  It holds the lock on the data directory
+// until Done.
+func NewOffline(cfg *config.Config, opts ...Option) (*Bot, error) {
+	if err := PrepareConfig(cfg); err != nil {
+		return nil, err
 	}
-	if cfg.Token == "" {
-		return nil, errors.New("Mattermost webhook token required")
+	lock, err := LockDataDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	registerSecrets(cfg)
+	bot := &Bot{
+		cfg: cfg,
+		log: logging.With("bot", cfg.Username),
+		metrics: newBotMetrics(),
+		limiter: newRateLimiter(cfg.RateLimit),
+		triggers: newTriggers(cfg.Triggers),
+		errc: make(chan error, 1),
+		quit: make(chan struct{}),
+		clock: RealClock,
+		lock: lock,
+	}	
+	for _, opt := range opts {
+		opt(bot)
+	}
+	bot.outbox = newOutbox(cfg, bot)
+	if err := bot.outbox.load(); err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("Loading outbox: %v", err)
+	}
+	if !bot.quiet {
+		bot.outbox.Start()
+	}
+	bot.scheduler = newScheduler(cfg, bot)
+	if err := bot.scheduler.load(); err != nil {
+		bot.Log().Warnf("Loading schedule failed, starting afresh: %v", err)
+	}
+	if !bot.quiet {
+		bot.scheduler.Start()
+	}
+	bot.Init()
+	return bot, nil
+}
+
+// registerSecrets keeps the bot's tokens out of the logs.
+func registerSecrets(cfg *config.Config) {
+	logging.AddSecret(cfg.Token)
+	for _, t := range cfg.SlashTokens {
+		logging.AddSecret(t)
+	}
+	logging.AddSecret(cfg.Slack.SigningSecret)
+}
+
+// DataRoot holds the data directories of bots whose config sets none.
+var DataRoot = "./data"
+
+// CheckConfig validates cfg, including its plugin list, without
+// changing anything.
+func CheckConfig(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-	if cfg.Port == 0 {
-		return nil, errors.New("Port required")
+	return checkPlugins(cfg)
+}
+
+// PrepareConfig validates cfg and fills in defaults for optional fields.
+func PrepareConfig(cfg *config.Config) error {
+	if err := CheckConfig(cfg); err != nil {
+		return err
 	}
 	if cfg.BaseURL == "" {
 		cfg.BaseURL = "localhost"
 	}
 	if cfg.DataDir == "" {
-		cfg.DataDir = fmt.Sprintf("./data/%s", cfg.Username)
+		cfg.DataDir = fmt.Sprintf("%s/%s", DataRoot, cfg.Username)
 		os.MkdirAll(cfg.DataDir, 0700)
 	}
-	bot := &Bot{
-		Config: cfg,
-	}	
-	bot.Init()
-	return bot, bot.Start()
+	return nil
+}
+
+// Config returns the bot's current configuration, which may be replaced
+// by a reload at any time.
+func (b *Bot) Config() *config.Config {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.cfg
 }
 
+// Start binds the listener before returning so that address errors are
+// reported to the caller, then serves requests in the background.
 func (b *Bot) Start() error {
+	if b.Config().Port == 0 {
+		return errors.New("Port required unless the bot shares a listener")
+	}
 	r := mux.NewRouter()
+	b.routes(r)
+	serveStatic(r)
+
+	cfg := b.Config()
+	addr := fmt.Sprintf("%s:%d", cfg.BaseURL, cfg.Port)
+	ln, err := listen(addr, cfg.TLS, b.Log())
+	if err != nil {
+		return err
+	}
+	if cfg.TLS.RedirectPort != 0 {
+		b.redirect, err = startRedirect(cfg.BaseURL, cfg.TLS.RedirectPort, cfg.Port, b.errc)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	b.server = &http.Server{
+		Addr: addr,
+		Handler: r,
+	}
+	go func() {
+		err := b.server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			b.errc <- err
+		}
+	}()
+
+	b.Log().Infof("Retrobot is available on %s", b.URL(""))
+	return nil
+}
+
+// routes adds the bot's endpoints to r.
+func (b *Bot) routes(r *mux.Router) {
 	r.HandleFunc( "/message", b.Message )
 	r.HandleFunc( "/slash/{command}", b.Slash)
+	r.HandleFunc( "/slack/slash", b.SlackSlash)
+	r.HandleFunc( "/slack/actions", b.SlackActions)
+	r.HandleFunc( "/actions/{plugin}/{id}", b.Action)
+	r.HandleFunc( "/dialog", b.DialogSubmit)
+	r.HandleFunc( "/healthz", b.Healthz )
+	r.HandleFunc( "/readyz", b.Readyz )
+	r.Handle( "/metrics", b.metrics.registry )
+}
+
+func serveStatic(r *mux.Router) {
 	r.PathPrefix("/static/").Handler(
 		http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))),
 	)
-	
+}
+
+// Log returns the logger tagged with this bot's name.
+func (b *Bot) Log() *logging.Logger {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.log
+}
+
+// Outbox returns the queue that plugins use for background posts.
+func (b *Bot) Outbox() *Outbox {
+	return b.outbox
+}
+
+// Scheduler returns the scheduler that runs plugins' periodic jobs.
+func (b *Bot) Scheduler() *Scheduler {
+	return b.scheduler
+}
+
+// Errors delivers failures of the HTTP server after a successful Start.
+func (b *Bot) Errors() <-chan error {
+	return b.errc
+}
+
+// Shutdown stops accepting requests, waits for in-flight handlers and
+// deferred work to finish (or ctx to expire) and then stops the plugins.
+func (b *Bot) Shutdown(ctx context.Context) error {
 	var err error
+	if b.redirect != nil {
+		b.redirect.Shutdown(ctx)
+	}
+	if b.server != nil {
+		err = b.server.Shutdown(ctx)
+	}
+	done := make(chan struct{})
 	go func() {
-		err = http.ListenAndServe( 
-			fmt.Sprintf("%s:%d", b.Config.BaseURL, b.Config.Port),
-			r,
-		)
+		b.work.Wait()
+		close(done)
 	}()
-
-	if err == nil {
-		log.Printf("Retrobot is available on %s:%d", b.Config.BaseURL, b.Config.Port)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
 	}
-			
+	b.Done()
 	return err
 }
 
 func (b *Bot) Slash( w http.ResponseWriter, r *http.Request ) {
-	if r.Method == "POST" {
-		r.ParseForm()
-		bb, err := ioutil.ReadAll(r.Body)
-		if err == nil {
-			log.Printf("Request with content-type: %s", r.Header.Get("Content-Type"))
-			log.Printf("Request body: %s", string(bb))
-			var req BotRequest
-			switch r.Header.Get("Content-Type") {
-			case "application/json":
-				err = json.Unmarshal(bb, &req)
-				if err != nil {
-					return
-				}
-			case "application/x-www-form-urlencoded":
-				req.Token = r.Form.Get("token")
-				req.UserName = r.Form.Get("user_name")
-				req.UserID = r.Form.Get("user_id")
-				req.TriggerWord = r.Form.Get("trigger_word")
-				req.ChannelID = r.Form.Get("channel_id")
-				req.ChannelName = r.Form.Get("channel_name")
-				req.TeamDomain = r.Form.Get("team_domain")
-				req.TeamID = r.Form.Get("team_id")
-				req.PostID = r.Form.Get("post_id")
-				req.Text = r.Form.Get("text")
-				req.Timestamp, _ = strconv.ParseInt(r.Form.Get("timestamp"), 10, 64)				
-			default:
-				log.Printf("Unknown request type. Skipping")
-			}
-			if b.Config.IsTokenValid(true, req.Token) {
-				// request ok
-				log.Println("Token was valid")
-			} else {
-				log.Println("Ignoring invalid token")
-				return
-			}
-			log.Printf("Parsed request is : %+v", req)
-
-			// in the base of a slash, reappend things
-			req.Text = mux.Vars(r)["command"] + " " + req.Text
-
-			resp := b.HandleRequest( &req )
-			if resp != nil {
-				if resp.ResponseType == "" {
-					resp.ResponseType = "in_channel"
-				}
-				bb, err = json.Marshal(resp)
-				if err == nil {
-					w.Header().Set("Content-Type", "application/json")
-					w.Write(bb)
-					return
-				}			
-			}
-		}		
-	} else {
-		log.Printf("Invalid request method: %s", r.Method)
-	}
+	b.serve(w, r, SourceSlash)
 }
 
 func (b *Bot) Message( w http.ResponseWriter, r *http.Request ) {
+	b.serve(w, r, SourceWebhook)
+}
+
+func (b *Bot) serve( w http.ResponseWriter, r *http.Request, source RequestSource ) {
+	if r.Method != "POST" {
+		b.Log().Warnf("Invalid request method: %s", r.Method)
+		return
+	}
+	start := time.Now()
+	defer func() {
+		b.metrics.latency.Observe(time.Since(start).Seconds(), source.String())
+	}()
+	req, err := DecodeRequest(r, source)
+	if err != nil {
+		b.Log().Warnf("Failed to decode %s request: %v", source, err)
+		return
+	}
+	if !b.Config().IsTokenValid(req.IsSlash(), req.Token) {
+		b.Log().Warnf("Ignoring %s request with invalid token from %s", source, r.RemoteAddr)
+		b.metrics.tokenRejections.Inc(source.String())
+		return
+	}
+	b.Log().Debugf("%s request from %s in %s: %q", source, req.UserName, req.ChannelName, req.Text)
+
+	if req.IsSlash() {
+		// in the base of a slash, reappend things
+		req.Text = mux.Vars(r)["command"] + " " + req.Text
+	}
+
+	b.respond(w, req)
+}
 
-	if r.Method == "POST" {
-		r.ParseForm()
-		bb, err := ioutil.ReadAll(r.Body)
+// respond answers req over w, in the format of the platform it came from.
+func (b *Bot) respond( w http.ResponseWriter, req *BotRequest ) {
+	resp := b.HandleRequest( req )
+	if resp != nil {
+		if req.IsSlash() && resp.ResponseType == "" {
+			resp.ResponseType = "in_channel"
+		}
+		bb, err := json.Marshal(encodeResponse(req.Platform, resp))
 		if err == nil {
-			log.Printf("Request with content-type: %s", r.Header.Get("Content-Type"))
-			log.Printf("Request body: %s", string(bb))
-			var req BotRequest
-			switch r.Header.Get("Content-Type") {
-			case "application/json":
-				err = json.Unmarshal(bb, &req)
-				if err != nil {
-					return
-				}
-			case "application/x-www-form-urlencoded":
-				req.Token = r.Form.Get("token")
-				req.UserName = r.Form.Get("user_name")
-				req.UserID = r.Form.Get("user_id")
-				req.TriggerWord = r.Form.Get("trigger_word")
-				req.ChannelID = r.Form.Get("channel_id")
-				req.ChannelName = r.Form.Get("channel_name")
-				req.TeamDomain = r.Form.Get("team_domain")
-				req.TeamID = r.Form.Get("team_id")
-				req.PostID = r.Form.Get("post_id")
-				req.Text = r.Form.Get("text")
-				req.Timestamp, _ = strconv.ParseInt(r.Form.Get("timestamp"), 10, 64)				
-			default:
-				log.Printf("Unknown request type. Skipping")
-			}
-			if b.Config.IsTokenValid(false, req.Token) {
-				// request ok
-				log.Println("Token was valid")
-			} else {
-				log.Println("Ignoring invalid token")
-				return
-			}
-			log.Printf("Parsed request is : %+v", req)
-
-			resp := b.HandleRequest( &req )
-			if resp != nil {
-				bb, err = json.Marshal(resp)
-				if err == nil {
-					w.Header().Set("Content-Type", "application/json")
-					w.Write(bb)
-					return
-				}			
-			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(bb)
 		}
-	} else {
-		log.Printf("Invalid request method %s", r.Method)
 	}
-	
 }
 
-var reField = regexp.MustCompile("([$][{]([^${}]+)[}])")
+// TemplateData describes the bot to templates: ${bot.username},
+// ${bot.baseurl}, ${bot.port}, ${bot.scheme} and ${bot.url}, the address
+// of its endpoints, with ${baseurl}, ${port} and ${scheme} kept as short
+// forms.  ${env.NAME} is an environment variable named in templateenv.
+func (b *Bot) TemplateData() tmpl.Data {
+	cfg := b.Config()
+	env := make(map[string]string, len(cfg.TemplateEnv))
+	for _, name := range cfg.TemplateEnv {
+		env[name] = os.Getenv(name)
+	}
+	return tmpl.Data{
+		"env": env,
+		"bot": map[string]interface{}{
+			"username": cfg.Username,
+			"baseurl": cfg.BaseURL,
+			"port": b.Port(),
+			"scheme": b.Scheme(),
+			"url": b.URL(""),
+			"iconurl": cfg.IconURL,
+		},
+		"baseurl": cfg.BaseURL,
+		"port": b.Port(),
+		"scheme": b.Scheme(),
+	}
+}
+
+// RequestData describes req to templates: ${user} and ${channel} are
+// names, ${user.id} and ${channel.id} IDs, and ${request.<field>} any
+// field of the request except its token.
+func RequestData(req *BotRequest) tmpl.Data {
+	r := *req
+	r.Token = ""
+	return tmpl.Data{
+		"request": &r,
+		"user": req.UserName,
+		"user.id": req.UserID,
+		"channel": req.ChannelName,
+		"channel.id": req.ChannelID,
+	}
+}
+
+// Render executes the template src against data and the bot's own
+// TemplateData.  Errors are logged and render as "".
+func (b *Bot) Render( src string, data tmpl.Data ) string {
+	all := b.TemplateData()
+	for k, v := range data {
+		all[k] = v
+	}
+	out, err := tmpl.Render(src, all)
+	if err != nil {
+		b.Log().Warnf("Rendering %q failed: %v", src, err)
+	}
+	return out
+}
 
+// Expand renders a config value, such as the icon URL, that may refer to
+// the bot's own settings.  When the bot serves HTTPS, http URLs of the
+// bot itself become https, so that configs written for plain HTTP keep
+// working.
 func (b *Bot) Expand( value string ) string {
-	return b.expand(value)
-}
-
-func (b *Bot) expand( value string ) string {
-	for reField.MatchString(value) {
-		m := reField.FindAllStringSubmatch(value, -1)
-		fullPattern := m[0][1]
-		name := m[0][2]
-		log.Printf("Got field match %s (%s)", fullPattern, name)
-		var replacement string
-		switch name {
-		case "baseurl":
-			replacement = b.Config.BaseURL
-		case "port":
-			replacement = fmt.Sprintf("%d", b.Config.Port)
-		}
-		log.Printf("Replace %s with %s", fullPattern, replacement)
-		value = strings.Replace(value, fullPattern, replacement, -1)
+	out := b.Render(value, nil)
+	if b.Scheme() == "https" && strings.HasPrefix(out, "http://"+b.Config().BaseURL) {
+		out = "https://" + strings.TrimPrefix(out, "http://")
 	}
-	return value
+	return out
 }
 
 func (b *Bot) HandleRequest( req *BotRequest ) *BotResponse {
-	for _, p := range b.Plugins {
+	if resp := b.throttle(req); resp != nil {
+		b.decorate(resp)
+		return resp
+	}
+	if resp, ok := b.resume(req); ok {
+		return resp
+	}
+	triggersFirst := b.Config().TriggerOrder == "before"
+	if triggersFirst {
+		if resp := b.handleTrigger(req); resp != nil {
+			return resp
+		}
+	}
+	for _, p := range b.activePlugins() {
 		resp, ok := p.Handle(b, req)
 		if ok && resp != nil {
-			if resp.UserName == "" {
-				resp.UserName = b.Config.Username
-			}
-			if resp.IconURL == "" {
-				resp.IconURL = b.expand(b.Config.IconURL)
+			var cmds []*Command
+			if c, ok := p.(Commander); ok {
+				cmds = c.Commands()
 			}
+			b.metrics.requests.Inc(req.Source.String(), p.Name(), commandLabel(cmds, req))
+			b.decorate(resp)
 			return resp
 		}
 	}	
+	if resp, ok := handleCommands(b.commands(), b, req); ok && resp != nil {
+		b.metrics.requests.Inc(req.Source.String(), "bot", commandLabel(b.commands(), req))
+		b.decorate(resp)
+		return resp
+	}
+	if resp := b.help(req); resp != nil {
+		b.metrics.requests.Inc(req.Source.String(), "bot", "help")
+		b.decorate(resp)
+		return resp
+	}
+	if !triggersFirst {
+		if resp := b.handleTrigger(req); resp != nil {
+			return resp
+		}
+	}
+	b.metrics.requests.Inc(req.Source.String(), "none", "")
 	return nil
 }
 
+func (b *Bot) handleTrigger( req *BotRequest ) *BotResponse {
+	resp := b.trigger(req)
+	if resp != nil {
+		b.metrics.requests.Inc(req.Source.String(), "bot", "trigger")
+		b.decorate(resp)
+	}
+	return resp
+}
+
+// decorate fills in the bot's identity on responses that don't set one.
+func (b *Bot) decorate( resp *BotResponse ) {
+	if resp.UserName == "" {
+		resp.UserName = b.Config().Username
+	}
+	if resp.IconURL == "" {
+		resp.IconURL = b.Expand(b.Config().IconURL)
+	}
+}
+
 func (b *Bot) Init() {
 	b.Plugins = GetPlugins(b)
 	b.InitPlugins()
 }
 
 func (b *Bot) Done() {
+	b.stopOnce.Do(func() {
+		close(b.quit)
+	})
+	if b.scheduler != nil {
+		b.scheduler.Stop()
+	}
 	b.DonePlugins()
+	if b.outbox != nil {
+		b.outbox.Stop()
+	}
+	b.lock.Unlock()
 }
 
 func (b *Bot) InitPlugins() {
-	for _, p := range b.Plugins {
-		p.SetConfigPath( b.Config.DataDir + "/" + p.Name() )
-		p.Init()
+	pcs := pluginConfigs(b.Config())
+	for i, p := range b.Plugins {
+		b.startPlugin(p, pcs[i].Settings)
 	}
 }
 
+// activePlugins returns the current plugin set, which a reload may
+// replace at any time.
+func (b *Bot) activePlugins() []Plugin {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.Plugins
+}
+
 func (b *Bot) DonePlugins() {
-	for _, p := range b.Plugins {
-		p.Done()
+	for _, p := range b.activePlugins() {
+		stopPlugin(p)
 	}	
 }
\ No newline at end of file
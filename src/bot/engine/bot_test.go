@@ -0,0 +1,22 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine/enginetest"
+import "os"
+import "testing"
+
+func TestTemplateEnv(t *testing.T) {
+	os.Setenv("RETROBOT_TEST_SHOWN", "shown")
+	os.Setenv("RETROBOT_TEST_HIDDEN", "hidden")
+	defer os.Unsetenv("RETROBOT_TEST_SHOWN")
+	defer os.Unsetenv("RETROBOT_TEST_HIDDEN")
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+		Config: func(cfg *config.Config) {
+			cfg.TemplateEnv = []string{"RETROBOT_TEST_SHOWN"}
+		},
+	})
+	if got := h.Bot.Expand("[${env.RETROBOT_TEST_SHOWN}][${env.RETROBOT_TEST_HIDDEN}]"); got != "[shown][]" {
+		t.Errorf("Got %q", got)
+	}
+}
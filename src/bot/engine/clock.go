@@ -0,0 +1,46 @@
+package engine
+
+import "time"
+
+// Clock tells the scheduler and plugins the time.  Tests substitute a
+// clock they can move forward by hand; see package enginetest.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// RealClock is the wall clock, used unless a bot is given another.
+var RealClock Clock = realClock{}
+
+// Option adjusts a bot before its plugins start.
+type Option func(b *Bot)
+
+// WithClock makes the bot and its plugins use c for the time.
+func WithClock(c Clock) Option {
+	return func(b *Bot) {
+		b.clock = c
+	}
+}
+
+// WithoutBackground keeps the outbox and scheduler stopped, so that
+// nothing is posted or polled except in answer to HandleRequest.
+func WithoutBackground() Option {
+	return func(b *Bot) {
+		b.quiet = true
+	}
+}
+
+// Now returns the current time according to the bot's clock.
+func (b *Bot) Now() time.Time {
+	return b.clock.Now()
+}
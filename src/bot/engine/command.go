@@ -0,0 +1,275 @@
+package engine
+
+import "fmt"
+import "sort"
+import "strconv"
+import "strings"
+import "unicode"
+
+type ArgType int
+
+const (
+	ArgString ArgType = iota
+	ArgInt
+)
+
+// Arg declares one positional argument of a command.  A Rest argument
+// takes the remainder of the line, spaces included, and must come last.
+type Arg struct {
+	Name string
+	Type ArgType
+	Optional bool
+	Rest bool
+}
+
+func (a *Arg) usage() string {
+	name := a.Name
+	if a.Rest {
+		name += "..."
+	}
+	if a.Optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// Command declares a chat command.  When the first argument names one of
+// Subcommands, that subcommand handles the request; otherwise Args are
+// validated and Run is called.  "help" after any command shows usage
+// generated from these declarations.  Role is the minimum role needed to
+// run the command unless an auth rule in the bot config says otherwise.
+type Command struct {
+	Name string
+	Usage string
+	Role Role
+	Args []Arg
+	Subcommands []*Command
+	Run func(ctx *CommandContext) *BotResponse
+}
+
+// Commander is implemented by plugins that declare their commands, so the
+// bot can list them in its global help.
+type Commander interface {
+	Commands() []*Command
+}
+
+// CommandContext carries a validated command invocation to its handler.
+type CommandContext struct {
+	Bot *Bot
+	Request *BotRequest
+	Command *Command
+	Path []string
+	args map[string]string
+}
+
+// Arg returns the named argument, or "" if an optional one was omitted.
+func (c *CommandContext) Arg(name string) string {
+	return c.args[name]
+}
+
+// Int returns a named ArgInt argument, or 0 if it was omitted.
+func (c *CommandContext) Int(name string) int {
+	i, _ := strconv.Atoi(c.args[name])
+	return i
+}
+
+// Has reports whether the named argument was given.
+func (c *CommandContext) Has(name string) bool {
+	_, ok := c.args[name]
+	return ok
+}
+
+// commandText returns the request text with any trigger word removed.
+func commandText(req *BotRequest) string {
+	s := req.Text
+	if req.TriggerWord != "" && strings.HasPrefix(s, req.TriggerWord) {
+		s = s[len(req.TriggerWord):]
+	}
+	return strings.TrimSpace(s)
+}
+
+// nextWord splits the first whitespace separated word off s.
+func nextWord(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// HandleCommands routes req to the matching command in cmds.  Plugins
+// that declare their commands call it from Handle.
+func (b *PluginBase) HandleCommands( cmds []*Command, bot *Bot, req *BotRequest ) (*BotResponse, bool) {
+	return handleCommands(cmds, bot, req)
+}
+
+func handleCommands( cmds []*Command, bot *Bot, req *BotRequest ) (*BotResponse, bool) {
+	name, rest := nextWord(commandText(req))
+	for _, c := range cmds {
+		if c.Name == name {
+			return c.dispatch(bot, req, []string{c.Name}, rest), true
+		}
+	}
+	return nil, false
+}
+
+func (c *Command) dispatch( bot *Bot, req *BotRequest, path []string, rest string ) *BotResponse {
+	word, after := nextWord(rest)
+	if word == "help" && strings.TrimSpace(after) == "" {
+		return helpResponse(c.help(path[:len(path)-1]))
+	}
+	for _, sub := range c.Subcommands {
+		if sub.Name == word {
+			return sub.dispatch(bot, req, append(path, sub.Name), after)
+		}
+	}
+
+	if err := bot.Authorize(req, strings.Join(path, " "), c.Role); err != nil {
+		return &BotResponse{
+			Text: err.Error(),
+			ResponseType: "ephemeral",
+		}
+	}
+
+	ctx := &CommandContext{
+		Bot: bot,
+		Request: req,
+		Command: c,
+		Path: path,
+		args: make(map[string]string),
+	}
+	for _, a := range c.Args {
+		var v string
+		if a.Rest {
+			v, rest = strings.TrimSpace(rest), ""
+		} else {
+			v, rest = nextWord(rest)
+		}
+		if v == "" {
+			if !a.Optional {
+				return c.usageError(path, fmt.Sprintf("Missing %s.", a.usage()))
+			}
+			continue
+		}
+		if a.Type == ArgInt {
+			if _, err := strconv.Atoi(v); err != nil {
+				return c.usageError(path, fmt.Sprintf("%s must be a number.", a.usage()))
+			}
+		}
+		ctx.args[a.Name] = v
+	}
+	if strings.TrimSpace(rest) != "" {
+		return c.usageError(path, "Too many arguments.")
+	}
+	if c.Run == nil {
+		return helpResponse(c.help(path[:len(path)-1]))
+	}
+	return c.Run(ctx)
+}
+
+func (c *Command) usageError( path []string, msg string ) *BotResponse {
+	return &BotResponse{
+		Text: msg + "\n" + helpBlock(c.help(path[:len(path)-1])),
+		ResponseType: "ephemeral",
+	}
+}
+
+// help lists one usage line per runnable form of c and its subcommands.
+func (c *Command) help( parents []string ) [][2]string {
+	path := append(append([]string{}, parents...), c.Name)
+	lines := make([][2]string, 0)
+	for _, sub := range c.Subcommands {
+		lines = append(lines, sub.help(path)...)
+	}
+	if c.Run != nil {
+		parts := []string{"/" + strings.Join(path, " ")}
+		for _, a := range c.Args {
+			parts = append(parts, a.usage())
+		}
+		lines = append(lines, [2]string{strings.Join(parts, " "), c.Usage})
+	}
+	return lines
+}
+
+// helpBlock formats usage lines as an aligned code block.
+func helpBlock( lines [][2]string ) string {
+	return tableBlock("Help", lines)
+}
+
+// tableBlock formats two column lines as an aligned, titled code block.
+func tableBlock( title string, lines [][2]string ) string {
+	width := 0
+	for _, l := range lines {
+		if len(l[0]) > width {
+			width = len(l[0])
+		}
+	}
+	out := "```" + title + ":\n"
+	for _, l := range lines {
+		out += fmt.Sprintf("%-*s %s\n", width, l[0], l[1])
+	}
+	return out + "```\n"
+}
+
+func helpResponse( lines [][2]string ) *BotResponse {
+	return &BotResponse{
+		Text: helpBlock(lines),
+		ResponseType: "ephemeral",
+	}
+}
+
+// help answers the global "help" command with a summary of every
+// declared command, or "help <command>" with that command's usage.
+func (b *Bot) help( req *BotRequest ) *BotResponse {
+	word, rest := nextWord(commandText(req))
+	if word != "help" {
+		return nil
+	}
+	cmds := b.allCommands()
+	name := strings.TrimSpace(rest)
+	if name != "" {
+		for _, c := range cmds {
+			if c.Name == name {
+				return helpResponse(c.help(nil))
+			}
+		}
+		return &BotResponse{
+			Text: fmt.Sprintf("No such command %s.", name),
+			ResponseType: "ephemeral",
+		}
+	}
+	sort.SliceStable(cmds, func(i, j int) bool {
+		return cmds[i].Name < cmds[j].Name
+	})
+	lines := make([][2]string, 0, len(cmds)+1)
+	for _, c := range cmds {
+		lines = append(lines, [2]string{"/" + c.Name, c.Usage})
+	}
+	lines = append(lines, [2]string{"/help <command>", "Show usage of a command."})
+	return helpResponse(lines)
+}
+
+// commands are the commands the bot itself provides.
+func (b *Bot) commands() []*Command {
+	return []*Command{
+		{
+			Name: "jobs",
+			Usage: "List scheduled jobs.",
+			Role: RoleAdmin,
+			Run: b.jobs,
+		},
+	}
+}
+
+// allCommands returns the bot's own commands and those every active
+// plugin declares.
+func (b *Bot) allCommands() []*Command {
+	cmds := b.commands()
+	for _, p := range b.activePlugins() {
+		if c, ok := p.(Commander); ok {
+			cmds = append(cmds, c.Commands()...)
+		}
+	}
+	return cmds
+}
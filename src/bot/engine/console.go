@@ -0,0 +1,235 @@
+package engine
+
+import "bufio"
+import "fmt"
+import "io"
+import "strings"
+import "time"
+
+// Console feeds lines typed at a terminal, or read from a transcript, to
+// a bot as if they came from a Mattermost user, and prints the answers.
+// Lines starting with / are sent as slash commands, others as outgoing
+// webhook messages.  Lines starting with : change the console itself:
+//
+//	:user <name> [id]      speak as another user
+//	:channel <name> [id]   speak in another channel
+//	:sleep <duration>      pause a transcript, e.g. :sleep 2s
+//	:click <label> [value] click a button of the last answer, or pick
+//	                       value from its menu
+//	:quit                  stop reading
+//
+// Blank lines and lines starting with # are skipped.
+type Console struct {
+	Bot *Bot
+	UserName string
+	UserID string
+	ChannelName string
+	ChannelID string
+	TeamDomain string
+	// Echo prints each input line before its answer, for transcripts.
+	Echo bool
+	// Interactive prompts for each line with the current user name.
+	Interactive bool
+	last *BotResponse
+}
+
+// Run reads lines from in until EOF or :quit, writing answers to out.
+func (c *Console) Run(in io.Reader, out io.Writer) error {
+	sc := bufio.NewScanner(in)
+	for {
+		if c.Interactive {
+			fmt.Fprintf(out, "%s> ", c.UserName)
+		}
+		if !sc.Scan() {
+			break
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if c.Echo {
+			fmt.Fprintf(out, "%s> %s\n", c.UserName, line)
+		}
+		if strings.HasPrefix(line, ":") {
+			quit, err := c.directive(line[1:], out)
+			if err != nil {
+				fmt.Fprintf(out, "! %v\n", err)
+			}
+			if quit {
+				return nil
+			}
+			continue
+		}
+		resp := c.Bot.HandleRequest(c.Request(line))
+		if resp == nil {
+			fmt.Fprintln(out, "(no response)")
+			continue
+		}
+		c.last = resp
+		WriteResponse(out, resp)
+	}
+	if c.Interactive {
+		fmt.Fprintln(out)
+	}
+	return sc.Err()
+}
+
+func (c *Console) directive(line string, out io.Writer) (bool, error) {
+	word, rest := nextWord(line)
+	args := strings.Fields(rest)
+	switch word {
+	case "quit", "exit":
+		return true, nil
+	case "user", "channel":
+		if len(args) < 1 || len(args) > 2 {
+			return false, fmt.Errorf("Usage: :%s <name> [id]", word)
+		}
+		id := args[0]
+		if len(args) == 2 {
+			id = args[1]
+		}
+		if word == "user" {
+			c.UserName, c.UserID = args[0], id
+		} else {
+			c.ChannelName, c.ChannelID = args[0], id
+		}
+		return false, nil
+	case "sleep":
+		if len(args) != 1 {
+			return false, fmt.Errorf("Usage: :sleep <duration>")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return false, err
+		}
+		time.Sleep(d)
+		return false, nil
+	case "click":
+		if len(args) < 1 {
+			return false, fmt.Errorf("Usage: :click <label> [value]")
+		}
+		return false, c.click(args[0], strings.Join(args[1:], " "), out)
+	}
+	return false, fmt.Errorf("Unknown directive :%s", word)
+}
+
+// click acts on the action labelled label in the last answer.
+func (c *Console) click(label string, value string, out io.Writer) error {
+	act := findAction(c.last, label)
+	if act == nil {
+		return fmt.Errorf("No action %s in the last answer", label)
+	}
+	resp, err := c.Bot.Click(act, c.Request(""), value)
+	if err != nil {
+		return err
+	}
+	if resp.Update != nil {
+		c.last = resp.Update
+		WriteResponse(out, resp.Update)
+	}
+	if resp.Ephemeral != "" {
+		WriteResponse(out, &BotResponse{
+			UserName: c.Bot.Config().Username,
+			Text: resp.Ephemeral,
+			ResponseType: "ephemeral",
+		})
+	}
+	if resp.Update == nil && resp.Ephemeral == "" {
+		fmt.Fprintln(out, "(no response)")
+	}
+	return nil
+}
+
+func findAction(resp *BotResponse, label string) *AttachmentAction {
+	if resp == nil {
+		return nil
+	}
+	for _, a := range resp.Attachments {
+		for _, act := range a.Actions {
+			if strings.EqualFold(act.Name, label) {
+				return act
+			}
+		}
+	}
+	return nil
+}
+
+// Request builds the request Mattermost would send for line.
+func (c *Console) Request(line string) *BotRequest {
+	req := &BotRequest{
+		ChannelID: c.ChannelID,
+		ChannelName: c.ChannelName,
+		TeamDomain: c.TeamDomain,
+		Text: line,
+		Timestamp: time.Now().Unix(),
+		Token: c.Bot.Config().Token,
+		UserID: c.UserID,
+		UserName: c.UserName,
+		Source: SourceWebhook,
+	}
+	if strings.HasPrefix(line, "/") {
+		command, args := nextWord(line)
+		req.Command = command
+		req.Text = strings.TrimSpace(command[1:] + " " + strings.TrimSpace(args))
+		req.Source = SourceSlash
+	}
+	return req
+}
+
+// WriteResponse prints resp as plain text, with attachments indented
+// below the message.
+func WriteResponse(w io.Writer, resp *BotResponse) {
+	name := resp.UserName
+	if resp.ResponseType == "ephemeral" {
+		name += " (only visible to you)"
+	}
+	fmt.Fprintf(w, "%s:\n", name)
+	if resp.Text != "" {
+		writeIndented(w, "  ", resp.Text)
+	}
+	for _, a := range resp.Attachments {
+		if a.Pretext != "" {
+			writeIndented(w, "  ", a.Pretext)
+		}
+		if a.AuthorName != "" {
+			writeIndented(w, "  | ", a.AuthorName)
+		}
+		if a.Title != "" {
+			title := a.Title
+			if a.TitleLink != "" {
+				title += " <" + a.TitleLink + ">"
+			}
+			writeIndented(w, "  | ", title)
+		}
+		if a.Text != "" {
+			writeIndented(w, "  | ", a.Text)
+		}
+		for _, f := range a.Fields {
+			writeIndented(w, "  | ", f.Title+": "+f.Value)
+		}
+		if a.ImageURL != "" {
+			writeIndented(w, "  | ", "[image "+a.ImageURL+"]")
+		}
+		if len(a.Actions) > 0 {
+			labels := make([]string, 0, len(a.Actions))
+			for _, act := range a.Actions {
+				label := act.Name
+				if len(act.Options) > 0 {
+					values := make([]string, 0, len(act.Options))
+					for _, o := range act.Options {
+						values = append(values, o.Value)
+					}
+					label += ": " + strings.Join(values, "|")
+				}
+				labels = append(labels, "["+label+"]")
+			}
+			writeIndented(w, "  | ", strings.Join(labels, " "))
+		}
+	}
+}
+
+func writeIndented(w io.Writer, prefix string, text string) {
+	for _, l := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		fmt.Fprintf(w, "%s%s\n", prefix, l)
+	}
+}
@@ -0,0 +1,57 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "strings"
+import "testing"
+
+const consoleTranscript = `
+# a comment, skipped
+gem add the build is green
+:user alice alice-id
+/roll 1d1
+gem remove 0
+:user tester tester-id
+gem remove 0
+:click Remove
+:click Remove
+:channel
+:bogus
+nothing to see
+:quit
+gem
+`
+
+func TestConsoleTranscript(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Gem"}, {Name: "Dice"}},
+	})
+	con := &engine.Console{
+		Bot: h.Bot,
+		UserName: enginetest.UserName,
+		UserID: enginetest.UserID,
+		ChannelName: enginetest.ChannelName,
+		ChannelID: enginetest.ChannelID,
+		Echo: true,
+	}
+	var out strings.Builder
+	if err := con.Run(strings.NewReader(consoleTranscript), &out); err != nil {
+		t.Fatal(err)
+	}
+	enginetest.AssertGolden(t, "console", strings.Split(out.String(), "\n"))
+}
+
+// Lines starting with / are slash commands, with the command in the text
+// as Mattermost sends it.
+func TestConsoleRequest(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{Plugins: []config.PluginConfig{{Name: "Dice"}}})
+	con := &engine.Console{Bot: h.Bot, UserName: "alice", UserID: "alice-id"}
+	req := con.Request("/roll  2d6 ")
+	if !req.IsSlash() || req.Command != "/roll" || req.Text != "roll 2d6" || req.Token != "test-token" {
+		t.Errorf("Got %+v", req)
+	}
+	if req = con.Request("roll 2d6"); !req.IsWebhook() || req.Text != "roll 2d6" || req.UserID != "alice-id" {
+		t.Errorf("Got %+v", req)
+	}
+}
@@ -0,0 +1,182 @@
+package engine
+
+import "errors"
+import "fmt"
+import "time"
+
+const conversationCollection = "conversations"
+const conversationDefaultTimeout = 5 * time.Minute
+
+// Reply is the next request from a user a plugin asked something of,
+// with what the plugin stored when asking.
+type Reply struct {
+	Request *BotRequest
+	ID string
+	Context map[string]interface{}
+}
+
+// String returns a context value as a string.
+func (r *Reply) String(key string) string {
+	v, ok := r.Context[key]
+	if !ok {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// Bool returns a context value as a bool.
+func (r *Reply) Bool(key string) bool {
+	v, _ := r.Context[key].(bool)
+	return v
+}
+
+// Strings returns a context value holding a list of strings.
+func (r *Reply) Strings(key string) []string {
+	list, _ := r.Context[key].([]interface{})
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		out = append(out, fmt.Sprint(v))
+	}
+	return out
+}
+
+// ConversationHandler is implemented by plugins that ask follow-up
+// questions with Bot.Ask.  HandleReply reports whether the request was
+// the answer; if not, the question stays open and the request is
+// handled as usual.  Asking again from HandleReply keeps the
+// conversation going.
+type ConversationHandler interface {
+	HandleReply(b *Bot, reply *Reply) (*BotResponse, bool)
+}
+
+// conversationState is a pending question, kept in the asking plugin's
+// store so that it survives restarts.
+type conversationState struct {
+	Prompt string
+	Context map[string]interface{} `yaml:",omitempty"`
+	Asked time.Time
+	Expires time.Time
+}
+
+type storeOpener interface {
+	Store() (*Store, error)
+}
+
+func conversationKey(req *BotRequest) string {
+	return req.UserID + "/" + req.ChannelID
+}
+
+func conversations(p Plugin) (*Collection, error) {
+	so, ok := p.(storeOpener)
+	if !ok {
+		return nil, errors.New("Plugin has no store")
+	}
+	s, err := so.Store()
+	if err != nil {
+		return nil, err
+	}
+	return s.Collection(conversationCollection), nil
+}
+
+// Ask routes the next request from req's user in req's channel to p's
+// HandleReply with id and ctx, unless timeout passes first; zero means
+// five minutes.  It replaces any question p already had open there.
+// Values in ctx must survive a trip through YAML.
+func (b *Bot) Ask(p Plugin, req *BotRequest, id string, ctx map[string]interface{}, timeout time.Duration) error {
+	if _, ok := p.(ConversationHandler); !ok {
+		return fmt.Errorf("Plugin %s can't handle replies", p.Name())
+	}
+	if timeout <= 0 {
+		timeout = conversationDefaultTimeout
+	}
+	coll, err := conversations(p)
+	if err != nil {
+		return err
+	}
+	now := b.Now()
+	b.expireConversations(coll, now)
+	return coll.Put(conversationKey(req), &conversationState{
+		Prompt: id,
+		Context: ctx,
+		Asked: now,
+		Expires: now.Add(timeout),
+	})
+}
+
+// Forget drops any question p has open for req's user and channel.
+func (b *Bot) Forget(p Plugin, req *BotRequest) error {
+	coll, err := conversations(p)
+	if err != nil {
+		return err
+	}
+	return coll.Delete(conversationKey(req))
+}
+
+// expireConversations drops questions nobody answered in time.
+func (b *Bot) expireConversations(coll *Collection, now time.Time) {
+	for _, id := range coll.IDs() {
+		st := &conversationState{}
+		if ok, err := coll.Get(id, st); err != nil || (ok && now.After(st.Expires)) {
+			coll.Delete(id)
+		}
+	}
+}
+
+// resume offers req to the plugin with the most recent open question for
+// its user and channel, reporting whether the plugin took it.
+func (b *Bot) resume(req *BotRequest) (*BotResponse, bool) {
+	if req.UserID == "" {
+		return nil, false
+	}
+	key := conversationKey(req)
+	now := b.Now()
+	var owner Plugin
+	var coll *Collection
+	var state *conversationState
+	for _, p := range b.activePlugins() {
+		if _, ok := p.(ConversationHandler); !ok {
+			continue
+		}
+		c, err := conversations(p)
+		if err != nil {
+			continue
+		}
+		st := &conversationState{}
+		if ok, err := c.Get(key, st); !ok || err != nil {
+			continue
+		}
+		if now.After(st.Expires) {
+			c.Delete(key)
+			continue
+		}
+		if state == nil || st.Asked.After(state.Asked) {
+			owner, coll, state = p, c, st
+		}
+	}
+	if owner == nil {
+		return nil, false
+	}
+	// cleared first so that the handler can ask again
+	if err := coll.Delete(key); err != nil {
+		b.Log().Warnf("Clearing conversation of %s failed: %v", req.UserName, err)
+	}
+	resp, ok := owner.(ConversationHandler).HandleReply(b, &Reply{
+		Request: req,
+		ID: state.Prompt,
+		Context: state.Context,
+	})
+	if !ok {
+		if found, _ := coll.Get(key, &conversationState{}); !found {
+			coll.Put(key, state)
+		}
+		return nil, false
+	}
+	b.metrics.requests.Inc(req.Source.String(), owner.Name(), "reply")
+	if resp != nil {
+		b.decorate(resp)
+	}
+	return resp, true
+}
@@ -0,0 +1,110 @@
+package engine
+
+import "io"
+import "io/ioutil"
+import "mime"
+import "net/http"
+import "net/url"
+import "strconv"
+import "strings"
+import "encoding/json"
+import "fmt"
+import "golang.org/x/net/html/charset"
+
+const maxMultipartMemory = 1 << 20
+
+// DecodeRequest parses an inbound Mattermost request into a BotRequest.
+// Form, multipart and JSON bodies are accepted, and bodies declared in a
+// charset other than UTF-8 are transcoded before parsing.
+func DecodeRequest(r *http.Request, source RequestSource) (*BotRequest, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad content-type: %v", err)
+	}
+	req := &BotRequest{
+		Source: source,
+	}
+	switch mediaType {
+	case "application/json":
+		body, err := readBody(r.Body, params["charset"])
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(body, req); err != nil {
+			return nil, err
+		}
+	case "application/x-www-form-urlencoded":
+		body, err := readBody(r.Body, params["charset"])
+		if err != nil {
+			return nil, err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		req.fromForm(form)
+	case "multipart/form-data":
+		if err = r.ParseMultipartForm(maxMultipartMemory); err != nil {
+			return nil, err
+		}
+		form := url.Values(r.MultipartForm.Value)
+		if cs := params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") {
+			for k, vs := range form {
+				for i, v := range vs {
+					b, err := readBody(strings.NewReader(v), cs)
+					if err != nil {
+						return nil, err
+					}
+					vs[i] = string(b)
+				}
+				form[k] = vs
+			}
+		}
+		req.fromForm(form)
+	default:
+		return nil, fmt.Errorf("Unknown request type %s", mediaType)
+	}
+	return req, nil
+}
+
+func readBody(r io.Reader, cs string) ([]byte, error) {
+	if cs != "" && !strings.EqualFold(cs, "utf-8") {
+		cr, err := charset.NewReaderLabel(cs, r)
+		if err != nil {
+			return nil, err
+		}
+		r = cr
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (req *BotRequest) fromForm(form url.Values) {
+	req.Token = form.Get("token")
+	req.UserName = form.Get("user_name")
+	req.UserID = form.Get("user_id")
+	req.UserEmail = form.Get("user_email")
+	req.TriggerWord = form.Get("trigger_word")
+	req.TriggerID = form.Get("trigger_id")
+	req.ChannelID = form.Get("channel_id")
+	req.ChannelName = form.Get("channel_name")
+	req.TeamDomain = form.Get("team_domain")
+	req.TeamID = form.Get("team_id")
+	req.PostID = form.Get("post_id")
+	req.Command = form.Get("command")
+	req.ResponseURL = form.Get("response_url")
+	req.Text = form.Get("text")
+	req.Timestamp, _ = strconv.ParseInt(form.Get("timestamp"), 10, 64)
+	req.ChannelMentions = formList(form, "channel_mentions")
+	req.ChannelMentionIDs = formList(form, "channel_mentions_ids")
+	req.UserMentions = formList(form, "user_mentions")
+	req.UserMentionIDs = formList(form, "user_mentions_ids")
+	req.FileIDs = formList(form, "file_ids")
+}
+
+func formList(form url.Values, key string) StringList {
+	vs, ok := form[key]
+	if !ok {
+		return nil
+	}
+	return splitList(strings.Join(vs, ","))
+}
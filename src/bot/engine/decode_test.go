@@ -0,0 +1,104 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "bytes"
+import "encoding/json"
+import "github.com/gorilla/mux"
+import "mime/multipart"
+import "net/http"
+import "net/http/httptest"
+import "reflect"
+import "strings"
+import "testing"
+
+func TestDecodeRequest(t *testing.T) {
+	var multi bytes.Buffer
+	mw := multipart.NewWriter(&multi)
+	mw.WriteField("text", "roll 2d6")
+	mw.WriteField("user_name", "alice")
+	mw.WriteField("user_mentions", "bob,carol")
+	mw.Close()
+
+	for _, c := range []struct {
+		name string
+		contentType string
+		body string
+		want engine.BotRequest
+	}{
+		{"form", "application/x-www-form-urlencoded",
+			"text=roll+2d6&user_name=alice&user_mentions=bob%2C+carol&timestamp=1577880000",
+			engine.BotRequest{Text: "roll 2d6", UserName: "alice", UserMentions: engine.StringList{"bob", "carol"}, Timestamp: 1577880000}},
+		{"json list", "application/json",
+			`{"text": "roll 2d6", "user_name": "alice", "user_mentions": ["bob", "carol"]}`,
+			engine.BotRequest{Text: "roll 2d6", UserName: "alice", UserMentions: engine.StringList{"bob", "carol"}}},
+		{"json string", "application/json; charset=utf-8",
+			`{"text": "roll 2d6", "user_name": "alice", "user_mentions": "bob,carol"}`,
+			engine.BotRequest{Text: "roll 2d6", UserName: "alice", UserMentions: engine.StringList{"bob", "carol"}}},
+		{"multipart", mw.FormDataContentType(), multi.String(),
+			engine.BotRequest{Text: "roll 2d6", UserName: "alice", UserMentions: engine.StringList{"bob", "carol"}}},
+		{"latin-1", "application/x-www-form-urlencoded; charset=ISO-8859-1",
+			"text=caf\xe9&user_name=alice",
+			engine.BotRequest{Text: "café", UserName: "alice"}},
+	} {
+		r := httptest.NewRequest("POST", "/message", strings.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		req, err := engine.DecodeRequest(r, engine.SourceWebhook)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		c.want.Source = engine.SourceWebhook
+		if !reflect.DeepEqual(*req, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, *req, c.want)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/message", strings.NewReader("text"))
+	r.Header.Set("Content-Type", "text/plain")
+	if _, err := engine.DecodeRequest(r, engine.SourceWebhook); err == nil {
+		t.Error("Decoded a text/plain request")
+	}
+}
+
+// serve passes the form post r to handler and decodes the answer, nil if
+// there was none.
+func serve(t *testing.T, handler http.HandlerFunc, r *http.Request) *engine.BotResponse {
+	t.Helper()
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Body.Len() == 0 {
+		return nil
+	}
+	resp := &engine.BotResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Bad response %q: %v", w.Body, err)
+	}
+	return resp
+}
+
+// Outgoing webhooks and slash commands reach plugins the same way.
+func TestDecodedRequestsReachPlugins(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+	})
+	r := httptest.NewRequest("POST", "/message", strings.NewReader("token=test-token&user_name=alice&text=roll+1d1"))
+	resp := serve(t, h.Bot.Message, r)
+	if resp == nil || resp.Attachments[0].Text != "alice rolls 1" {
+		t.Errorf("Message got %+v", resp)
+	}
+
+	r = httptest.NewRequest("POST", "/message", strings.NewReader("token=wrong&user_name=alice&text=roll+1d1"))
+	if resp := serve(t, h.Bot.Message, r); resp != nil {
+		t.Errorf("Answered a bad token with %+v", resp)
+	}
+
+	r = httptest.NewRequest("POST", "/slash/roll", strings.NewReader("command=%2Froll&user_name=alice&text=1d1"))
+	r = mux.SetURLVars(r, map[string]string{"command": "roll"})
+	resp = serve(t, h.Bot.Slash, r)
+	if resp == nil || resp.Attachments[0].Text != "alice rolls 1" || resp.ResponseType != "in_channel" {
+		t.Errorf("Slash got %+v", resp)
+	}
+}
@@ -0,0 +1,104 @@
+package engine
+
+import "errors"
+import "strings"
+import "sync"
+import "time"
+
+const deferredExpiry = 30 * time.Minute
+const deferredMaxPosts = 5
+const deferredWorkingText = "Working on it..."
+
+var ErrDeferredExpired = errors.New("Deferred response has expired")
+
+// Deferred carries a request whose answer is delivered after the HTTP
+// handler has returned, by posting to the request's response_url.
+type Deferred struct {
+	m sync.Mutex
+	plugin *PluginBase
+	Request *BotRequest
+	Expires time.Time
+	posts int
+	inline bool
+	collected []*BotResponse
+}
+
+// Defer runs work in the background and returns an ephemeral reply that
+// can be sent straight back to Mattermost.  Requests without a
+// response_url (outgoing webhooks) run work inline instead, and whatever
+// it posts is merged into the returned response.
+func (p *PluginBase) Defer(req *BotRequest, work func(d *Deferred)) *BotResponse {
+	d := &Deferred{
+		plugin: p,
+		Request: req,
+		Expires: p.Bot.Now().Add(deferredExpiry),
+		inline: req.ResponseURL == "",
+	}
+	if d.inline {
+		work(d)
+		return d.merged()
+	}
+	p.Bot.work.Add(1)
+	go func() {
+		defer p.Bot.work.Done()
+		work(d)
+	}()
+	return &BotResponse{
+		Text: deferredWorkingText,
+		ResponseType: "ephemeral",
+	}
+}
+
+// Post queues a follow-up response on the bot's outbox, which retries it
+// until the request expires.  Mattermost's limit on follow-ups per
+// request is enforced here.  Failures are logged as well as returned, as
+// the background work has nobody else to tell.
+func (d *Deferred) Post(resp *BotResponse) error {
+	err := d.post(resp)
+	if err != nil {
+		d.plugin.Log().Warnf("Posting deferred response to %s failed: %v", d.Request.UserName, err)
+	}
+	return err
+}
+
+func (d *Deferred) post(resp *BotResponse) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.inline {
+		d.collected = append(d.collected, resp)
+		return nil
+	}
+	if d.posts >= deferredMaxPosts {
+		return errors.New("Too many deferred responses for request")
+	}
+	d.posts++
+	if resp.ResponseType == "" {
+		resp.ResponseType = "in_channel"
+	}
+	d.plugin.Bot.decorate(resp)
+
+	if d.plugin.Bot.Now().After(d.Expires) {
+		return ErrDeferredExpired
+	}
+	return d.plugin.Bot.Outbox().EnqueueFor(d.Request.Platform, d.Request.ResponseURL, resp, d.Expires)
+}
+
+func (d *Deferred) merged() *BotResponse {
+	if len(d.collected) == 0 {
+		return nil
+	}
+	out := &BotResponse{
+		ResponseType: d.collected[0].ResponseType,
+	}
+	texts := make([]string, 0, len(d.collected))
+	for _, r := range d.collected {
+		if r.Text != "" {
+			texts = append(texts, r.Text)
+		}
+		for _, a := range r.Attachments {
+			out.AddAttachment(a)
+		}
+	}
+	out.Text = strings.Join(texts, "\n")
+	return out
+}
@@ -0,0 +1,119 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "fmt"
+import "testing"
+import "time"
+
+// deferPlugin answers every request by running work in the background.
+type deferPlugin struct {
+	engine.PluginBase
+	work func(d *engine.Deferred)
+}
+
+func init() {
+	engine.RegisterPlugin("Deferrer", func(b *engine.Bot) engine.Plugin {
+		p := &deferPlugin{}
+		p.Bot = b
+		return p
+	})
+}
+
+func (p *deferPlugin) Init() {}
+func (p *deferPlugin) Done() {}
+
+func (p *deferPlugin) Name() string {
+	return "Deferrer"
+}
+
+func (p *deferPlugin) Handle(b *engine.Bot, req *engine.BotRequest) (*engine.BotResponse, bool) {
+	return p.Defer(req, p.work), true
+}
+
+// deferBot runs work for each request and returns the errors of its
+// posts, in order, once it has finished.
+func deferBot(t *testing.T, work func(d *engine.Deferred) []error) (*enginetest.Harness, chan []error) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Deferrer"}},
+		Config: func(cfg *config.Config) {
+			// fast enough not to hold up the test
+			cfg.Outbox.RatePerMinute = 1 << 30
+		},
+	})
+	done := make(chan []error, 1)
+	h.Bot.Plugins[0].(*deferPlugin).work = func(d *engine.Deferred) {
+		done <- work(d)
+	}
+	return h, done
+}
+
+func TestDeferredPostsToResponseURL(t *testing.T) {
+	sink := enginetest.NewSink(t)
+	h, done := deferBot(t, func(d *engine.Deferred) []error {
+		return []error{d.Post(&engine.BotResponse{Text: "done"})}
+	})
+	resp := h.Send(enginetest.Slash("/slow", enginetest.WithResponseURL(sink.URL())))
+	if resp == nil || resp.Text != "Working on it..." || resp.ResponseType != "ephemeral" {
+		t.Errorf("Answered %+v", resp)
+	}
+	if errs := <-done; errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	posts := sink.Wait(t, 1, 5*time.Second)
+	if posts[0].Text != "done" || posts[0].ResponseType != "in_channel" || posts[0].UserName != "testbot" {
+		t.Errorf("Posted %+v", posts[0])
+	}
+}
+
+// Outgoing webhooks have no response_url, so the work is done before
+// answering.
+func TestDeferredInline(t *testing.T) {
+	h, done := deferBot(t, func(d *engine.Deferred) []error {
+		return []error{d.Post(&engine.BotResponse{Text: "one"}), d.Post(&engine.BotResponse{Text: "two"})}
+	})
+	resp := h.Send(enginetest.Message("slow"))
+	<-done
+	if resp == nil || resp.Text != "one\ntwo" {
+		t.Errorf("Answered %+v", resp)
+	}
+}
+
+func TestDeferredPostLimit(t *testing.T) {
+	sink := enginetest.NewSink(t)
+	h, done := deferBot(t, func(d *engine.Deferred) []error {
+		errs := make([]error, 0)
+		for i := 0; i < 6; i++ {
+			errs = append(errs, d.Post(&engine.BotResponse{Text: fmt.Sprint(i)}))
+		}
+		return errs
+	})
+	h.Send(enginetest.Slash("/slow", enginetest.WithResponseURL(sink.URL())))
+	errs := <-done
+	for i, err := range errs {
+		if (err == nil) != (i < 5) {
+			t.Errorf("Post %d returned %v", i, err)
+		}
+	}
+	sink.Wait(t, 5, 5*time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(sink.Posts()); n != 5 {
+		t.Errorf("Got %d posts", n)
+	}
+}
+
+func TestDeferredExpires(t *testing.T) {
+	sink := enginetest.NewSink(t)
+	release := make(chan bool)
+	h, done := deferBot(t, func(d *engine.Deferred) []error {
+		<-release
+		return []error{d.Post(&engine.BotResponse{Text: "too late"})}
+	})
+	h.Send(enginetest.Slash("/slow", enginetest.WithResponseURL(sink.URL())))
+	h.Clock.Advance(31 * time.Minute)
+	close(release)
+	if errs := <-done; errs[0] != engine.ErrDeferredExpired {
+		t.Errorf("Got %v", errs[0])
+	}
+}
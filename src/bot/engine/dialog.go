@@ -0,0 +1,456 @@
+package engine
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "net/mail"
+import "net/url"
+import "strconv"
+import "strings"
+
+const dialogResponseURLKey = "_response_url"
+const dialogUserNameKey = "_user_name"
+const dialogUserIDKey = "_user_id"
+const dialogChannelIDKey = "_channel_id"
+const dialogTeamIDKey = "_team_id"
+const dialogExpiresKey = "_expires"
+
+// dialogExpiry is how long a form may stay open, as long as the
+// response_url its answer is posted to.
+const dialogExpiry = deferredExpiry
+
+var ErrDialogUnsupported = errors.New("Forms need a slash command and the bot's mattermosturl setting")
+var ErrDialogExpired = errors.New("This form has expired, please open it again.")
+
+type FieldType int
+
+const (
+	FieldText FieldType = iota
+	FieldTextarea
+	FieldInt
+	FieldEmail
+	FieldURL
+	FieldBool
+	FieldSelect
+	FieldUser
+	FieldChannel
+)
+
+// DialogField declares one input of a dialog.  Submitted values are
+// checked against the declaration before the plugin sees them.
+type DialogField struct {
+	Name string
+	Label string
+	Type FieldType
+	Optional bool
+	Default string
+	Placeholder string
+	Help string
+	MinLength int
+	MaxLength int
+	// Options are the choices of a FieldSelect.
+	Options []*ActionOption
+	// Check, if set, further validates a well-typed value, returning a
+	// message to show by the field if it is wrong.
+	Check func(v interface{}) string
+}
+
+// Dialog is a form opened for a user from a slash command.  Its
+// submission is validated by the bot and passed, with typed values and
+// Context, to the HandleDialog of the plugin that opened it.
+type Dialog struct {
+	ID string
+	Title string
+	Introduction string
+	SubmitLabel string
+	Fields []*DialogField
+	Context ActionContext
+}
+
+// DialogSubmission is a validated dialog submission.
+type DialogSubmission struct {
+	// Request says who submitted the dialog and where.
+	Request *BotRequest
+	ID string
+	Context ActionContext
+	values map[string]interface{}
+}
+
+// Has reports whether an optional field was filled in.
+func (s *DialogSubmission) Has(name string) bool {
+	_, ok := s.values[name]
+	return ok
+}
+
+// String returns a text, select, user or channel field.
+func (s *DialogSubmission) String(name string) string {
+	v, _ := s.values[name].(string)
+	return v
+}
+
+// Int returns a FieldInt field, or 0 if it was left empty.
+func (s *DialogSubmission) Int(name string) int {
+	v, _ := s.values[name].(int)
+	return v
+}
+
+// Bool returns a FieldBool field.
+func (s *DialogSubmission) Bool(name string) bool {
+	v, _ := s.values[name].(bool)
+	return v
+}
+
+// DialogResponse answers a submission.  Errors, by field name, or Error
+// keep the dialog open for the user to correct; otherwise it closes and
+// Post, if set, is posted where the dialog was opened.
+type DialogResponse struct {
+	Errors map[string]string `json:"errors,omitempty"`
+	Error string `json:"error,omitempty"`
+	Post *BotResponse `json:"-"`
+}
+
+// DialogHandler is implemented by plugins that open dialogs.  Dialog
+// returns the declaration submissions of id are validated against, so
+// a dialog opened with changed defaults or context must keep its fields.
+type DialogHandler interface {
+	Dialog(id string) *Dialog
+	HandleDialog(b *Bot, sub *DialogSubmission) *DialogResponse
+}
+
+// dialogElement is a field in Mattermost's format.
+type dialogElement struct {
+	DisplayName string `json:"display_name"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	SubType string `json:"subtype,omitempty"`
+	Default string `json:"default,omitempty"`
+	Placeholder string `json:"placeholder,omitempty"`
+	HelpText string `json:"help_text,omitempty"`
+	Optional bool `json:"optional"`
+	MinLength int `json:"min_length,omitempty"`
+	MaxLength int `json:"max_length,omitempty"`
+	DataSource string `json:"data_source,omitempty"`
+	Options []*ActionOption `json:"options,omitempty"`
+}
+
+type dialogOpen struct {
+	TriggerID string `json:"trigger_id"`
+	URL string `json:"url"`
+	Dialog struct {
+		CallbackID string `json:"callback_id"`
+		Title string `json:"title"`
+		IntroductionText string `json:"introduction_text,omitempty"`
+		Elements []*dialogElement `json:"elements"`
+		SubmitLabel string `json:"submit_label,omitempty"`
+		State string `json:"state"`
+	} `json:"dialog"`
+}
+
+func (f *DialogField) element() *dialogElement {
+	e := &dialogElement{
+		DisplayName: f.Label,
+		Name: f.Name,
+		Type: "text",
+		Default: f.Default,
+		Placeholder: f.Placeholder,
+		HelpText: f.Help,
+		Optional: f.Optional,
+		MinLength: f.MinLength,
+		MaxLength: f.MaxLength,
+	}
+	if e.DisplayName == "" {
+		e.DisplayName = f.Name
+	}
+	switch f.Type {
+	case FieldTextarea:
+		e.Type = "textarea"
+	case FieldInt:
+		e.SubType = "number"
+	case FieldEmail:
+		e.SubType = "email"
+	case FieldURL:
+		e.SubType = "url"
+	case FieldBool:
+		e.Type = "bool"
+	case FieldSelect:
+		e.Type = "select"
+		e.Options = f.Options
+	case FieldUser:
+		e.Type = "select"
+		e.DataSource = "users"
+	case FieldChannel:
+		e.Type = "select"
+		e.DataSource = "channels"
+	}
+	return e
+}
+
+// OpenDialog shows d to the user who sent req, which must be a Mattermost
+// slash command.  Mattermost gives no way to answer a submission in the
+// channel, so the command's response_url is kept with the dialog for the
+// plugin's Post.  The state also binds the dialog to the user, channel
+// and team it was opened for, until dialogExpiry, as the state passes
+// through the user's client.
+func (b *Bot) OpenDialog(p Plugin, req *BotRequest, d *Dialog) error {
+	base := b.Config().MattermostURL
+	if base == "" || req.TriggerID == "" || req.Platform != PlatformMattermost {
+		return ErrDialogUnsupported
+	}
+	state := ActionContext{
+		actionKey: p.Name() + "/" + d.ID,
+		dialogResponseURLKey: req.ResponseURL,
+		dialogUserNameKey: req.UserName,
+		dialogUserIDKey: req.UserID,
+		dialogChannelIDKey: req.ChannelID,
+		dialogTeamIDKey: req.TeamID,
+		dialogExpiresKey: b.Now().Add(dialogExpiry).Unix(),
+	}
+	for k, v := range d.Context {
+		state[k] = v
+	}
+	state[actionSigKey] = b.signAction(state)
+	bb, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	open := &dialogOpen{
+		TriggerID: req.TriggerID,
+		URL: b.URL("/dialog"),
+	}
+	open.Dialog.CallbackID = p.Name() + "/" + d.ID
+	open.Dialog.Title = d.Title
+	open.Dialog.IntroductionText = d.Introduction
+	open.Dialog.SubmitLabel = d.SubmitLabel
+	open.Dialog.State = string(bb)
+	for _, f := range d.Fields {
+		open.Dialog.Elements = append(open.Dialog.Elements, f.element())
+	}
+	body, err := json.Marshal(open)
+	if err != nil {
+		return err
+	}
+	resp, err := incomingClient.Post(strings.TrimRight(base, "/")+"/api/v4/actions/dialogs/open", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode / 100 != 2 {
+		return fmt.Errorf("Opening dialog failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SubmitDialog validates the values submitted to the dialog with
+// callbackID and state, as given to Mattermost by OpenDialog, and passes
+// them to the plugin that opened it.  A submission by another user or
+// from another channel than the dialog was opened for fails as a bad
+// signature.  A field error is not an error here; it is returned in the
+// response for the user to correct, as is the dialog having expired.
+func (b *Bot) SubmitDialog(req *BotRequest, callbackID string, state string, values map[string]interface{}) (*DialogResponse, error) {
+	ctx := ActionContext{}
+	if err := json.Unmarshal([]byte(state), &ctx); err != nil {
+		return nil, ErrActionSignature
+	}
+	route, err := b.verifyAction(ctx)
+	if err != nil || route != callbackID {
+		return nil, ErrActionSignature
+	}
+	for key, want := range map[string]string{
+		dialogUserIDKey: req.UserID,
+		dialogChannelIDKey: req.ChannelID,
+		dialogTeamIDKey: req.TeamID,
+	} {
+		if v, _ := ctx[key].(string); v != want {
+			return nil, ErrActionSignature
+		}
+	}
+	if b.Now().Unix() > contextInt(ctx, dialogExpiresKey) {
+		return &DialogResponse{Error: ErrDialogExpired.Error()}, nil
+	}
+	name, id := route, ""
+	if i := strings.Index(route, "/"); i >= 0 {
+		name, id = route[:i], route[i+1:]
+	}
+	var h DialogHandler
+	for _, p := range b.activePlugins() {
+		if p.Name() == name {
+			h, _ = p.(DialogHandler)
+		}
+	}
+	var d *Dialog
+	if h != nil {
+		d = h.Dialog(id)
+	}
+	if d == nil {
+		return nil, ErrActionUnknown
+	}
+	r := *req
+	if r.UserName == "" {
+		r.UserName, _ = ctx[dialogUserNameKey].(string)
+	}
+	r.ResponseURL, _ = ctx[dialogResponseURLKey].(string)
+	sub := &DialogSubmission{
+		Request: &r,
+		ID: id,
+		Context: ctx,
+		values: make(map[string]interface{}),
+	}
+	errs := make(map[string]string)
+	for _, f := range d.Fields {
+		v, msg := f.parse(values[f.Name])
+		if msg != "" {
+			errs[f.Name] = msg
+		} else if v != nil {
+			sub.values[f.Name] = v
+		}
+	}
+	if len(errs) > 0 {
+		return &DialogResponse{Errors: errs}, nil
+	}
+	b.metrics.requests.Inc("dialog", name, id)
+	resp := h.HandleDialog(b, sub)
+	if resp == nil {
+		resp = &DialogResponse{}
+	}
+	if resp.Post != nil && len(resp.Errors) == 0 && resp.Error == "" {
+		if r.ResponseURL == "" {
+			b.Log().Warnf("Dropping answer to dialog %s, which has no response_url", route)
+		} else {
+			if resp.Post.ResponseType == "" {
+				resp.Post.ResponseType = "in_channel"
+			}
+			b.decorate(resp.Post)
+			if err = b.Outbox().Enqueue(r.ResponseURL, resp.Post, b.Now().Add(deferredExpiry)); err != nil {
+				b.Log().Warnf("Queueing answer to dialog %s failed: %v", route, err)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// parse checks a submitted value against the field, returning it typed,
+// or nil if an optional field was left empty, or a message saying what
+// is wrong with it.
+func (f *DialogField) parse(raw interface{}) (interface{}, string) {
+	if f.Type == FieldBool {
+		switch v := raw.(type) {
+		case bool:
+			return v, f.check(v)
+		case string:
+			return v == "true", f.check(v == "true")
+		}
+		return false, f.check(false)
+	}
+	s := ""
+	switch v := raw.(type) {
+	case string:
+		s = strings.TrimSpace(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" {
+		if f.Optional {
+			return nil, ""
+		}
+		return nil, "This field is required."
+	}
+	if f.MinLength > 0 && len([]rune(s)) < f.MinLength {
+		return nil, fmt.Sprintf("Must be at least %d characters.", f.MinLength)
+	}
+	if f.MaxLength > 0 && len([]rune(s)) > f.MaxLength {
+		return nil, fmt.Sprintf("Must be at most %d characters.", f.MaxLength)
+	}
+	var v interface{} = s
+	switch f.Type {
+	case FieldInt:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, "Must be a whole number."
+		}
+		v = i
+	case FieldEmail:
+		if _, err := mail.ParseAddress(s); err != nil {
+			return nil, "Must be an email address."
+		}
+	case FieldURL:
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, "Must be an http or https URL."
+		}
+	case FieldSelect:
+		ok := false
+		for _, o := range f.Options {
+			ok = ok || o.Value == s
+		}
+		if !ok {
+			return nil, "Pick one of the options."
+		}
+	}
+	return v, f.check(v)
+}
+
+func (f *DialogField) check(v interface{}) string {
+	if f.Check == nil {
+		return ""
+	}
+	return f.Check(v)
+}
+
+// mattermostDialogSubmission is the payload Mattermost posts to /dialog.
+type mattermostDialogSubmission struct {
+	Type string `json:"type"`
+	CallbackID string `json:"callback_id"`
+	State string `json:"state"`
+	UserID string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	TeamID string `json:"team_id"`
+	Submission map[string]interface{} `json:"submission"`
+	Cancelled bool `json:"cancelled"`
+}
+
+// DialogSubmit serves Mattermost's dialog submissions.
+func (b *Bot) DialogSubmit( w http.ResponseWriter, r *http.Request ) {
+	if r.Method != "POST" {
+		b.Log().Warnf("Invalid request method: %s", r.Method)
+		return
+	}
+	in := &mattermostDialogSubmission{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, actionMaxBody)).Decode(in); err != nil {
+		b.Log().Warnf("Failed to decode dialog submission: %v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if in.Cancelled {
+		return
+	}
+	req := &BotRequest{
+		ChannelID: in.ChannelID,
+		TeamID: in.TeamID,
+		UserID: in.UserID,
+		Source: SourceSlash,
+	}
+	resp, err := b.SubmitDialog(req, in.CallbackID, in.State, in.Submission)
+	if err != nil {
+		b.Log().Warnf("Ignoring dialog submission from %s: %v", r.RemoteAddr, err)
+		if err == ErrActionSignature {
+			b.metrics.tokenRejections.Inc("dialog")
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	bb, err := json.Marshal(resp)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bb)
+	}
+}
@@ -0,0 +1,133 @@
+// Package enginetest helps test plugins: it starts a bot without a
+// listener in a temporary data directory, builds requests, fakes the
+// clock, records posts to incoming webhooks and compares responses with
+// golden files.
+package enginetest
+
+import "bot/config"
+import "bot/engine"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// Options describe the bot under test.
+type Options struct {
+	// Plugins to run, all default plugins if empty.
+	Plugins []config.PluginConfig
+	// Files are written into the data directory, by path relative to it,
+	// before the plugins start, e.g. "Feed/config.yml".
+	Files map[string]string
+	// Config, if set, may change the bot config before the bot starts.
+	Config func(cfg *config.Config)
+	// Start is the fake clock's initial time, Epoch if zero.
+	Start time.Time
+}
+
+// Epoch is where fake clocks start unless told otherwise.
+var Epoch = time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// Harness is a running bot under test.
+type Harness struct {
+	t testing.TB
+	Bot *engine.Bot
+	Clock *Clock
+	DataDir string
+	mm *mattermost
+}
+
+// NewBot starts a bot as described by o.  It is stopped when the test
+// ends.
+func NewBot(t testing.TB, o Options) *Harness {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range o.Files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mm := newMattermost(t)
+	cfg := &config.Config{
+		Username: "testbot",
+		BaseURL: "localhost",
+		MattermostURL: mm.server.URL,
+		Port: 1,
+		Token: "test-token",
+		DataDir: dir,
+		Plugins: o.Plugins,
+	}
+	if o.Config != nil {
+		o.Config(cfg)
+	}
+	start := o.Start
+	if start.IsZero() {
+		start = Epoch
+	}
+	clock := NewClock(start)
+	bot, err := engine.NewOffline(cfg, engine.WithClock(clock))
+	if err != nil {
+		t.Fatalf("Starting bot: %v", err)
+	}
+	t.Cleanup(bot.Done)
+	return &Harness{
+		t: t,
+		Bot: bot,
+		Clock: clock,
+		DataDir: dir,
+		mm: mm,
+	}
+}
+
+// Send passes req to the bot and returns its answer, or nil.
+func (h *Harness) Send(req *engine.BotRequest) *engine.BotResponse {
+	return h.Bot.HandleRequest(req)
+}
+
+// Step moves the clock on by d and runs the jobs that made due, returning
+// once they have finished.
+func (h *Harness) Step(d time.Duration) {
+	h.Clock.Advance(d)
+	h.Bot.Scheduler().RunDue()
+}
+
+// Restart stops the bot and starts a new one on the same data directory
+// and clock, to test what plugins remember.
+func (h *Harness) Restart() {
+	h.t.Helper()
+	cfg := *h.Bot.Config()
+	h.Bot.Done()
+	bot, err := engine.NewOffline(&cfg, engine.WithClock(h.Clock))
+	if err != nil {
+		h.t.Fatalf("Restarting bot: %v", err)
+	}
+	h.t.Cleanup(bot.Done)
+	h.Bot = bot
+}
+
+// Click clicks the action labelled label in resp, as the user the
+// options describe, and returns the plugin's answer.  It fails the test
+// if resp has no such action.
+func (h *Harness) Click(resp *engine.BotResponse, label string, opts ...RequestOption) *engine.ActionResponse {
+	h.t.Helper()
+	if resp != nil {
+		for _, a := range resp.Attachments {
+			for _, act := range a.Actions {
+				if act.Name != label {
+					continue
+				}
+				out, err := h.Bot.Click(act, Message("", opts...), "")
+				if err != nil {
+					h.t.Fatalf("Clicking %s: %v", label, err)
+				}
+				return out
+			}
+		}
+	}
+	h.t.Fatalf("No action %s in %+v", label, resp)
+	return nil
+}
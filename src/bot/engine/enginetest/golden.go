@@ -0,0 +1,36 @@
+package enginetest
+
+import "encoding/json"
+import "flag"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+// AssertGolden compares v, as indented JSON, with testdata/<name>.golden.
+// Run the tests with -update to write the files afresh.
+func AssertGolden(t testing.TB, name string, v interface{}) {
+	t.Helper()
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	fn := filepath.Join("testdata", name+".golden")
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		if err = ioutil.WriteFile(fn, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Reading golden file: %v (run with -update to create it)", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("%s differs from golden file %s:\ngot:\n%s\nwant:\n%s", name, fn, got, want)
+	}
+}
@@ -0,0 +1,62 @@
+package enginetest
+
+import "bot/engine"
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "sync"
+import "testing"
+
+// OpenedDialog is a dialog the bot asked Mattermost to show.
+type OpenedDialog struct {
+	TriggerID string `json:"trigger_id"`
+	URL string `json:"url"`
+	Dialog struct {
+		CallbackID string `json:"callback_id"`
+		Title string `json:"title"`
+		Elements []map[string]interface{} `json:"elements"`
+		State string `json:"state"`
+	} `json:"dialog"`
+}
+
+// mattermost fakes the parts of the Mattermost API the bot calls.
+type mattermost struct {
+	m sync.Mutex
+	server *httptest.Server
+	dialogs []*OpenedDialog
+}
+
+func newMattermost(t testing.TB) *mattermost {
+	mm := &mattermost{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/actions/dialogs/open", func(w http.ResponseWriter, r *http.Request) {
+		d := &OpenedDialog{}
+		if err := json.NewDecoder(r.Body).Decode(d); err != nil || d.TriggerID == "" {
+			http.Error(w, "bad dialog", http.StatusBadRequest)
+			return
+		}
+		mm.m.Lock()
+		mm.dialogs = append(mm.dialogs, d)
+		mm.m.Unlock()
+	})
+	mm.server = httptest.NewServer(mux)
+	t.Cleanup(mm.server.Close)
+	return mm
+}
+
+// Dialogs returns the dialogs the bot has opened so far.
+func (h *Harness) Dialogs() []*OpenedDialog {
+	h.mm.m.Lock()
+	defer h.mm.m.Unlock()
+	return append([]*OpenedDialog{}, h.mm.dialogs...)
+}
+
+// Submit fills in d with values, as the user the options describe.
+func (h *Harness) Submit(d *OpenedDialog, values map[string]interface{}, opts ...RequestOption) *engine.DialogResponse {
+	h.t.Helper()
+	resp, err := h.Bot.SubmitDialog(Message("", opts...), d.Dialog.CallbackID, d.Dialog.State, values)
+	if err != nil {
+		h.t.Fatalf("Submitting %s: %v", d.Dialog.CallbackID, err)
+	}
+	return resp
+}
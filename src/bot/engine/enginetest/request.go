@@ -0,0 +1,67 @@
+package enginetest
+
+import "bot/engine"
+import "strings"
+
+// Default identity of requests, unless changed with From and In.
+const (
+	UserName = "tester"
+	UserID = "tester-id"
+	ChannelName = "town-square"
+	ChannelID = "town-square-id"
+)
+
+// RequestOption adjusts a request built by Message or Slash.
+type RequestOption func(req *engine.BotRequest)
+
+// From makes the request come from another user.
+func From(name string, id string) RequestOption {
+	return func(req *engine.BotRequest) {
+		req.UserName, req.UserID = name, id
+	}
+}
+
+// In makes the request come from another channel.
+func In(name string, id string) RequestOption {
+	return func(req *engine.BotRequest) {
+		req.ChannelName, req.ChannelID = name, id
+	}
+}
+
+// WithResponseURL gives the request a response_url, so that deferred
+// answers are posted there rather than returned inline.
+func WithResponseURL(url string) RequestOption {
+	return func(req *engine.BotRequest) {
+		req.ResponseURL = url
+	}
+}
+
+// Message builds an outgoing webhook request carrying text.
+func Message(text string, opts ...RequestOption) *engine.BotRequest {
+	req := &engine.BotRequest{
+		ChannelID: ChannelID,
+		ChannelName: ChannelName,
+		Text: text,
+		Token: "test-token",
+		UserID: UserID,
+		UserName: UserName,
+		Source: engine.SourceWebhook,
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	return req
+}
+
+// Slash builds a slash command request from a line such as "/roll 2d6",
+// with the text as the bot sees it after routing.  It has a trigger_id,
+// so it can open dialogs.
+func Slash(line string, opts ...RequestOption) *engine.BotRequest {
+	req := Message("", opts...)
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	req.Command = fields[0]
+	req.Text = strings.TrimPrefix(strings.Join(fields, " "), "/")
+	req.Source = engine.SourceSlash
+	req.TriggerID = "test-trigger"
+	return req
+}
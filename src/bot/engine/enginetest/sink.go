@@ -0,0 +1,77 @@
+package enginetest
+
+import "bot/engine"
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "sync"
+import "testing"
+import "time"
+
+// Sink is a local incoming webhook that records what is posted to it.
+type Sink struct {
+	m sync.Mutex
+	server *httptest.Server
+	posts []*engine.BotResponse
+	arrived chan struct{}
+	// Status is returned to posters, 200 if zero.
+	Status int
+}
+
+// NewSink starts a sink that is closed when the test ends.
+func NewSink(t testing.TB) *Sink {
+	s := &Sink{arrived: make(chan struct{}, 1)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *Sink) serve(w http.ResponseWriter, r *http.Request) {
+	resp := &engine.BotResponse{}
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.m.Lock()
+	status := s.Status
+	if status == 0 || status/100 == 2 {
+		s.posts = append(s.posts, resp)
+	}
+	s.m.Unlock()
+	select {
+	case s.arrived <- struct{}{}:
+	default:
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+}
+
+// URL is the hook address to configure plugins with.
+func (s *Sink) URL() string {
+	return s.server.URL + "/hooks/test"
+}
+
+// Posts returns what has been posted so far.
+func (s *Sink) Posts() []*engine.BotResponse {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]*engine.BotResponse{}, s.posts...)
+}
+
+// Wait returns the posts once there are at least n, failing the test if
+// they don't arrive within timeout of real time.
+func (s *Sink) Wait(t testing.TB, n int, timeout time.Duration) []*engine.BotResponse {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		if posts := s.Posts(); len(posts) >= n {
+			return posts
+		}
+		select {
+		case <-s.arrived:
+		case <-deadline:
+			t.Fatalf("Got %d posts, want %d", len(s.Posts()), n)
+		}
+	}
+}
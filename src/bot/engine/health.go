@@ -0,0 +1,115 @@
+package engine
+
+import "bot/metrics"
+import "encoding/json"
+import "net/http"
+
+// botMetrics holds the counters a bot exports on /metrics.
+type botMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.Counter
+	latency *metrics.Histogram
+	tokenRejections *metrics.Counter
+	feedFetchErrors *metrics.Counter
+	postFailures *metrics.Counter
+	deadLetters *metrics.Counter
+	rateLimited *metrics.Counter
+}
+
+func newBotMetrics() *botMetrics {
+	r := metrics.NewRegistry()
+	return &botMetrics{
+		registry: r,
+		requests: r.NewCounter("retrobot_requests_total",
+			"Requests handled, by plugin and command.", "source", "plugin", "command"),
+		latency: r.NewHistogram("retrobot_request_duration_seconds",
+			"Time spent handling inbound requests.", metrics.DefaultBuckets, "source"),
+		tokenRejections: r.NewCounter("retrobot_token_rejections_total",
+			"Requests ignored because of an invalid token.", "source"),
+		feedFetchErrors: r.NewCounter("retrobot_feed_fetch_errors_total",
+			"Failed feed fetches, by feed name.", "feed"),
+		postFailures: r.NewCounter("retrobot_incoming_webhook_post_failures_total",
+			"Failed POSTs to Mattermost incoming webhooks and response URLs."),
+		deadLetters: r.NewCounter("retrobot_outbox_dead_letters_total",
+			"Outbound messages given up on after exhausting retries."),
+		rateLimited: r.NewCounter("retrobot_rate_limited_total",
+			"Commands refused for exceeding a rate limit, by scope.", "scope"),
+	}
+}
+
+// commandLabel names the command req ran for the requests counter, or
+// "other" if its first word isn't one of cmds, so that free text can't
+// add series.
+func commandLabel(cmds []*Command, req *BotRequest) string {
+	command, _ := nextWord(commandText(req))
+	for _, c := range cmds {
+		if c.Name == command {
+			return command
+		}
+	}
+	return "other"
+}
+
+// HealthStatus describes one plugin's health for /healthz and /readyz.
+type HealthStatus struct {
+	Healthy bool `json:"healthy"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthChecker is implemented by plugins that can report on their own
+// state.  Plugins without it are always considered healthy.
+type HealthChecker interface {
+	Health() *HealthStatus
+}
+
+type healthReport struct {
+	Bot string `json:"bot"`
+	Healthy bool `json:"healthy"`
+	Plugins map[string]*HealthStatus `json:"plugins"`
+}
+
+func (b *Bot) health() *healthReport {
+	report := &healthReport{
+		Bot: b.Config().Username,
+		Healthy: true,
+		Plugins: make(map[string]*HealthStatus),
+	}
+	for _, p := range b.activePlugins() {
+		status := &HealthStatus{Healthy: true}
+		if hc, ok := p.(HealthChecker); ok {
+			status = hc.Health()
+		}
+		report.Plugins[p.Name()] = status
+		if !status.Healthy {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// Healthz reports plugin health but always answers 200 while the bot
+// is serving.
+func (b *Bot) Healthz(w http.ResponseWriter, r *http.Request) {
+	b.writeHealth(w, b.health(), http.StatusOK)
+}
+
+// Readyz answers 503 unless every plugin reports itself healthy.
+func (b *Bot) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := b.health()
+	code := http.StatusOK
+	if !report.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	b.writeHealth(w, report, code)
+}
+
+func (b *Bot) writeHealth(w http.ResponseWriter, report *healthReport, code int) {
+	bb, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(bb)
+}
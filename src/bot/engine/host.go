@@ -0,0 +1,128 @@
+package engine
+
+import "context"
+import "fmt"
+import "net"
+import "net/http"
+import "strconv"
+import "sync"
+import "bot/config"
+import "bot/logging"
+import "github.com/gorilla/mux"
+
+// Host serves several bots on one listener, each under /{username}/,
+// with /static/ shared between them.  Bots keep their own tokens; the
+// TLS settings of the host apply instead of theirs.
+type Host struct {
+	addr string
+	port int
+	tls config.TLSConfig
+	router *mux.Router
+	m sync.Mutex
+	bots map[string]*Bot
+	server *http.Server
+	redirect *http.Server
+	errc chan error
+}
+
+// NewHost returns a host that will listen on addr, host:port, once
+// started.  The host part may be empty to listen on all interfaces, and
+// port 0 picks a free port when started.  tc may serve it over TLS.
+func NewHost(addr string, tc config.TLSConfig) (*Host, error) {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 0 {
+		return nil, fmt.Errorf("Invalid port in listen address %s", addr)
+	}
+	if err := tc.Validate(port); err != nil {
+		return nil, err
+	}
+	r := mux.NewRouter()
+	serveStatic(r)
+	return &Host{
+		addr: addr,
+		port: port,
+		tls: tc,
+		router: r,
+		bots: make(map[string]*Bot),
+		errc: make(chan error, 1),
+	}, nil
+}
+
+// Mount serves b's endpoints under /{username}/.  Mount every bot
+// before Start.  The path is fixed when mounted, so a username changed
+// by a reload needs a restart.
+func (h *Host) Mount(b *Bot) error {
+	name := b.Config().Username
+	h.m.Lock()
+	defer h.m.Unlock()
+	if _, ok := h.bots[name]; ok || name == "static" {
+		return fmt.Errorf("Path /%s/ is already in use", name)
+	}
+	h.bots[name] = b
+	b.host, b.prefix = h, "/"+name
+	b.routes(h.router.PathPrefix(b.prefix).Subrouter())
+	b.Log().Infof("Retrobot is available under /%s/ on the shared listener", name)
+	return nil
+}
+
+// Start binds the listener before returning so that address errors are
+// reported to the caller, then serves requests in the background.
+func (h *Host) Start() error {
+	ln, err := listen(h.addr, h.tls, logging.With("listener", "shared"))
+	if err != nil {
+		return err
+	}
+	h.m.Lock()
+	h.addr = ln.Addr().String()
+	h.port = ln.Addr().(*net.TCPAddr).Port
+	h.m.Unlock()
+	if h.tls.RedirectPort != 0 {
+		host, _, _ := net.SplitHostPort(h.addr)
+		h.redirect, err = startRedirect(host, h.tls.RedirectPort, h.port, h.errc)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	h.server = &http.Server{
+		Addr: h.addr,
+		Handler: h.router,
+	}
+	go func() {
+		err := h.server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			h.errc <- err
+		}
+	}()
+	logging.Infof("Shared listener is available on %s", h.Addr())
+	return nil
+}
+
+// Addr returns the address the host listens on, with the port chosen
+// once started.
+func (h *Host) Addr() string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.addr
+}
+
+// Errors delivers failures of the HTTP server after a successful Start.
+func (h *Host) Errors() <-chan error {
+	return h.errc
+}
+
+// Shutdown stops accepting requests and waits for those in flight.
+// Shut the bots down afterwards.
+func (h *Host) Shutdown(ctx context.Context) error {
+	if h.redirect != nil {
+		h.redirect.Shutdown(ctx)
+	}
+	if h.server == nil {
+		return nil
+	}
+	return h.server.Shutdown(ctx)
+}
@@ -0,0 +1,129 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "context"
+import "encoding/json"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "strings"
+import "testing"
+
+func hostedBot(t *testing.T, h *engine.Host, name string) *engine.Bot {
+	t.Helper()
+	b, err := engine.NewHosted(&config.Config{
+		Username: name,
+		Token: name + "-token",
+		DataDir: t.TempDir(),
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+	}, h)
+	if err != nil {
+		t.Fatalf("Starting %s: %v", name, err)
+	}
+	t.Cleanup(b.Done)
+	return b
+}
+
+// post sends an outgoing webhook to path on h and returns the name of
+// the bot that answered, if any.
+func post(t *testing.T, h *engine.Host, path string, token string, text string) string {
+	t.Helper()
+	resp, err := http.PostForm("http://"+h.Addr()+path, url.Values{
+		"token": {token},
+		"text": {text},
+		"user_name": {"tester"},
+		"user_id": {"tester-id"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out := &engine.BotResponse{}
+	json.NewDecoder(resp.Body).Decode(out)
+	return out.UserName
+}
+
+func TestHostRoutesByUsername(t *testing.T) {
+	h, err := engine.NewHost("127.0.0.1:0", config.TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpha := hostedBot(t, h, "alpha")
+	hostedBot(t, h, "beta")
+	if _, err := engine.NewHosted(&config.Config{
+		Username: "alpha",
+		Token: "x",
+		DataDir: t.TempDir(),
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+	}, h); err == nil {
+		t.Error("Mounted two bots at /alpha/")
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Shutdown(context.Background()) })
+
+	for _, c := range []struct {
+		path string
+		token string
+		want string
+	}{
+		{"/alpha/message", "alpha-token", "alpha"},
+		{"/beta/message", "beta-token", "beta"},
+		{"/beta/message", "alpha-token", ""},
+		{"/gamma/message", "alpha-token", ""},
+	} {
+		if got := post(t, h, c.path, c.token, "roll 1d1"); got != c.want {
+			t.Errorf("%s with %s answered by %q, want %q", c.path, c.token, got, c.want)
+		}
+	}
+	if got, want := alpha.URL("/dialog"), "http://localhost:"+strings.Split(h.Addr(), ":")[1]+"/alpha/dialog"; got != want {
+		t.Errorf("URL is %q, want %q", got, want)
+	}
+}
+
+// Free text answered by a trigger must not become a command label.
+func TestRequestsMetricCommands(t *testing.T) {
+	h, err := engine.NewHost("127.0.0.1:0", config.TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := engine.NewHosted(&config.Config{
+		Username: "alpha",
+		Token: "alpha-token",
+		DataDir: t.TempDir(),
+		Plugins: []config.PluginConfig{{Name: "Exec", Settings: map[string]interface{}{
+			"programs": []interface{}{
+				map[string]interface{}{"command": "hello", "path": "/bin/echo", "args": []string{"hi"}},
+				map[string]interface{}{"trigger": "thanks", "path": "/bin/echo", "args": []string{"welcome"}},
+			},
+		}}},
+	}, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Done)
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Shutdown(context.Background()) })
+
+	post(t, h, "/alpha/message", "alpha-token", "hello")
+	post(t, h, "/alpha/message", "alpha-token", "many thanks")
+	resp, err := http.Get("http://" + h.Addr() + "/alpha/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bb, _ := ioutil.ReadAll(resp.Body)
+	out := string(bb)
+	for _, want := range []string{`command="hello"`, `command="other"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Metrics lack %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `command="many"`) {
+		t.Errorf("Free text became a label:\n%s", out)
+	}
+}
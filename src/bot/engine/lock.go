@@ -0,0 +1,45 @@
+package engine
+
+import "bot/config"
+import "errors"
+import "os"
+import "syscall"
+
+var ErrDataDirLocked = errors.New("The data directory is in use by a running bot")
+
+// DataDirLock is held by a bot, or a tool changing its data, for as long
+// as it uses a data directory, so that two processes don't write the
+// same files.  The lock goes with the process, so a crash can't leave it
+// behind.
+type DataDirLock struct {
+	f *os.File
+}
+
+// LockDataDir takes the lock on cfg's data directory, failing with
+// ErrDataDirLocked if another bot or tool holds it.
+func LockDataDir(cfg *config.Config) (*DataDirLock, error) {
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(cfg.GetDataPath(".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrDataDirLocked
+		}
+		return nil, err
+	}
+	return &DataDirLock{f}, nil
+}
+
+// Unlock releases the lock.  It may be called more than once.
+func (l *DataDirLock) Unlock() {
+	if l == nil || l.f == nil {
+		return
+	}
+	l.f.Close()
+	l.f = nil
+}
@@ -0,0 +1,25 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "testing"
+
+func TestDataDirLocked(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+	})
+	cfg := *h.Bot.Config()
+	if _, err := engine.LockDataDir(&cfg); err != engine.ErrDataDirLocked {
+		t.Fatalf("Got %v while the bot runs", err)
+	}
+	if _, err := engine.NewOffline(&cfg); err != engine.ErrDataDirLocked {
+		t.Fatalf("Started a second bot: %v", err)
+	}
+	h.Bot.Done()
+	lock, err := engine.LockDataDir(&cfg)
+	if err != nil {
+		t.Fatalf("Got %v after the bot stopped", err)
+	}
+	lock.Unlock()
+}
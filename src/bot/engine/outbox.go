@@ -0,0 +1,339 @@
+package engine
+
+import "bot/config"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+import "gopkg.in/yaml.v2"
+
+const outboxDefaultMaxAttempts = 8
+const outboxDefaultRatePerMinute = 60
+const outboxDefaultTimeoutSeconds = 10
+const outboxBaseBackoff = 5 * time.Second
+const outboxMaxBackoff = 15 * time.Minute
+
+// OutboxMessage is one payload waiting to be POSTed to a Mattermost
+// incoming webhook or response_url.
+type OutboxMessage struct {
+	ID int64
+	Hook string
+	Payload *BotResponse
+	Platform Platform `yaml:",omitempty"`
+	Created time.Time
+	Expires time.Time
+	Attempts int
+	NextAttempt time.Time
+	LastError string
+}
+
+type outboxState struct {
+	NextID int64
+	Queue []*OutboxMessage
+	Dead []*OutboxMessage
+}
+
+// Outbox delivers outbound posts for all of a bot's plugins.  Messages
+// are persisted under the bot's DataDir, retried with exponential
+// backoff, rate limited per hook and moved to a dead-letter list once
+// they run out of attempts or expire.  Backoff and expiry follow the
+// bot's clock; the rate limit paces real requests, so it follows the
+// wall clock.
+type Outbox struct {
+	m sync.Mutex
+	fn string
+	state outboxState
+	maxAttempts int
+	interval time.Duration
+	client *http.Client
+	lastSent map[string]time.Time
+	bot *Bot
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// OutboxPath returns the outbox file used by the bot with cfg.
+func OutboxPath(cfg *config.Config) string {
+	return cfg.GetDataPath("outbox.yml")
+}
+
+// LoadOutbox opens the outbox of the bot with cfg without starting
+// delivery, so that dead letters can be inspected and replayed while the
+// bot is stopped.
+func LoadOutbox(cfg *config.Config) (*Outbox, error) {
+	o := newOutbox(cfg, nil)
+	return o, o.load()
+}
+
+func newOutbox(cfg *config.Config, b *Bot) *Outbox {
+	oc := cfg.Outbox
+	if oc.MaxAttempts <= 0 {
+		oc.MaxAttempts = outboxDefaultMaxAttempts
+	}
+	if oc.RatePerMinute <= 0 {
+		oc.RatePerMinute = outboxDefaultRatePerMinute
+	}
+	if oc.TimeoutSeconds <= 0 {
+		oc.TimeoutSeconds = outboxDefaultTimeoutSeconds
+	}
+	return &Outbox{
+		fn: OutboxPath(cfg),
+		maxAttempts: oc.MaxAttempts,
+		interval: time.Minute / time.Duration(oc.RatePerMinute),
+		client: &http.Client{
+			Timeout: time.Duration(oc.TimeoutSeconds) * time.Second,
+		},
+		lastSent: make(map[string]time.Time),
+		bot: b,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// now returns the time by the bot's clock.
+func (o *Outbox) now() time.Time {
+	if o.bot == nil {
+		return time.Now()
+	}
+	return o.bot.Now()
+}
+
+func (o *Outbox) load() error {
+	b, err := ioutil.ReadFile(o.fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, &o.state)
+}
+
+// save writes the outbox atomically.  The caller must hold o.m.
+func (o *Outbox) save() error {
+	y, err := yaml.Marshal(&o.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.fn, y, 0600)
+}
+
+// Start begins delivering queued messages in the background.
+func (o *Outbox) Start() {
+	o.quit = make(chan struct{})
+	o.done = make(chan struct{})
+	go o.run()
+}
+
+// Stop ends delivery.  Undelivered messages stay on disk for next time.
+func (o *Outbox) Stop() {
+	if o.quit == nil {
+		return
+	}
+	close(o.quit)
+	<-o.done
+	o.quit = nil
+}
+
+// Enqueue queues payload for delivery to hook.  A zero expires means the
+// message is retried until it runs out of attempts.
+func (o *Outbox) Enqueue(hook string, payload *BotResponse, expires time.Time) error {
+	return o.EnqueueFor(PlatformMattermost, hook, payload, expires)
+}
+
+// EnqueueFor queues payload for a hook of another platform, encoded the
+// way that platform expects when it is sent.
+func (o *Outbox) EnqueueFor(platform Platform, hook string, payload *BotResponse, expires time.Time) error {
+	o.m.Lock()
+	o.state.NextID++
+	now := o.now()
+	o.state.Queue = append(o.state.Queue, &OutboxMessage{
+		ID: o.state.NextID,
+		Hook: hook,
+		Payload: payload,
+		Platform: platform,
+		Created: now,
+		Expires: expires,
+		NextAttempt: now,
+	})
+	err := o.save()
+	o.m.Unlock()
+	o.signal()
+	return err
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// DeadLetters returns copies of the messages that could not be delivered.
+func (o *Outbox) DeadLetters() []OutboxMessage {
+	o.m.Lock()
+	defer o.m.Unlock()
+	out := make([]OutboxMessage, len(o.state.Dead))
+	for i, msg := range o.state.Dead {
+		out[i] = *msg
+	}
+	return out
+}
+
+// Replay moves the dead letter with id, or all of them if id is 0, back
+// onto the queue with a fresh set of attempts.  It returns the number of
+// messages requeued.
+func (o *Outbox) Replay(id int64) (int, error) {
+	o.m.Lock()
+	keep := make([]*OutboxMessage, 0, len(o.state.Dead))
+	n := 0
+	now := o.now()
+	for _, msg := range o.state.Dead {
+		if id != 0 && msg.ID != id {
+			keep = append(keep, msg)
+			continue
+		}
+		msg.Attempts = 0
+		msg.NextAttempt = now
+		msg.Expires = time.Time{}
+		o.state.Queue = append(o.state.Queue, msg)
+		n++
+	}
+	o.state.Dead = keep
+	err := o.save()
+	o.m.Unlock()
+	if id != 0 && n == 0 {
+		return 0, fmt.Errorf("No dead letter with id %d", id)
+	}
+	o.signal()
+	return n, err
+}
+
+func (o *Outbox) run() {
+	defer close(o.done)
+	for {
+		wait := o.deliverDue()
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-o.wake:
+			t.Stop()
+		case <-o.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// RunDue delivers the messages that are due by the bot's clock, one
+// after another, and returns once none is.  Tests that keep the outbox
+// stopped and move a fake clock call it.
+func (o *Outbox) RunDue() {
+	for o.deliverDue() == 0 {
+	}
+}
+
+// deliverDue sends at most one message that is due and whose hook is not
+// rate limited, then returns how long to wait before looking again.
+// Expired messages are dead-lettered unsent.
+func (o *Outbox) deliverDue() time.Duration {
+	o.m.Lock()
+	now := o.now()
+	sent := time.Now()
+	wait := time.Minute
+	var next *OutboxMessage
+	for _, msg := range o.state.Queue {
+		if !msg.Expires.IsZero() && now.After(msg.Expires) {
+			next = msg
+			break
+		}
+		d := msg.NextAttempt.Sub(now)
+		if limit := o.lastSent[msg.Hook].Add(o.interval).Sub(sent); limit > d {
+			d = limit
+		}
+		if d <= 0 {
+			next = msg
+			break
+		}
+		if d < wait {
+			wait = d
+		}
+	}
+	if next == nil {
+		o.m.Unlock()
+		return wait
+	}
+	if !next.Expires.IsZero() && now.After(next.Expires) {
+		next.LastError = "expired before delivery"
+		o.remove(next)
+		o.state.Dead = append(o.state.Dead, next)
+		o.deadLettered(next)
+		o.saveLogged()
+		o.m.Unlock()
+		return 0
+	}
+	o.lastSent[next.Hook] = sent
+	o.m.Unlock()
+
+	err := postToIncoming(o.client, next.Hook, encodeResponse(next.Platform, next.Payload))
+
+	o.m.Lock()
+	defer o.m.Unlock()
+	if err == nil {
+		o.remove(next)
+	} else {
+		next.Attempts++
+		next.LastError = err.Error()
+		o.failed(next)
+		expired := !next.Expires.IsZero() && o.now().After(next.Expires)
+		if next.Attempts >= o.maxAttempts || expired {
+			o.remove(next)
+			o.state.Dead = append(o.state.Dead, next)
+			o.deadLettered(next)
+		} else {
+			backoff := outboxBaseBackoff << uint(next.Attempts-1)
+			if backoff > outboxMaxBackoff || backoff <= 0 {
+				backoff = outboxMaxBackoff
+			}
+			next.NextAttempt = o.now().Add(backoff)
+		}
+	}
+	o.saveLogged()
+	return 0
+}
+
+// saveLogged saves the outbox, logging rather than returning a failure.
+// The caller must hold o.m.
+func (o *Outbox) saveLogged() {
+	if err := o.save(); err != nil && o.bot != nil {
+		o.bot.Log().Errorf("Saving outbox failed: %v", err)
+	}
+}
+
+// remove drops msg from the queue.  The caller must hold o.m.
+func (o *Outbox) remove(msg *OutboxMessage) {
+	for i, m := range o.state.Queue {
+		if m == msg {
+			o.state.Queue = append(o.state.Queue[:i], o.state.Queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o *Outbox) failed(msg *OutboxMessage) {
+	if o.bot == nil {
+		return
+	}
+	o.bot.metrics.postFailures.Inc()
+	o.bot.Log().Warnf("POST of outbox message %d to %s failed (attempt %d): %s", msg.ID, msg.Hook, msg.Attempts, msg.LastError)
+}
+
+func (o *Outbox) deadLettered(msg *OutboxMessage) {
+	if o.bot == nil {
+		return
+	}
+	o.bot.metrics.deadLetters.Inc()
+	o.bot.Log().Errorf("Outbox message %d to %s moved to dead letters", msg.ID, msg.Hook)
+}
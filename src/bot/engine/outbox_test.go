@@ -0,0 +1,149 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "net/http"
+import "net/http/httptest"
+import "sync"
+import "testing"
+import "time"
+
+// hook is an incoming webhook that fails until told otherwise.
+type hook struct {
+	m sync.Mutex
+	status int
+	hits int
+	*httptest.Server
+}
+
+func newHook(t *testing.T, status int) *hook {
+	h := &hook{status: status}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.m.Lock()
+		defer h.m.Unlock()
+		h.hits++
+		w.WriteHeader(h.status)
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *hook) set(status int) {
+	h.m.Lock()
+	h.status = status
+	h.m.Unlock()
+}
+
+func (h *hook) count() int {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.hits
+}
+
+// outboxBot runs a bot whose outbox is driven by the test through
+// RunDue, on a fake clock.
+func outboxBot(t *testing.T, maxAttempts int) (*engine.Bot, *enginetest.Clock) {
+	cfg := &config.Config{
+		Username: "testbot",
+		Token: "test-token",
+		Port: 1,
+		DataDir: t.TempDir(),
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+		Outbox: config.OutboxConfig{
+			MaxAttempts: maxAttempts,
+			// fast enough not to hold up the test
+			RatePerMinute: 1 << 30,
+		},
+	}
+	clock := enginetest.NewClock(enginetest.Epoch)
+	b, err := engine.NewOffline(cfg, engine.WithClock(clock), engine.WithoutBackground())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Done)
+	return b, clock
+}
+
+func enqueue(t *testing.T, b *engine.Bot, url string, expires time.Time) {
+	t.Helper()
+	if err := b.Outbox().Enqueue(url, &engine.BotResponse{Text: "hello"}, expires); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxRetriesWithBackoff(t *testing.T) {
+	b, clock := outboxBot(t, 5)
+	h := newHook(t, http.StatusInternalServerError)
+	enqueue(t, b, h.URL, time.Time{})
+
+	// 5s, then 10s, then 20s between attempts
+	for i, wait := range []time.Duration{0, 5 * time.Second, 10 * time.Second} {
+		clock.Advance(wait - time.Millisecond)
+		b.Outbox().RunDue()
+		if h.count() != i {
+			t.Fatalf("Attempt %d came early", i+1)
+		}
+		clock.Advance(time.Millisecond)
+		b.Outbox().RunDue()
+		if h.count() != i+1 {
+			t.Fatalf("Got %d attempts, want %d", h.count(), i+1)
+		}
+	}
+
+	h.set(http.StatusOK)
+	clock.Advance(20 * time.Second)
+	b.Outbox().RunDue()
+	clock.Advance(time.Hour)
+	b.Outbox().RunDue()
+	if h.count() != 4 || len(b.Outbox().DeadLetters()) != 0 {
+		t.Errorf("Got %d attempts and %d dead letters", h.count(), len(b.Outbox().DeadLetters()))
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	b, clock := outboxBot(t, 2)
+	h := newHook(t, http.StatusInternalServerError)
+	enqueue(t, b, h.URL, time.Time{})
+	b.Outbox().RunDue()
+	clock.Advance(time.Minute)
+	b.Outbox().RunDue()
+	dead := b.Outbox().DeadLetters()
+	if h.count() != 2 || len(dead) != 1 || dead[0].Attempts != 2 {
+		t.Fatalf("Got %d attempts and dead letters %+v", h.count(), dead)
+	}
+
+	// replayed, it gets a fresh set of attempts
+	h.set(http.StatusOK)
+	if n, err := b.Outbox().Replay(0); n != 1 || err != nil {
+		t.Fatalf("Replayed %d: %v", n, err)
+	}
+	b.Outbox().RunDue()
+	if h.count() != 3 || len(b.Outbox().DeadLetters()) != 0 {
+		t.Errorf("Got %d attempts and %d dead letters after replay", h.count(), len(b.Outbox().DeadLetters()))
+	}
+}
+
+// A response_url that has expired must not be posted to, even on the
+// first attempt, e.g. when the bot restarts with it queued.
+func TestOutboxExpiry(t *testing.T) {
+	b, clock := outboxBot(t, 5)
+	h := newHook(t, http.StatusOK)
+	enqueue(t, b, h.URL, clock.Now().Add(time.Minute))
+	clock.Advance(2 * time.Minute)
+	b.Outbox().RunDue()
+	dead := b.Outbox().DeadLetters()
+	if h.count() != 0 || len(dead) != 1 || dead[0].Attempts != 0 {
+		t.Errorf("Got %d attempts and dead letters %+v", h.count(), dead)
+	}
+
+	// and one that expires while being retried stops there
+	h.set(http.StatusInternalServerError)
+	enqueue(t, b, h.URL, clock.Now().Add(time.Minute))
+	b.Outbox().RunDue()
+	clock.Advance(2 * time.Minute)
+	b.Outbox().RunDue()
+	if h.count() != 1 || len(b.Outbox().DeadLetters()) != 2 {
+		t.Errorf("Got %d attempts and %d dead letters", h.count(), len(b.Outbox().DeadLetters()))
+	}
+}
@@ -1,11 +1,17 @@
 package engine
 
-import "log"
+import "bot/logging"
 import "os"
 import "encoding/json"
 import "bytes"
 import "fmt"
 import "net/http"
+import "sort"
+import "io"
+import "io/ioutil"
+import "time"
+import "sync"
+import "gopkg.in/yaml.v2"
 
 type Plugin interface {
 	Handle(b *Bot, req *BotRequest) (*BotResponse, bool)
@@ -14,18 +20,52 @@ type Plugin interface {
 	Done()
 	ConfigPath() string
 	SetConfigPath(s string)
+	Settings() map[string]interface{}
+	SetSettings(s map[string]interface{})
+	Log() *logging.Logger
+	SetLogger(l *logging.Logger)
 }
 
-var plugins = make([]Plugin, 0)
+// PluginFactory builds a fresh plugin instance for a bot.
+type PluginFactory func(b *Bot) Plugin
 
-func RegisterPlugin( p Plugin ) {
-	plugins = append(plugins, p)
-	log.Printf("Registered plugin %s", p.Name())
+var plugins = make(map[string]PluginFactory)
+
+func RegisterPlugin( name string, f PluginFactory ) {
+	plugins[name] = f
+	logging.Debugf("Registered plugin %s", name)
+}
+
+// RegisteredPlugins returns the names of all known plugins, sorted.
+func RegisteredPlugins() []string {
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 type PluginBase struct {
 	Bot *Bot
 	configPath string
+	sm sync.RWMutex
+	settings map[string]interface{}
+	log *logging.Logger
+	stm sync.Mutex
+	store *Store
+}
+
+// Log returns the logger tagged with the plugin's bot and name.
+func (b *PluginBase) Log() *logging.Logger {
+	if b.log == nil {
+		return logging.With("plugin", "unknown")
+	}
+	return b.log
+}
+
+func (b *PluginBase) SetLogger(l *logging.Logger) {
+	b.log = l
 }
 
 func (b *PluginBase) ConfigPath() string {
@@ -37,7 +77,72 @@ func (b *PluginBase) SetConfigPath(s string) {
 	os.MkdirAll(b.configPath, 0700)
 }
 
+// Settings returns the inline settings given to the plugin in the bot
+// config, or nil if there are none.
+func (b *PluginBase) Settings() map[string]interface{} {
+	b.sm.RLock()
+	defer b.sm.RUnlock()
+	return b.settings
+}
+
+func (b *PluginBase) SetSettings(s map[string]interface{}) {
+	b.sm.Lock()
+	defer b.sm.Unlock()
+	b.settings = s
+}
+
+// DecodeSettings unpacks the plugin's inline settings into out, which
+// should be a pointer to a struct laid out like a YAML config.
+func (b *PluginBase) DecodeSettings(out interface{}) error {
+	bb, err := yaml.Marshal(b.Settings())
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(bb, out)
+}
+
+// Store returns the plugin's persistent store, kept in its data
+// directory in the format chosen by the bot's storage setting.
+func (b *PluginBase) Store() (*Store, error) {
+	b.stm.Lock()
+	defer b.stm.Unlock()
+	if b.store == nil {
+		s, err := OpenStore(b.ConfigPath(), b.Bot.Config().Storage)
+		if err != nil {
+			return nil, err
+		}
+		b.store = s
+	}
+	return b.store, nil
+}
+
+// closeStore is called by the bot once the plugin is done.
+func (b *PluginBase) closeStore() {
+	b.stm.Lock()
+	defer b.stm.Unlock()
+	if b.store != nil {
+		if err := b.store.Close(); err != nil {
+			b.Log().Warnf("Closing store failed: %v", err)
+		}
+		b.store = nil
+	}
+}
+
+var incomingClient = &http.Client{
+	Timeout: outboxDefaultTimeoutSeconds * time.Second,
+}
+
+// PostToIncoming posts payload to hookUrl once and waits for the result.
+// Plugins posting in the background should use the bot's Outbox instead.
 func (b *PluginBase) PostToIncoming( hookUrl string, payload *BotResponse ) error {
+	err := postToIncoming(incomingClient, hookUrl, payload)
+	if err != nil && b.Bot != nil {
+		b.Bot.metrics.postFailures.Inc()
+	}
+	return err
+}
+
+func postToIncoming( client *http.Client, hookUrl string, payload interface{} ) error {
 
 	bb, err := json.Marshal( payload )
 	if err != nil {
@@ -53,11 +158,13 @@ func (b *PluginBase) PostToIncoming( hookUrl string, payload *BotResponse ) erro
 		return err
 	}
 
-	client := &http.Client{}
+	req.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
 
 	if resp.StatusCode / 100 != 2 {
 		return fmt.Errorf("Non 2xx response code returned: %d", resp.StatusCode)
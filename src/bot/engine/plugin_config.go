@@ -1,11 +1,108 @@
 package engine
 
+import "bot/config"
+import "fmt"
+import "reflect"
+import "sort"
+
+// defaultPlugins lists the plugins a bot runs when its config names none,
+// in dispatch order.
+var defaultPlugins = []string{
+	"Feed",
+	"Dice",
+	"Gem",
+}
+
+// pluginConfigs returns the plugins enabled by cfg in dispatch order.
+func pluginConfigs(cfg *config.Config) []config.PluginConfig {
+	if len(cfg.Plugins) == 0 {
+		out := make([]config.PluginConfig, len(defaultPlugins))
+		for i, name := range defaultPlugins {
+			out[i].Name = name
+		}
+		return out
+	}
+	out := make([]config.PluginConfig, len(cfg.Plugins))
+	copy(out, cfg.Plugins)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Priority < out[j].Priority
+	})
+	return out
+}
+
+// checkPlugins reports plugins named in cfg that are not registered.
+func checkPlugins(cfg *config.Config) error {
+	for _, pc := range cfg.Plugins {
+		if _, ok := plugins[pc.Name]; !ok {
+			return fmt.Errorf("Unknown plugin %s", pc.Name)
+		}
+	}
+	return nil
+}
+
 func GetPlugins(b *Bot) []Plugin {
 
-	return []Plugin{
-		NewPluginFeed(b),
-		NewPluginDice(b),
-		NewPluginGem(b),
+	pcs := pluginConfigs(b.Config())
+	out := make([]Plugin, 0, len(pcs))
+	for _, pc := range pcs {
+		out = append(out, plugins[pc.Name](b))
 	}
+	return out
 	
-}
\ No newline at end of file
+}
+
+// startPlugin prepares a new plugin instance with its data directory
+// and settings, then initialises it.
+func (b *Bot) startPlugin(p Plugin, settings map[string]interface{}) {
+	p.SetLogger(b.Log().With("plugin", p.Name()))
+	p.SetConfigPath( b.Config().DataDir + "/" + p.Name() )
+	p.SetSettings(settings)
+	p.Init()
+}
+
+// storeCloser is implemented by plugins embedding PluginBase.
+type storeCloser interface {
+	closeStore()
+}
+
+// stopPlugin ends the plugin and releases its store.
+func stopPlugin(p Plugin) {
+	p.Done()
+	if sc, ok := p.(storeCloser); ok {
+		sc.closeStore()
+	}
+}
+
+// applyPlugins brings the running plugin set in line with cfg.  Plugins
+// that stay enabled keep their instance and runtime state; new ones are
+// started and dropped ones are stopped.
+func (b *Bot) applyPlugins(cfg *config.Config) {
+	current := make(map[string]Plugin)
+	for _, p := range b.activePlugins() {
+		current[p.Name()] = p
+	}
+	pcs := pluginConfigs(cfg)
+	next := make([]Plugin, 0, len(pcs))
+	for _, pc := range pcs {
+		p, ok := current[pc.Name]
+		if !ok {
+			p = plugins[pc.Name](b)
+			b.startPlugin(p, pc.Settings)
+			b.Log().Infof("Plugin %s enabled", pc.Name)
+		} else {
+			delete(current, pc.Name)
+			if !reflect.DeepEqual(p.Settings(), pc.Settings) {
+				b.Log().Infof("Plugin %s settings changed", pc.Name)
+				p.SetSettings(pc.Settings)
+			}
+		}
+		next = append(next, p)
+	}
+	for name, p := range current {
+		b.Log().Infof("Plugin %s disabled", name)
+		stopPlugin(p)
+	}
+	b.m.Lock()
+	b.Plugins = next
+	b.m.Unlock()
+}
@@ -1,6 +1,5 @@
 package engine
 
-import "log"
 import "time"
 import "fmt"
 import "math/rand"
@@ -12,7 +11,30 @@ type PluginDice struct {
 	PluginBase
 }
 
+// PluginDiceSettings are read from the plugin's inline bot settings.
+type PluginDiceSettings struct {
+	MaxDice int
+	DefaultSides int
+}
+
+func (p *PluginDice) settings() *PluginDiceSettings {
+	s := &PluginDiceSettings{}
+	if err := p.DecodeSettings(s); err != nil {
+		p.Log().Warnf("Bad settings: %v", err)
+	}
+	if s.MaxDice < 1 {
+		s.MaxDice = 20
+	}
+	if s.DefaultSides < 1 {
+		s.DefaultSides = 6
+	}
+	return s
+}
+
 func init() {
+	RegisterPlugin("Dice", func(b *Bot) Plugin {
+		return NewPluginDice(b)
+	})
 }
 
 var reNSided = regexp.MustCompile("^([0-9]+)$")
@@ -20,7 +42,7 @@ var rexDy = regexp.MustCompile("^([0-9]+)?d([0-9]+)$")
 
 func (p *PluginDice) Init() {
 	//
-	log.Printf("Init for plugin %s", p.Name()) 
+	p.Log().Infof("Init for plugin %s", p.Name()) 
 	rand.Seed(time.Now().UnixNano())
 }
 
@@ -33,25 +55,35 @@ func (p *PluginDice) Name() string {
 }
 
 func (p *PluginDice) Handle( b *Bot, req *BotRequest ) (*BotResponse, bool) {
+	return p.HandleCommands(p.Commands(), b, req)
+}
 
-	command, args := req.CommandAndArgs(1)
-
-	log.Printf("Command: %s, Args: %+v", command, args)
-	
-		if command != "roll" {
-		return nil, false
+func (p *PluginDice) Commands() []*Command {
+	return []*Command{
+		{
+			Name: "roll",
+			Usage: "Roll dice, given as <sides> or <qty>d<sides>.",
+			Args: []Arg{
+				{Name: "dice", Optional: true},
+			},
+			Run: p.roll,
+		},
 	}
+}
+
+func (p *PluginDice) roll( ctx *CommandContext ) *BotResponse {
 
+	settings := p.settings()
 	qty := 1
-	sides := 6
+	sides := settings.DefaultSides
 
-	if len(args) == 1 {
-		if reNSided.MatchString(args[0]) {
-			m := reNSided.FindAllStringSubmatch(args[0], -1)
+	if dice := ctx.Arg("dice"); dice != "" {
+		if reNSided.MatchString(dice) {
+			m := reNSided.FindAllStringSubmatch(dice, -1)
 			i, _ := strconv.ParseInt(m[0][1], 10, 64)
 			sides = int(i)
-		} else if rexDy.MatchString(args[0]) {
-			m := rexDy.FindAllStringSubmatch(args[0], -1)
+		} else if rexDy.MatchString(dice) {
+			m := rexDy.FindAllStringSubmatch(dice, -1)
 			i, _ := strconv.ParseInt(m[0][1], 10, 64)
 			qty = int(i)
 			i, _ = strconv.ParseInt(m[0][2], 10, 64)
@@ -65,8 +97,8 @@ func (p *PluginDice) Handle( b *Bot, req *BotRequest ) (*BotResponse, bool) {
 	if qty < 1 {
 		qty = 1
 	}
-	if qty > 20 {
-		qty = 20
+	if qty > settings.MaxDice {
+		qty = settings.MaxDice
 	}
 	
 	results := make([]string, qty)
@@ -80,11 +112,11 @@ func (p *PluginDice) Handle( b *Bot, req *BotRequest ) (*BotResponse, bool) {
 	r.AddAttachment(
 		&BotResponseAttachment{
 			Color: "#00ff00",	
-			Text: fmt.Sprintf("%s rolls %s", req.UserName, strings.Join(results, ", ")),
+			Text: fmt.Sprintf("%s rolls %s", ctx.Request.UserName, strings.Join(results, ", ")),
 			Title: fmt.Sprintf("Roll %d %d-sided dice", qty, sides),
 		},
 	)
-	return r, true
+	return r
 }
 
 func NewPluginDice(b *Bot) *PluginDice {
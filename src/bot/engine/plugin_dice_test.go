@@ -0,0 +1,50 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine/enginetest"
+import "testing"
+
+func diceBot(t *testing.T) *enginetest.Harness {
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{
+			{Name: "Dice", Settings: map[string]interface{}{"maxdice": 3}},
+		},
+	})
+}
+
+// One-sided dice keep the rolls, and so the golden files, deterministic.
+func TestDiceRoll(t *testing.T) {
+	h := diceBot(t)
+	for _, c := range []struct {
+		name string
+		text string
+	}{
+		{"dice_sides", "roll 1"},
+		{"dice_qty", "roll 2d1"},
+		{"dice_max", "roll 9d1"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			resp := h.Send(enginetest.Message(c.text))
+			if resp == nil {
+				t.Fatalf("No response to %q", c.text)
+			}
+			enginetest.AssertGolden(t, c.name, resp)
+		})
+	}
+}
+
+func TestDiceSlash(t *testing.T) {
+	h := diceBot(t)
+	resp := h.Send(enginetest.Slash("/roll 1d1", enginetest.From("alice", "alice-id")))
+	if resp == nil {
+		t.Fatal("No response to /roll")
+	}
+	enginetest.AssertGolden(t, "dice_slash", resp)
+}
+
+func TestDiceIgnoresOthers(t *testing.T) {
+	h := diceBot(t)
+	if resp := h.Send(enginetest.Message("hello there")); resp != nil {
+		t.Errorf("Got %+v, want no response", resp)
+	}
+}
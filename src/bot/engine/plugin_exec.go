@@ -0,0 +1,359 @@
+package engine
+
+import "bytes"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "os"
+import "os/exec"
+import "regexp"
+import "strings"
+import "sync"
+import "time"
+
+const execDefaultTimeoutSeconds = 10
+const execDefaultMaxConcurrent = 4
+const execMaxOutput = 1 << 20
+const execMaxStderr = 64 << 10
+const execWaitDelay = 2 * time.Second
+
+// execBaseEnv is passed through to programs when the settings list no
+// environment variables of their own.
+var execBaseEnv = []string{"PATH", "HOME", "LANG", "TZ"}
+
+// ExecProgram maps a command or a regex trigger to an external program.
+// The program gets the request as JSON on stdin and answers with a
+// response as JSON on stdout.  Plain text output is sent as the
+// response text.
+type ExecProgram struct {
+	Command string
+	Trigger string
+	Usage string
+	Role string
+	Path string
+	Args []string
+	Env map[string]string
+	TimeoutSeconds int
+	Defer bool
+	role Role
+}
+
+// name is how the program is known to auth rules and the logs.
+func (e *ExecProgram) name() string {
+	if e.Command != "" {
+		return e.Command
+	}
+	return e.Trigger
+}
+
+// PluginExecSettings are read from the plugin's inline bot settings.
+type PluginExecSettings struct {
+	TimeoutSeconds int
+	MaxConcurrent int
+	PassEnv []string
+	Programs []*ExecProgram
+}
+
+type PluginExec struct {
+	PluginBase
+	m sync.Mutex
+	s *PluginExecSettings
+	triggers map[string]*regexp.Regexp
+	running int
+}
+
+var errExecBusy = errors.New("Too many programs running")
+
+func init() {
+	RegisterPlugin("Exec", func(b *Bot) Plugin {
+		return NewPluginExec(b)
+	})
+}
+
+// SetSettings decodes the settings once, leaving out programs that can't
+// be run safely: one with an unknown role would otherwise be open to
+// everybody.
+func (p *PluginExec) SetSettings(settings map[string]interface{}) {
+	p.PluginBase.SetSettings(settings)
+	s := &PluginExecSettings{}
+	if err := p.DecodeSettings(s); err != nil {
+		p.Log().Errorf("Bad settings: %v", err)
+		s = &PluginExecSettings{}
+	}
+	if s.TimeoutSeconds <= 0 {
+		s.TimeoutSeconds = execDefaultTimeoutSeconds
+	}
+	if s.MaxConcurrent <= 0 {
+		s.MaxConcurrent = execDefaultMaxConcurrent
+	}
+	if s.PassEnv == nil {
+		s.PassEnv = execBaseEnv
+	}
+	programs := make([]*ExecProgram, 0, len(s.Programs))
+	for _, prog := range s.Programs {
+		role, err := ParseRole(prog.Role)
+		if err != nil {
+			p.Log().Errorf("Program %s disabled: %v", prog.name(), err)
+			continue
+		}
+		prog.role = role
+		if prog.Trigger != "" {
+			if _, err := p.trigger(prog.Trigger); err != nil {
+				p.Log().Errorf("Program %s disabled, bad trigger %q: %v", prog.name(), prog.Trigger, err)
+				continue
+			}
+		}
+		if prog.Path == "" {
+			p.Log().Warnf("Program %s has no path", prog.name())
+		}
+		programs = append(programs, prog)
+	}
+	s.Programs = programs
+	p.m.Lock()
+	p.s = s
+	p.m.Unlock()
+}
+
+func (p *PluginExec) settings() *PluginExecSettings {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.s == nil {
+		return &PluginExecSettings{}
+	}
+	return p.s
+}
+
+func (p *PluginExec) Init() {
+	p.Log().Infof("Init for plugin %s", p.Name())
+	p.Log().Infof("Configured %d programs", len(p.settings().Programs))
+}
+
+func (p *PluginExec) Done() {
+	//
+}
+
+func (p *PluginExec) Name() string {
+	return "Exec"
+}
+
+// trigger returns the compiled form of pattern, cached across requests.
+func (p *PluginExec) trigger(pattern string) (*regexp.Regexp, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if re, ok := p.triggers[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	p.triggers[pattern] = re
+	return re, nil
+}
+
+func (p *PluginExec) Handle( b *Bot, req *BotRequest ) (*BotResponse, bool) {
+	if resp, ok := p.HandleCommands(p.Commands(), b, req); ok {
+		return resp, ok
+	}
+	for _, prog := range p.settings().Programs {
+		if prog.Trigger == "" {
+			continue
+		}
+		re, err := p.trigger(prog.Trigger)
+		if err != nil || !re.MatchString(req.Text) {
+			continue
+		}
+		if err := b.Authorize(req, prog.name(), prog.role); err != nil {
+			return &BotResponse{
+				Text: err.Error(),
+				ResponseType: "ephemeral",
+			}, true
+		}
+		return p.run(prog, req), true
+	}
+	return nil, false
+}
+
+func (p *PluginExec) Commands() []*Command {
+	cmds := make([]*Command, 0)
+	for _, prog := range p.settings().Programs {
+		if prog.Command == "" {
+			continue
+		}
+		prog := prog
+		cmds = append(cmds, &Command{
+			Name: prog.Command,
+			Usage: prog.Usage,
+			Role: prog.role,
+			Args: []Arg{
+				{Name: "args", Optional: true, Rest: true},
+			},
+			Run: func(ctx *CommandContext) *BotResponse {
+				return p.run(prog, ctx.Request)
+			},
+		})
+	}
+	return cmds
+}
+
+// run answers req with the output of prog, in the background if the
+// program is marked Defer.
+func (p *PluginExec) run( prog *ExecProgram, req *BotRequest ) *BotResponse {
+	if !prog.Defer {
+		return p.respond(prog, req)
+	}
+	return p.Defer(req, func(d *Deferred) {
+		d.Post(p.respond(prog, req))
+	})
+}
+
+func (p *PluginExec) respond( prog *ExecProgram, req *BotRequest ) *BotResponse {
+	resp, err := p.execute(prog, req)
+	if err == errExecBusy {
+		return &BotResponse{
+			Text: "Busy, try again shortly.",
+			ResponseType: "ephemeral",
+		}
+	}
+	if err != nil {
+		p.Log().Warnf("Program %s failed: %v", prog.name(), err)
+		return &BotResponse{
+			Text: "Command failed.",
+			ResponseType: "ephemeral",
+		}
+	}
+	return resp
+}
+
+// execute runs prog with req on stdin and decodes its output.
+func (p *PluginExec) execute( prog *ExecProgram, req *BotRequest ) (*BotResponse, error) {
+	s := p.settings()
+	if !p.acquire(s.MaxConcurrent) {
+		return nil, errExecBusy
+	}
+	defer p.release()
+
+	timeout := prog.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = s.TimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout) * time.Second)
+	defer cancel()
+
+	in := *req
+	in.Token = ""
+	stdin, err := json.Marshal(&in)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, prog.Path, prog.Args...)
+	cmd.Dir = p.ConfigPath()
+	cmd.Env = p.environ(s.PassEnv, prog, req)
+	cmd.Stdin = bytes.NewReader(stdin)
+	stdout := &limitedBuffer{max: execMaxOutput}
+	stderr := &limitedBuffer{max: execMaxStderr}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = execWaitDelay
+
+	start := time.Now()
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %ds", timeout)
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, msg)
+		} else {
+			p.Log().Debugf("Program %s stderr: %s", prog.name(), msg)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stdout.overflow {
+		return nil, fmt.Errorf("output exceeds %d bytes", execMaxOutput)
+	}
+	p.Log().Debugf("Program %s finished in %v", prog.name(), time.Since(start))
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 {
+		return nil, errors.New("no output")
+	}
+	resp := &BotResponse{}
+	if out[0] != '{' {
+		resp.Text = string(out)
+		return resp, nil
+	}
+	if err = json.Unmarshal(out, resp); err != nil {
+		return nil, fmt.Errorf("bad response: %v", err)
+	}
+	return resp, nil
+}
+
+func (p *PluginExec) acquire(max int) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.running >= max {
+		return false
+	}
+	p.running++
+	return true
+}
+
+func (p *PluginExec) release() {
+	p.m.Lock()
+	p.running--
+	p.m.Unlock()
+}
+
+// environ builds a program's environment from the allowed variables of
+// the bot's own environment, the program's settings and a few
+// describing the request.
+func (p *PluginExec) environ( pass []string, prog *ExecProgram, req *BotRequest ) []string {
+	env := make([]string, 0, len(pass)+len(prog.Env)+4)
+	for _, name := range pass {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	for k, v := range prog.Env {
+		env = append(env, k+"="+v)
+	}
+	command, _ := req.CommandAndArgs(0)
+	return append(env,
+		"RETROBOT_BOT="+p.Bot.Config().Username,
+		"RETROBOT_DATADIR="+p.ConfigPath(),
+		"RETROBOT_COMMAND="+command,
+		"RETROBOT_SOURCE="+req.Source.String(),
+	)
+}
+
+// limitedBuffer keeps the first max bytes written to it and notes
+// whether anything more was discarded.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+	overflow bool
+}
+
+func (l *limitedBuffer) Write(b []byte) (int, error) {
+	if room := l.max - l.Len(); len(b) > room {
+		l.overflow = true
+		if room > 0 {
+			l.Buffer.Write(b[:room])
+		}
+		return len(b), nil
+	}
+	return l.Buffer.Write(b)
+}
+
+func NewPluginExec(b *Bot) *PluginExec {
+	return &PluginExec{
+		PluginBase: PluginBase{
+			Bot: b,
+		},
+		triggers: make(map[string]*regexp.Regexp),
+	}
+}
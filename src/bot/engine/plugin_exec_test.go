@@ -0,0 +1,45 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine/enginetest"
+import "strings"
+import "testing"
+
+func execBot(t *testing.T, programs ...map[string]interface{}) *enginetest.Harness {
+	list := make([]interface{}, len(programs))
+	for i, prog := range programs {
+		list[i] = prog
+	}
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{
+			{Name: "Exec", Settings: map[string]interface{}{"programs": list}},
+		},
+		Config: func(cfg *config.Config) {
+			cfg.Auth.Admins = []string{"admin-id"}
+		},
+	})
+}
+
+func TestExecRuns(t *testing.T) {
+	h := execBot(t, map[string]interface{}{"command": "hello", "path": "/bin/echo", "args": []string{"hello there"}})
+	resp := h.Send(enginetest.Message("hello"))
+	if resp == nil || strings.TrimSpace(resp.Text) != "hello there" {
+		t.Errorf("Got %+v", resp)
+	}
+}
+
+// A misspelled role must not leave the program open to everybody.
+func TestExecBadRoleFailsClosed(t *testing.T) {
+	h := execBot(t,
+		map[string]interface{}{"command": "secret", "role": "admn", "path": "/bin/echo", "args": []string{"ran"}},
+		map[string]interface{}{"trigger": "(?i)^secret!$", "role": "admn", "path": "/bin/echo", "args": []string{"ran"}},
+	)
+	for _, text := range []string{"secret", "secret!"} {
+		for _, user := range []enginetest.RequestOption{enginetest.From("tester", "tester-id"), enginetest.From("admin", "admin-id")} {
+			resp := h.Send(enginetest.Message(text, user))
+			if resp != nil && strings.Contains(resp.Text, "ran") {
+				t.Errorf("%q ran: %+v", text, resp)
+			}
+		}
+	}
+}
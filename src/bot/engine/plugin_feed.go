@@ -1,8 +1,16 @@
 package engine
 
 import "strings"
+import "strconv"
+import "net/url"
+import "errors"
+import "fmt"
+import "reflect"
+import "sync"
+import "os"
 import "time"
-import "log"
+import "bot/logging"
+import "bot/tmpl"
 import "io/ioutil"
 import "gopkg.in/yaml.v2"
 import "github.com/mmcdole/gofeed"
@@ -13,6 +21,9 @@ type Feed struct {
 	Name string
 	URL string
 	CheckMinutes int
+	// Cron, if set, checks the feed on a cron schedule such as
+	// "0 8-18 * * 1-5" instead of every CheckMinutes.
+	Cron string
 	Hooks []string
 	IncludeDescription bool
 	Template string
@@ -20,6 +31,19 @@ type Feed struct {
 	lastMaxID int
 	lastUpdated time.Time
 	lastTime time.Time
+	cron Schedule
+}
+
+// due reports whether the feed should be checked at now.
+func (f *Feed) due( now time.Time ) bool {
+	if f.lastTime.IsZero() {
+		return true
+	}
+	if f.cron != nil {
+		next := f.cron.Next(f.lastTime)
+		return !next.IsZero() && !next.After(now)
+	}
+	return now.Sub(f.lastTime) > time.Duration(f.CheckMinutes) * time.Minute
 }
 
 type PluginFeedConfig struct {
@@ -31,96 +55,226 @@ type PluginFeedConfig struct {
 type PluginFeed struct {
 	PluginBase
 	Config *PluginFeedConfig
+	m sync.Mutex
 	fp *gofeed.Parser
+	hm sync.Mutex
+	status map[string]*feedStatus
+	muted map[string]bool
+	// fm serialises rewrites of the config file
+	fm sync.Mutex
+	// pm serialises polls, which run without holding m
+	pm sync.Mutex
+}
+
+const feedPollJob = "Feed/poll"
+const feedPollJitter = 10 * time.Second
+
+// feedStatus records the outcome of the latest fetches of one feed.
+type feedStatus struct {
+	name string
+	lastSuccess time.Time
+	lastError error
 }
 
 func init() {
+	RegisterPlugin("Feed", func(b *Bot) Plugin {
+		return NewPluginFeed(b)
+	})
 }
 
 func (p *PluginFeed) Init() {
-	log.Printf("Init for plugin %s", p.Name()) 	 
-	b, err := ioutil.ReadFile( p.ConfigPath()+"/config.yml" )
+	p.Log().Infof("Init for plugin %s", p.Name()) 	 
+	cfg, err := p.loadConfig()
 	if err == nil {
-		log.Println("Found feed config..")
-		cfg := &PluginFeedConfig{}
-		err = yaml.Unmarshal(b, cfg)
-		if err == nil {
-			log.Printf("Parsed feed config and got %d feeds", len(cfg.FeedList))
-			p.Config = cfg	
-			p.FetchAndUpdate(false)
-//			p.FetchAndUpdate(false)
-		} else {
-			log.Printf("Parsing feed config failed: %v", err)
-		}
+		p.Log().Infof("Parsed feed config and got %d feeds", len(cfg.FeedList))
+		p.restore(cfg.FeedList)
+		p.Config = cfg	
+		p.FetchAndUpdate(false)
 	} else {
-		log.Printf("Reading feed config failed: %v", err)
+		p.Log().Warnf("Reading feed config failed: %v", err)
 	}
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+	err = p.Bot.Scheduler().Add(&Job{
+		Name: feedPollJob,
+		Schedule: Every(time.Minute),
+		Jitter: feedPollJitter,
+		Run: func() {
 			p.FetchAndUpdate(true)
+		},
+	})
+	if err != nil {
+		p.Log().Errorf("Scheduling feed polling failed: %v", err)
+	}
+
+	sample := &Feed{Name: "Sample feed"}
+	p.Log().Debugf("Feed sample: %s", sample.Render(&gofeed.Item{
+		Link: "https://www.google.com",
+		Title: "Item title",
+		Description: "This is the item description.",
+	}))
+}
+
+func (p *PluginFeed) configFile() string {
+	return p.ConfigPath() + "/config.yml"
+}
+
+func (p *PluginFeed) loadConfig() (*PluginFeedConfig, error) {
+	b, err := ioutil.ReadFile(p.configFile())
+	if err != nil {
+		return nil, err
+	}
+	cfg := &PluginFeedConfig{}
+	if err = yaml.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i, feed := range cfg.FeedList {
+		if feed.URL == "" {
+			return nil, fmt.Errorf("Feed %d (%s) has no URL", i, feed.Name)
+		}
+		if seen[feed.URL] {
+			return nil, fmt.Errorf("Feed %s is listed twice", feed.URL)
 		}
-	}()
+		if err = tmpl.Check(feed.Template); err != nil {
+			return nil, fmt.Errorf("Feed %s: %v", feed.URL, err)
+		}
+		if feed.Cron != "" {
+			if feed.cron, err = ParseCron(feed.Cron); err != nil {
+				return nil, fmt.Errorf("Feed %s: %v", feed.URL, err)
+			}
+		}
+		seen[feed.URL] = true
+	}
+	return cfg, nil
+}
+
+func (p *PluginFeed) ConfigFiles() []string {
+	return []string{p.configFile()}
+}
+
+// Reload swaps in a freshly read feed list.
+func (p *PluginFeed) Reload() error {
+	commit, err := p.PrepareReload()
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
 
-	data := map[string]string{
-		"feed.name": "Sample feed",
-		"item.link": "https://www.google.com",
-		"item.title": "Item title",
-		"item.description": "This is the item description.",
+// PrepareReload reads and checks the feed list, returning the function
+// that swaps it in.
+func (p *PluginFeed) PrepareReload() (func(), error) {
+	cfg, err := p.loadConfig()
+	if os.IsNotExist(err) {
+		cfg, err = &PluginFeedConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		p.swapConfig(cfg)
+	}, nil
+}
+
+// swapConfig makes cfg the feed list, carrying over the polling state of
+// feeds that are still configured so no items are re-posted.
+func (p *PluginFeed) swapConfig(cfg *PluginFeedConfig) {
+	p.restore(cfg.FeedList)
+	p.m.Lock()
+	defer p.m.Unlock()
+	old := make(map[string]*Feed)
+	for _, feed := range p.Config.FeedList {
+		old[feed.URL] = feed
+	}
+	for _, feed := range cfg.FeedList {
+		prev, ok := old[feed.URL]
+		if !ok {
+			p.Log().Infof("Feed added: %s (%s)", feed.Name, feed.URL)
+			continue
+		}
+		delete(old, feed.URL)
+		feed.lastMaxID = prev.lastMaxID
+		feed.lastUpdated = prev.lastUpdated
+		feed.lastTime = prev.lastTime
+		if !reflect.DeepEqual(*feed, *prev) {
+			p.Log().Infof("Feed changed: %s (%s)", feed.Name, feed.URL)
+		}
+	}
+	p.hm.Lock()
+	for _, feed := range old {
+		p.Log().Infof("Feed removed: %s (%s)", feed.Name, feed.URL)
+		delete(p.status, feed.URL)
+		delete(p.muted, feed.URL)
+		p.dropState(feed)
 	}
-	log.Printf("Feed sample: %s", p.expand(feedDefaultFormat, data))
+	p.hm.Unlock()
+	p.Config = cfg
 }
 
 func (p *PluginFeed) FetchAndUpdate(broadcast bool) {
+	p.fetch(broadcast, false)
+}
+
+// fetch polls the feeds that are due, or all of them if force is set.
+// The feeds are fetched from a copy of the list so that commands needn't
+// wait for the network.
+func (p *PluginFeed) fetch(broadcast bool, force bool) {
+	p.pm.Lock()
+	defer p.pm.Unlock()
 	if p.fp == nil {
 		p.fp = gofeed.NewParser()
 	}
-	for _, feed := range p.Config.FeedList {
-		if time.Since(feed.lastTime) > time.Duration(feed.CheckMinutes) * time.Minute {
-			feed.lastTime = time.Now()
-			f, _ := p.fp.ParseURL(feed.URL)
-			log.Printf("Updating feed %s", f.Title)
-			updates := make([]*gofeed.Item, 0, 20)
-			for i:=len(f.Items)-1; i>=0; i-- {
-				item := f.Items[i]
-				if item.PublishedParsed != nil && item.PublishedParsed.After( feed.lastUpdated ) {
-					if feed.IgnoreTitlePrefix != "" && strings.HasPrefix(strings.ToLower(item.Title), strings.ToLower(feed.IgnoreTitlePrefix)) {
-						continue
-					} 
-					log.Printf("Update found: %s", item.Title)
-					feed.lastUpdated = *item.PublishedParsed
-					updates = append(updates, item)
-				}
+	for _, feed := range p.dueFeeds(p.Bot.Now(), force) {
+		f, err := p.fp.ParseURL(feed.URL)
+		p.recordFetch(feed, err)
+		if err != nil {
+			p.Log().Warnf("Fetching feed %s failed: %v", feed.Name, err)
+			continue
+		}
+		p.Log().Infof("Updating feed %s", f.Title)
+		send := broadcast || !feed.lastUpdated.IsZero()
+		seen := feed.lastUpdated
+		updates := make([]*gofeed.Item, 0, 20)
+		for i:=len(f.Items)-1; i>=0; i-- {
+			item := f.Items[i]
+			if item.PublishedParsed != nil && item.PublishedParsed.After( feed.lastUpdated ) {
+				if feed.IgnoreTitlePrefix != "" && strings.HasPrefix(strings.ToLower(item.Title), strings.ToLower(feed.IgnoreTitlePrefix)) {
+					continue
+				} 
+				p.Log().Debugf("Update found: %s", item.Title)
+				feed.lastUpdated = *item.PublishedParsed
+				updates = append(updates, item)
 			}
-			log.Printf("Got %d updates", len(updates))
-			if len(updates) > 0 && broadcast {
-				//updates = updates[len(updates)-1:]
-				for _, item := range updates {
-					for _, hook := range feed.Hooks {
-						log.Printf("POST %s", hook)
-
-						data := make(map[string]string)
-						data["feed.name"] = feed.Name
-						data["item.link"] = item.Link
-						data["item.title"] = item.Title
-						data["item.description"] = item.Description
-
-						text := feed.Template 
-						if text == "" {
-							text = feedDefaultFormat
-						}
-						
-						err := p.PostToIncoming( 
-							hook,
-							&BotResponse{
-								UserName: p.Bot.Config.Username,
-								IconURL: p.Bot.Expand(p.Bot.Config.IconURL),
-								Text: p.expand(text, data),		
+		}
+		p.Log().Debugf("Got %d updates", len(updates))
+		if feed.lastUpdated != seen {
+			p.advance(feed)
+			p.saveState(feed)
+		}
+		if len(updates) > 0 && send && p.isMuted(feed.URL) {
+			p.Log().Debugf("Not posting %d updates of muted feed %s", len(updates), feed.Name)
+			send = false
+		}
+		if len(updates) > 0 && send {
+			//updates = updates[len(updates)-1:]
+			for _, item := range updates {
+				for _, hook := range feed.Hooks {
+					p.Log().Debugf("Queueing POST to %s", hook)
+
+					err := p.Bot.Outbox().Enqueue( 
+						hook,
+						&BotResponse{
+							UserName: p.Bot.Config().Username,
+							IconURL: p.Bot.Expand(p.Bot.Config().IconURL),
+							Text: feed.Render(item),		
+							Attachments: []*BotResponseAttachment{
+								{Actions: []*AttachmentAction{p.muteButton(feed)}},
 							},
-						)
-						if err != nil {
-							log.Printf("POST failed with error: %v", err)
-						}
+						},
+						time.Time{},
+					)
+					if err != nil {
+						p.Log().Warnf("Queueing POST failed with error: %v", err)
 					}
 				}
 			}
@@ -128,8 +282,165 @@ func (p *PluginFeed) FetchAndUpdate(broadcast bool) {
 	}
 }
 
+// dueFeeds marks the feeds that are due at now, or all of them if force
+// is set, as checked and returns copies of them.
+func (p *PluginFeed) dueFeeds(now time.Time, force bool) []*Feed {
+	p.m.Lock()
+	defer p.m.Unlock()
+	out := make([]*Feed, 0)
+	for _, feed := range p.Config.FeedList {
+		if force || feed.due(now) {
+			feed.lastTime = now
+			c := *feed
+			out = append(out, &c)
+		}
+	}
+	return out
+}
+
+// advance records the newest item posted from a fetched copy of a feed
+// in the listed feed with its URL, which a reload may have replaced
+// during the fetch.
+func (p *PluginFeed) advance(fetched *Feed) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, feed := range p.Config.FeedList {
+		if feed.URL == fetched.URL && fetched.lastUpdated.After(feed.lastUpdated) {
+			feed.lastUpdated = fetched.lastUpdated
+		}
+	}
+}
+
+// feedState is what the plugin remembers about a feed across restarts,
+// so that items published while the bot was down are still posted.
+type feedState struct {
+	LastUpdated time.Time
+	Muted bool `yaml:",omitempty"`
+}
+
+const feedStateCollection = "feeds"
+
+func (p *PluginFeed) states() *Collection {
+	s, err := p.Store()
+	if err != nil {
+		p.Log().Warnf("Feed state unavailable: %v", err)
+		return nil
+	}
+	return s.Collection(feedStateCollection)
+}
+
+// restore loads the saved state of feeds, keyed by URL.
+func (p *PluginFeed) restore(feeds []*Feed) {
+	coll := p.states()
+	if coll == nil {
+		return
+	}
+	p.hm.Lock()
+	defer p.hm.Unlock()
+	if p.muted == nil {
+		p.muted = make(map[string]bool)
+	}
+	for _, feed := range feeds {
+		st := &feedState{}
+		if ok, err := coll.Get(feed.URL, st); ok && err == nil {
+			feed.lastUpdated = st.LastUpdated
+			p.muted[feed.URL] = st.Muted
+		}
+	}
+}
+
+// saveState records when the feed was last updated.  It holds p.hm so
+// that it can't interleave with setMuted.
+func (p *PluginFeed) saveState(feed *Feed) {
+	coll := p.states()
+	if coll == nil {
+		return
+	}
+	p.hm.Lock()
+	defer p.hm.Unlock()
+	if err := coll.Put(feed.URL, &feedState{feed.lastUpdated, p.muted[feed.URL]}); err != nil {
+		p.Log().Warnf("Saving state of feed %s failed: %v", feed.Name, err)
+	}
+}
+
+func (p *PluginFeed) isMuted(url string) bool {
+	p.hm.Lock()
+	defer p.hm.Unlock()
+	return p.muted[url]
+}
+
+// setMuted stops or resumes posting a feed's new items.  The feed is
+// still polled while muted, so unmuting doesn't post a backlog.
+func (p *PluginFeed) setMuted(url string, muted bool) error {
+	p.hm.Lock()
+	defer p.hm.Unlock()
+	if p.muted == nil {
+		p.muted = make(map[string]bool)
+	}
+	p.muted[url] = muted
+	coll := p.states()
+	if coll == nil {
+		return errors.New("Feed state unavailable")
+	}
+	st := &feedState{}
+	if _, err := coll.Get(url, st); err != nil {
+		return err
+	}
+	st.Muted = muted
+	return coll.Put(url, st)
+}
+
+func (p *PluginFeed) dropState(feed *Feed) {
+	if coll := p.states(); coll != nil {
+		coll.Delete(feed.URL)
+	}
+}
+
+func (p *PluginFeed) recordFetch(feed *Feed, err error) {
+	p.hm.Lock()
+	defer p.hm.Unlock()
+	if p.status == nil {
+		p.status = make(map[string]*feedStatus)
+	}
+	st, ok := p.status[feed.URL]
+	if !ok {
+		st = &feedStatus{}
+		p.status[feed.URL] = st
+	}
+	st.name = feed.Name
+	st.lastError = err
+	if err == nil {
+		st.lastSuccess = p.Bot.Now()
+	} else if p.Bot != nil {
+		p.Bot.metrics.feedFetchErrors.Inc(feed.Name)
+	}
+}
+
+// Health reports each feed's last success and error.  A feed that fails
+// to fetch is the feed's problem, not the bot's, so the plugin stays
+// healthy.
+func (p *PluginFeed) Health() *HealthStatus {
+	p.hm.Lock()
+	defer p.hm.Unlock()
+	h := &HealthStatus{
+		Healthy: true,
+		Details: make(map[string]interface{}),
+	}
+	for _, st := range p.status {
+		d := map[string]interface{}{}
+		if !st.lastSuccess.IsZero() {
+			d["last_success"] = st.lastSuccess
+		}
+		if st.lastError != nil {
+			d["last_error"] = st.lastError.Error()
+		}
+		h.Details[st.name] = d
+	}
+	return h
+}
+
 func (p *PluginFeed) Done() {
-	//
+	p.Bot.Scheduler().Remove(feedPollJob)
 }
 
 func (p *PluginFeed) Name() string {
@@ -137,36 +448,424 @@ func (p *PluginFeed) Name() string {
 }
 
 func (p *PluginFeed) Handle( b *Bot, req *BotRequest ) (*BotResponse, bool) {
+	return p.HandleCommands(p.Commands(), b, req)
+}
 
-	command, _ := req.CommandAndArgs(0)
+func (p *PluginFeed) Commands() []*Command {
+	return []*Command{
+		{
+			Name: "feed",
+			Usage: "List the feeds being watched.",
+			Run: p.list,
+			Subcommands: []*Command{
+				{
+					Name: "refresh",
+					Usage: "Check every feed for new items now.",
+					Role: RoleModerator,
+					Run: p.refresh,
+				},
+				{
+					Name: "add",
+					Usage: "Open a form to add a feed.",
+					Role: RoleModerator,
+					Run: p.add,
+				},
+				{
+					Name: "mute",
+					Usage: "Stop posting new items of a feed, given by name or URL.",
+					Role: RoleModerator,
+					Args: []Arg{
+						{Name: "feed", Rest: true},
+					},
+					Run: p.mute,
+				},
+				{
+					Name: "unmute",
+					Usage: "Resume posting new items of a muted feed.",
+					Role: RoleModerator,
+					Args: []Arg{
+						{Name: "feed", Rest: true},
+					},
+					Run: p.mute,
+				},
+			},
+		},
+	}
+}
 
-	if command != "feed" {
+func (p *PluginFeed) list( ctx *CommandContext ) *BotResponse {
+	if !p.authorized(ctx) {
+		return &BotResponse{
+			Text: ErrForbidden.Error(),
+			ResponseType: "ephemeral",
+		}
+	}
+	return p.listResponse()
+}
+
+// authorized applies the feed config's own allow list when it sets
+// MustBeAuthorized.  Bot moderators are always allowed.
+func (p *PluginFeed) authorized( ctx *CommandContext ) bool {
+	p.m.Lock()
+	cfg := p.Config
+	p.m.Unlock()
+	if !cfg.MustBeAuthorized || ctx.Bot.HasRole(ctx.Request.UserID, RoleModerator) {
+		return true
+	}
+	for _, id := range cfg.AuthUserID {
+		if id == ctx.Request.UserID {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PluginFeed) refresh( ctx *CommandContext ) *BotResponse {
+	return p.Defer(ctx.Request, func(d *Deferred) {
+		p.fetch(true, true)
+		d.Post(&BotResponse{
+			Text: "Feeds refreshed.",
+			ResponseType: "ephemeral",
+		})
+	})
+}
+
+func (p *PluginFeed) add( ctx *CommandContext ) *BotResponse {
+	if err := p.Bot.OpenDialog(p, ctx.Request, p.Dialog("add")); err != nil {
+		return &BotResponse{
+			Text: fmt.Sprintf("%v.  Add feeds to %s instead.", err, p.configFile()),
+			ResponseType: "ephemeral",
+		}
+	}
+	return &BotResponse{ResponseType: "ephemeral"}
+}
+
+// Dialog declares the form for adding a feed.
+func (p *PluginFeed) Dialog( id string ) *Dialog {
+	if id != "add" {
+		return nil
+	}
+	return &Dialog{
+		ID: "add",
+		Title: "Add a feed",
+		SubmitLabel: "Add",
+		Fields: []*DialogField{
+			{Name: "name", Label: "Name", MaxLength: 100},
+			{
+				Name: "url",
+				Label: "Feed URL",
+				Type: FieldURL,
+				Check: func(v interface{}) string {
+					if p.findFeed(v.(string)) != nil {
+						return "That feed is already watched."
+					}
+					return ""
+				},
+			},
+			{
+				Name: "hooks",
+				Label: "Incoming webhooks",
+				Type: FieldTextarea,
+				Help: "One incoming webhook URL per line.",
+			},
+			{Name: "checkminutes", Label: "Check every (minutes)", Type: FieldInt, Optional: true, Default: "15"},
+			{
+				Name: "template",
+				Label: "Template",
+				Type: FieldTextarea,
+				Optional: true,
+				Placeholder: feedDefaultFormat,
+				Check: func(v interface{}) string {
+					if err := tmpl.Check(v.(string)); err != nil {
+						return err.Error()
+					}
+					return ""
+				},
+			},
+			{Name: "includedescription", Label: "Include descriptions", Type: FieldBool},
+		},
+	}
+}
+
+// HandleDialog adds the submitted feed to the config file and reloads
+// it, which starts polling the feed.
+func (p *PluginFeed) HandleDialog( b *Bot, sub *DialogSubmission ) *DialogResponse {
+	if err := b.Authorize(sub.Request, "feed add", RoleModerator); err != nil {
+		return &DialogResponse{Error: err.Error()}
+	}
+	feed := &Feed{
+		Name: sub.String("name"),
+		URL: sub.String("url"),
+		CheckMinutes: sub.Int("checkminutes"),
+		IncludeDescription: sub.Bool("includedescription"),
+		Template: sub.String("template"),
+	}
+	for _, hook := range strings.Fields(sub.String("hooks")) {
+		if u, err := url.Parse(hook); err != nil || u.Host == "" {
+			return &DialogResponse{Errors: map[string]string{"hooks": fmt.Sprintf("%s is not a URL.", hook)}}
+		}
+		feed.Hooks = append(feed.Hooks, hook)
+	}
+	if len(feed.Hooks) == 0 {
+		return &DialogResponse{Errors: map[string]string{"hooks": "This field is required."}}
+	}
+	if err := p.addFeed(feed); err != nil {
+		p.Log().Warnf("Adding feed %s failed: %v", feed.URL, err)
+		return &DialogResponse{Error: err.Error()}
+	}
+	return &DialogResponse{Post: &BotResponse{
+		Text: fmt.Sprintf("Added feed %s.", feed.Name),
+		ResponseType: "ephemeral",
+	}}
+}
+
+// addFeed appends feed to the config file and reloads.
+func (p *PluginFeed) addFeed( feed *Feed ) error {
+	p.fm.Lock()
+	defer p.fm.Unlock()
+	cfg := &PluginFeedConfig{}
+	b, err := ioutil.ReadFile(p.configFile())
+	if err == nil {
+		err = yaml.Unmarshal(b, cfg)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range cfg.FeedList {
+		if f.URL == feed.URL {
+			return fmt.Errorf("Feed %s is already listed", feed.URL)
+		}
+	}
+	cfg.FeedList = append(cfg.FeedList, feed)
+	if b, err = yaml.Marshal(cfg); err != nil {
+		return err
+	}
+	if err = writeFileAtomic(p.configFile(), b, 0600); err != nil {
+		return err
+	}
+	return p.Reload()
+}
+
+// mute serves both "feed mute" and "feed unmute".
+func (p *PluginFeed) mute( ctx *CommandContext ) *BotResponse {
+	muted := ctx.Path[len(ctx.Path)-1] == "mute"
+	name := ctx.Arg("feed")
+	feeds := p.matchFeeds(name)
+	text := ""
+	if len(feeds) > 1 {
+		text = p.askWhich(ctx.Request, feeds, muted)
+	} else if len(feeds) == 1 {
+		text = p.muteText(feeds[0], name, muted)
+	} else {
+		text = p.muteText(nil, name, muted)
+	}
+	return &BotResponse{
+		Text: text,
+		ResponseType: "ephemeral",
+	}
+}
+
+// matchFeeds returns the feed called name, or failing that the feeds
+// whose names contain it.
+func (p *PluginFeed) matchFeeds( name string ) []*Feed {
+	if feed := p.findFeed(name); feed != nil {
+		return []*Feed{feed}
+	}
+	out := make([]*Feed, 0)
+	for _, feed := range p.feeds() {
+		if strings.Contains(strings.ToLower(feed.Name), strings.ToLower(name)) {
+			out = append(out, feed)
+		}
+	}
+	return out
+}
+
+// askWhich asks the user to pick one of feeds to mute or unmute.
+func (p *PluginFeed) askWhich( req *BotRequest, feeds []*Feed, muted bool ) string {
+	urls := make([]string, 0, len(feeds))
+	lines := []string{"Which feed did you mean?"}
+	for i, feed := range feeds {
+		urls = append(urls, feed.URL)
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, feed.Name))
+	}
+	err := p.Bot.Ask(p, req, "mute", map[string]interface{}{
+		"muted": muted,
+		"urls": urls,
+	}, 0)
+	if err != nil {
+		p.Log().Warnf("Asking which feed failed: %v", err)
+		return "Several feeds match, give the full name."
+	}
+	lines = append(lines, "Answer with a number or name, or cancel.")
+	return strings.Join(lines, "\n")
+}
+
+// HandleReply takes the answer to askWhich.  Anything else is left for
+// the other commands, with the question still open.
+func (p *PluginFeed) HandleReply( b *Bot, reply *Reply ) (*BotResponse, bool) {
+	if reply.ID != "mute" {
 		return nil, false
 	}
+	answer := commandText(reply.Request)
+	if strings.EqualFold(answer, "cancel") {
+		return &BotResponse{Text: "Cancelled.", ResponseType: "ephemeral"}, true
+	}
+	urls := reply.Strings("urls")
+	url := ""
+	if i, err := strconv.Atoi(answer); err == nil && i >= 1 && i <= len(urls) {
+		url = urls[i-1]
+	} else if feed := p.findFeed(answer); feed != nil {
+		for _, u := range urls {
+			if u == feed.URL {
+				url = u
+			}
+		}
+	}
+	if url == "" {
+		return nil, false
+	}
+	return &BotResponse{
+		Text: p.muteText(p.findFeed(url), url, reply.Bool("muted")),
+		ResponseType: "ephemeral",
+	}, true
+}
 
-	r := &BotResponse{
-		//Text: fmt.Sprintf("You roll %d", rand.Intn(6)+1),
+func (p *PluginFeed) muteText( feed *Feed, name string, muted bool ) string {
+	if feed == nil {
+		return fmt.Sprintf("No feed called %s.", name)
+	}
+	if err := p.setMuted(feed.URL, muted); err != nil {
+		p.Log().Warnf("Muting feed %s failed: %v", feed.Name, err)
+		return "Failed to change the feed."
+	}
+	if muted {
+		return fmt.Sprintf("Muted feed %s.  Unmute it with /feed unmute %s", feed.Name, feed.Name)
+	}
+	return fmt.Sprintf("Unmuted feed %s.", feed.Name)
+}
+
+// findFeed returns the feed with the given name or URL, ignoring case.
+func (p *PluginFeed) findFeed( name string ) *Feed {
+	for _, feed := range p.feeds() {
+		if strings.EqualFold(feed.Name, name) || feed.URL == name {
+			return feed
+		}
+	}
+	return nil
+}
+
+func (p *PluginFeed) muteButton( feed *Feed ) *AttachmentAction {
+	return p.Bot.Button(p, "", "mute", "Mute this feed", ActionContext{"url": feed.URL})
+}
+
+// HandleAction mutes the feed whose post had the button clicked, looked
+// up in the feed list so that buttons keep working across restarts.  It
+// needs the same role as "feed mute".
+func (p *PluginFeed) HandleAction( b *Bot, act *ActionRequest ) *ActionResponse {
+	if act.ID != "mute" {
+		return nil
+	}
+	if err := b.Authorize(act.Request, "feed mute", RoleModerator); err != nil {
+		return &ActionResponse{Ephemeral: err.Error()}
+	}
+	url := act.String("url")
+	feed := p.findFeed(url)
+	if feed == nil || feed.URL != url {
+		return &ActionResponse{Ephemeral: "That feed is no longer watched."}
 	}
-	r.AddAttachment(
-		&BotResponseAttachment{
-			Color: "#ff0000",	
-			Text:  "feed thing",
+	return &ActionResponse{Ephemeral: p.muteText(feed, url, true)}
+}
+
+func (p *PluginFeed) feeds() []*Feed {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.Config.FeedList
+}
+
+func (p *PluginFeed) listResponse() *BotResponse {
+	feeds := p.feeds()
+
+	a := &BotResponseAttachment{
+		Color: "#ff0000",	
+		Title: "Feeds",
+	}
+	if len(feeds) == 0 {
+		a.Text = "No feeds configured."
+	}
+	for _, feed := range feeds {
+		title := feed.Name
+		if p.isMuted(feed.URL) {
+			title += " (muted)"
+		}
+		a.Fields = append(a.Fields, &BotResponseAttachmentField{
+			Title: title,
+			Value: feed.URL,
+		})
+	}
+	r := &BotResponse{}
+	r.AddAttachment(a)
+	return r
+}
+
+// feedView is what templates see of a feed: plain fields, so that a
+// template can't call back into Render, and no hook URLs.
+type feedView struct {
+	Name string
+	URL string
+	CheckMinutes int
+	Cron string
+	IncludeDescription bool
+	IgnoreTitlePrefix string
+}
+
+// Render formats an item of the feed through the feed's template, which
+// sees the feed as ${feed.<field>} and the item as ${item.<field>}, e.g.
+// ${item.link} or {{range .item.Categories}}.
+func (feed *Feed) Render(item *gofeed.Item) string {
+	text := feed.Template 
+	if text == "" {
+		text = feedDefaultFormat
+	}
+	out, err := tmpl.Render(text, tmpl.Data{
+		"feed": feedView{
+			Name: feed.Name,
+			URL: feed.URL,
+			CheckMinutes: feed.CheckMinutes,
+			Cron: feed.Cron,
+			IncludeDescription: feed.IncludeDescription,
+			IgnoreTitlePrefix: feed.IgnoreTitlePrefix,
 		},
-	)
-	return r, true
+		"item": item,
+	})
+	if err != nil {
+		logging.Warnf("Rendering item of feed %s failed: %v", feed.Name, err)
+	}
+	return out
 }
 
-func (b *PluginFeed) expand( value string, data map[string]string ) string {
-	for reField.MatchString(value) {
-		m := reField.FindAllStringSubmatch(value, -1)
-		fullPattern := m[0][1]
-		name := m[0][2]
-		log.Printf("Got field match %s (%s)", fullPattern, name)
-		replacement := data[name]
-		log.Printf("Replace %s with %s", fullPattern, replacement)
-		value = strings.Replace(value, fullPattern, replacement, -1)
+// PreviewFeed fetches url and renders its newest items through template
+// without posting them anywhere.
+func PreviewFeed(url string, template string, max int) ([]string, error) {
+	if err := tmpl.Check(template); err != nil {
+		return nil, err
+	}
+	f, err := gofeed.NewParser().ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	feed := &Feed{
+		Name: f.Title,
+		URL: url,
+		Template: template,
+	}
+	out := make([]string, 0, max)
+	for _, item := range f.Items {
+		if len(out) >= max {
+			break
+		}
+		out = append(out, feed.Render(item))
 	}
-	return value
+	return out, nil
 }
 
 func NewPluginFeed(b *Bot) *PluginFeed {
@@ -0,0 +1,425 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "path/filepath"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+// rssServer serves an RSS feed whose items can be added while it runs.
+type rssServer struct {
+	m sync.Mutex
+	items []string
+	served int
+	*httptest.Server
+}
+
+func newRSSServer(t *testing.T) *rssServer {
+	s := &rssServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.m.Lock()
+		defer s.m.Unlock()
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Test</title>`)
+		// newest first, as feeds usually are
+		for i := len(s.items) - 1; i >= 0; i-- {
+			fmt.Fprint(w, s.items[i])
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+		s.served++
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *rssServer) add(title string, published time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.items = append(s.items, fmt.Sprintf(
+		`<item><title>%s</title><link>https://example.com/%d</link><pubDate>%s</pubDate></item>`,
+		title, len(s.items), published.Format(time.RFC1123Z)))
+}
+
+// fetches returns how many times the feed has been fetched.
+func (s *rssServer) fetches() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.served
+}
+
+func feedBot(t *testing.T, feed *rssServer, sink *enginetest.Sink, template string) *enginetest.Harness {
+	return feedBotWith(t, feed, sink, template, nil)
+}
+
+func feedBotWith(t *testing.T, feed *rssServer, sink *enginetest.Sink, template string, configure func(cfg *config.Config)) *enginetest.Harness {
+	cfg := fmt.Sprintf("feedlist:\n- name: Test\n  url: %s\n  checkminutes: 1\n  hooks: [%s]\n", feed.URL, sink.URL())
+	if template != "" {
+		cfg += fmt.Sprintf("  template: %q\n", template)
+	}
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Feed"}},
+		Files: map[string]string{"Feed/config.yml": cfg},
+		Config: configure,
+	})
+}
+
+// fetched steps the clock a minute at a time until the bot has fetched
+// feed again, and so has queued posts of everything added before.
+func fetched(t *testing.T, h *enginetest.Harness, feed *rssServer) {
+	t.Helper()
+	n := feed.fetches()
+	for i := 0; i < 10 && feed.fetches() == n; i++ {
+		h.Step(time.Minute)
+	}
+	if feed.fetches() == n {
+		t.Fatal("Feed was not fetched")
+	}
+}
+
+// poll fetches feed and waits until the sink has n posts.
+func poll(t *testing.T, h *enginetest.Harness, feed *rssServer, sink *enginetest.Sink, n int) {
+	t.Helper()
+	fetched(t, h, feed)
+	sink.Wait(t, n, 5*time.Second)
+}
+
+func TestFeedPostsNewItems(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	feed.add("Old news", enginetest.Epoch.Add(-time.Hour))
+	h := feedBot(t, feed, sink, "")
+
+	// items already in the feed at startup are not posted; they would
+	// be delivered before the fresh one and fail the golden file
+	fetched(t, h, feed)
+
+	feed.add("Fresh news", enginetest.Epoch.Add(time.Minute))
+	poll(t, h, feed, sink, 1)
+	posts := sink.Posts()
+	// the button's context holds the test server's address, which varies
+	for _, a := range posts[0].Attachments {
+		for _, act := range a.Actions {
+			if act.Integration == nil || act.Integration.Context["url"] != feed.URL {
+				t.Errorf("Action %s is not for the feed", act.Name)
+			}
+			act.Integration = nil
+		}
+	}
+	enginetest.AssertGolden(t, "feed_post", posts)
+}
+
+func TestFeedTemplate(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := feedBot(t, feed, sink, "${feed.name} says {{upper (field \"item.title\" .)}}")
+	feed.add("Shouting", enginetest.Epoch.Add(time.Minute))
+	poll(t, h, feed, sink, 1)
+	if got := sink.Posts()[0].Text; got != "Test says SHOUTING" {
+		t.Errorf("Got %q", got)
+	}
+}
+
+// Templates see the feed's fields only: calling back into rendering
+// would recurse until the process dies, and hooks are secret.
+func TestFeedTemplateSeesFields(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := feedBot(t, feed, sink, "[{{.feed.Render .item}}][${feed.hooks}]")
+	feed.add("Loop", enginetest.Epoch.Add(time.Minute))
+	poll(t, h, feed, sink, 1)
+	if got := sink.Posts()[0].Text; strings.Contains(got, sink.URL()) || strings.Contains(got, "Loop") {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestFeedRemembersAcrossRestart(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	feed.add("Before", enginetest.Epoch.Add(-time.Hour))
+	h := feedBot(t, feed, sink, "")
+	h.Clock.Advance(time.Hour)
+	h.Restart()
+
+	// published while the bot was down, so posted on the first poll
+	feed.add("While down", enginetest.Epoch.Add(30*time.Minute))
+	poll(t, h, feed, sink, 1)
+	posts := sink.Posts()
+	if len(posts) != 1 || !strings.HasSuffix(posts[0].Text, "/1") {
+		t.Errorf("Got posts %+v, want only the item published while down", posts)
+	}
+}
+
+func TestFeedMute(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := feedBotWith(t, feed, sink, "", func(cfg *config.Config) {
+		cfg.Auth.Moderators = []string{"mod-id"}
+	})
+	feed.add("First", enginetest.Epoch.Add(time.Minute))
+	poll(t, h, feed, sink, 1)
+	post := sink.Posts()[0]
+
+	if out := h.Click(post, "Mute this feed"); out.Ephemeral != engine.ErrForbidden.Error() {
+		t.Errorf("Muted by a user: %+v", out)
+	}
+	out := h.Click(post, "Mute this feed", enginetest.From("mod", "mod-id"))
+	if !strings.HasPrefix(out.Ephemeral, "Muted feed Test.") {
+		t.Errorf("Got %+v", out)
+	}
+
+	// posts are queued in order, so Second would come before Third
+	feed.add("Second", enginetest.Epoch.Add(2*time.Minute))
+	fetched(t, h, feed)
+	resp := h.Send(enginetest.Message("feed", enginetest.From("mod", "mod-id")))
+	if got := resp.Attachments[0].Fields[0].Title; got != "Test (muted)" {
+		t.Errorf("Listed as %q", got)
+	}
+
+	h.Send(enginetest.Message("feed unmute test", enginetest.From("mod", "mod-id")))
+	feed.add("Third", enginetest.Epoch.Add(10*time.Minute))
+	poll(t, h, feed, sink, 2)
+	posts := sink.Posts()
+	if len(posts) != 2 || !strings.HasSuffix(posts[1].Text, "/2") {
+		t.Errorf("Got posts %+v, want only the item after unmuting", posts)
+	}
+}
+
+func TestFeedMuteAfterRestart(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := feedBotWith(t, feed, sink, "", func(cfg *config.Config) {
+		cfg.Auth.Moderators = []string{"mod-id"}
+	})
+	feed.add("First", enginetest.Epoch.Add(time.Minute))
+	poll(t, h, feed, sink, 1)
+	post := sink.Posts()[0]
+
+	// the feed can't be reached after the restart, but is still listed
+	feed.Close()
+	h.Restart()
+	out := h.Click(post, "Mute this feed", enginetest.From("mod", "mod-id"))
+	if !strings.HasPrefix(out.Ephemeral, "Muted feed Test.") {
+		t.Errorf("Got %+v", out)
+	}
+
+	// and once it has been removed, the button says so
+	writeFile(t, filepath.Join(h.DataDir, "Feed", "config.yml"), []byte("feedlist: []\n"))
+	h.Restart()
+	out = h.Click(post, "Mute this feed", enginetest.From("mod", "mod-id"))
+	if out.Ephemeral != "That feed is no longer watched." {
+		t.Errorf("Got %+v", out)
+	}
+}
+
+func TestFeedCron(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Feed"}},
+		Files: map[string]string{"Feed/config.yml": fmt.Sprintf(
+			"feedlist:\n- name: Test\n  url: %s\n  cron: \"30 * * * *\"\n  hooks: [%s]\n", feed.URL, sink.URL())},
+	})
+	// fetched once at startup, at 12:00, then not until 12:30
+	start := feed.fetches()
+	for h.Clock.Now().Before(enginetest.Epoch.Add(29 * time.Minute)) {
+		h.Step(time.Minute)
+	}
+	if feed.fetches() != start {
+		t.Fatalf("Fetched %d times before 12:30", feed.fetches()-start)
+	}
+	fetched(t, h, feed)
+	if now := h.Clock.Now(); now.Before(enginetest.Epoch.Add(30 * time.Minute)) {
+		t.Errorf("Fetched at %v", now)
+	}
+}
+
+func TestFeedChannelRuleKeepsRole(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := feedBotWith(t, feed, sink, "", func(cfg *config.Config) {
+		cfg.Auth.Moderators = []string{"mod-id"}
+		cfg.Auth.Rules = []config.AuthRule{{Command: "feed", Channels: []string{enginetest.ChannelName}}}
+	})
+	if resp := h.Send(enginetest.Message("feed mute test")); resp == nil || resp.Text != engine.ErrForbidden.Error() {
+		t.Errorf("User muted a feed: %+v", resp)
+	}
+	if resp := h.Send(enginetest.Message("feed mute test", enginetest.From("mod", "mod-id"), enginetest.In("other", "other-id"))); resp == nil || resp.Text != engine.ErrWrongChannel.Error() {
+		t.Errorf("Muted outside the channel: %+v", resp)
+	}
+	if resp := h.Send(enginetest.Message("feed mute test", enginetest.From("mod", "mod-id"))); resp == nil || !strings.HasPrefix(resp.Text, "Muted feed Test.") {
+		t.Errorf("Moderator got %+v", resp)
+	}
+}
+
+// twoFeedBot watches two feeds whose names both contain "tech".
+func twoFeedBot(t *testing.T) *enginetest.Harness {
+	sink := enginetest.NewSink(t)
+	cfg := "feedlist:\n"
+	for _, name := range []string{"Tech News", "Tech Blog"} {
+		cfg += fmt.Sprintf("- name: %s\n  url: %s\n  checkminutes: 60\n  hooks: [%s]\n", name, newRSSServer(t).URL, sink.URL())
+	}
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Feed"}},
+		Files: map[string]string{"Feed/config.yml": cfg},
+		Config: func(cfg *config.Config) {
+			cfg.Auth.Moderators = []string{"mod-id"}
+		},
+	})
+}
+
+func TestFeedMuteAsksWhich(t *testing.T) {
+	h := twoFeedBot(t)
+	mod := enginetest.From("mod", "mod-id")
+	resp := h.Send(enginetest.Message("feed mute tech", mod))
+	enginetest.AssertGolden(t, "feed_mute_ask", resp.Text)
+
+	// someone else's message is not the answer
+	if resp := h.Send(enginetest.Message("2")); resp != nil && strings.HasPrefix(resp.Text, "Muted") {
+		t.Errorf("Answered by another user: %+v", resp)
+	}
+	h.Restart()
+	resp = h.Send(enginetest.Message("2", mod))
+	if resp == nil || !strings.HasPrefix(resp.Text, "Muted feed Tech Blog.") {
+		t.Fatalf("Got %+v", resp)
+	}
+	resp = h.Send(enginetest.Message("feed", mod))
+	if got := resp.Attachments[0].Fields[1].Title; got != "Tech Blog (muted)" {
+		t.Errorf("Listed as %q", got)
+	}
+
+	h.Send(enginetest.Message("feed unmute tech", mod))
+	resp = h.Send(enginetest.Message("tech news", mod))
+	if resp == nil || resp.Text != "Unmuted feed Tech News." {
+		t.Errorf("Got %+v", resp)
+	}
+}
+
+func TestFeedMuteQuestionExpires(t *testing.T) {
+	h := twoFeedBot(t)
+	mod := enginetest.From("mod", "mod-id")
+	h.Send(enginetest.Message("feed mute tech", mod))
+	h.Clock.Advance(6 * time.Minute)
+	if resp := h.Send(enginetest.Message("1", mod)); resp != nil && strings.HasPrefix(resp.Text, "Muted") {
+		t.Errorf("Answered after the question expired: %+v", resp)
+	}
+}
+
+func TestFeedAddDialog(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := feedBotWith(t, feed, sink, "", func(cfg *config.Config) {
+		cfg.Auth.Moderators = []string{"mod-id"}
+	})
+	mod := enginetest.From("mod", "mod-id")
+
+	if resp := h.Send(enginetest.Slash("/feed add")); resp.Text != engine.ErrForbidden.Error() {
+		t.Errorf("Opened for a user: %+v", resp)
+	}
+	h.Send(enginetest.Slash("/feed add", mod, enginetest.WithResponseURL(sink.URL())))
+	d := h.Dialogs()[0]
+
+	out := h.Submit(d, map[string]interface{}{
+		"name": "Dup",
+		"url": feed.URL,
+		"hooks": "not a url",
+		"checkminutes": "often",
+		"template": "{{",
+	}, mod)
+	enginetest.AssertGolden(t, "feed_dialog_errors", out)
+
+	other := newRSSServer(t)
+	out = h.Submit(d, map[string]interface{}{
+		"name": "Other",
+		"url": other.URL,
+		"hooks": "https://chat.example.com/hooks/a\nhttps://chat.example.com/hooks/b",
+		"checkminutes": float64(5),
+		"includedescription": true,
+	}, mod)
+	if out.Error != "" || len(out.Errors) != 0 {
+		t.Fatalf("Got %+v", out)
+	}
+	resp := h.Send(enginetest.Message("feed", mod))
+	if n := len(resp.Attachments[0].Fields); n != 2 {
+		t.Errorf("Listing %d feeds, want 2", n)
+	}
+	posts := sink.Wait(t, 1, 5*time.Second)
+	if posts[0].Text != "Added feed Other." {
+		t.Errorf("Got %q", posts[0].Text)
+	}
+}
+
+// A broken feed is reported but doesn't make the bot unready.
+func TestFeedHealth(t *testing.T) {
+	feed := newRSSServer(t)
+	sink := enginetest.NewSink(t)
+	h := feedBot(t, feed, sink, "")
+	feed.Close()
+	reported := false
+	for i := 0; i < 10 && !reported; i++ {
+		h.Step(time.Minute)
+		w := httptest.NewRecorder()
+		h.Bot.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Readyz answered %d: %s", w.Code, w.Body)
+		}
+		reported = strings.Contains(w.Body.String(), `"last_error"`)
+	}
+	if !reported {
+		t.Error("Feed error not reported")
+	}
+}
+
+// Commands answer while a poll waits on a slow feed.
+func TestFeedCommandsDuringPoll(t *testing.T) {
+	feed := newRSSServer(t)
+	var gm sync.Mutex
+	var gate chan bool
+	started := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gm.Lock()
+		g := gate
+		gm.Unlock()
+		if g != nil {
+			started <- true
+			<-g
+		}
+		feed.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+	sink := enginetest.NewSink(t)
+	h := feedBotWith(t, &rssServer{Server: slow}, sink, "", func(cfg *config.Config) {
+		cfg.Auth.Moderators = []string{"mod-id"}
+	})
+
+	gm.Lock()
+	gate = make(chan bool)
+	gm.Unlock()
+	polled := make(chan bool)
+	go func() {
+		// a minute after the last fetch isn't yet due
+		h.Step(2 * time.Minute)
+		close(polled)
+	}()
+	<-started
+	done := make(chan bool)
+	go func() {
+		mod := enginetest.From("mod", "mod-id")
+		h.Send(enginetest.Message("feed", mod))
+		h.Send(enginetest.Message("feed mute test", mod))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Commands waited for the poll")
+	}
+	close(gate)
+	<-polled
+	<-done
+}
@@ -2,50 +2,79 @@ package engine
 
 import "os"
 import "io/ioutil"
-import "log"
+import "bot/logging"
 import "time"
 import "fmt"
 import "math/rand"
-import "strconv"
 import "strings"
+import "sort"
+import "strconv"
 import "sync"
+import "path/filepath"
 import "gopkg.in/yaml.v2"
+import "bot/config"
 
 type Gem struct {
 	ID int
 	Creator string
+	CreatorID string `yaml:",omitempty"`
 	Date time.Time
 	Text string
 }
 
+// OwnedBy reports whether req comes from the gem's creator.  Gems saved
+// before user IDs were recorded belong to nobody, as user names can be
+// taken over; only moderators may remove them.
+func (g *Gem) OwnedBy(req *BotRequest) bool {
+	return g.CreatorID != "" && g.CreatorID == req.UserID
+}
+
+// GemDB holds a bot's gems by channel.  Each gem is a document in the
+// "gems" collection of the Gem plugin's store; Count and Gems are the
+// in-memory view, also used as the export format.
 type GemDB struct {
 	m sync.Mutex
-	fn string
+	store *Store
 	Count int
 	Gems map[string][]*Gem
 }
 
-func (db *GemDB) Add( channelid string, creator string, date time.Time, text string ) (int, error) {
+// gemDoc is how a gem is kept in the store.
+type gemDoc struct {
+	Channel string
+	Gem `yaml:",inline"`
+}
+
+const gemCollection = "gems"
+const gemsUnavailable = "Gems are unavailable, see the bot's log."
+
+func (db *GemDB) Add( channelid string, creator string, creatorid string, date time.Time, text string ) (int, error) {
 	db.m.Lock()
 	defer db.m.Unlock()
-	nextId := db.Count
-	db.Count++
 
 	g := &Gem{
-		ID: nextId,
+		ID: db.Count,
 		Creator: creator,
+		CreatorID: creatorid,
 		Date: date,
 		Text: text,
 	} 
-
-	list, ok := db.Gems[channelid]
-	if !ok {
-		list = make([]*Gem, 0)
+	if err := db.put(channelid, g); err != nil {
+		return 0, err
 	}
-	list = append(list, g)
-	db.Gems[channelid] = list
+	db.Gems[channelid] = append(db.Gems[channelid], g)
+
+	return g.ID, nil
+}
 
-	return nextId, db.Save()	
+// put stores g and moves Count past its ID.  The caller must hold db.m.
+func (db *GemDB) put( channelid string, g *Gem ) error {
+	coll := db.store.Collection(gemCollection)
+	if err := coll.Put(strconv.Itoa(g.ID), &gemDoc{channelid, *g}); err != nil {
+		return err
+	}
+	db.Count = g.ID + 1
+	return coll.SetSeq(db.Count)
 }
 
 func (db *GemDB) Get(channelid string, id int) *Gem {
@@ -122,56 +151,141 @@ func (db *GemDB) Remove(channelid string, id int) error {
 	if len(out) == len(list) {
 		return fmt.Errorf("No such gem %d in channel", id)
 	}	
+	if err := db.store.Collection(gemCollection).Delete(strconv.Itoa(id)); err != nil {
+		return err
+	}
 	db.Gems[channelid] = out
-	return db.Save()
+	return nil
 }
 
-func (db *GemDB) Save() error {
-	f, err := os.Create(db.fn)
-	if err != nil {
-		return err
+// load reads every gem document from the store.
+func (db *GemDB) load() error {
+	coll := db.store.Collection(gemCollection)
+	for _, id := range coll.IDs() {
+		doc := &gemDoc{}
+		if _, err := coll.Get(id, doc); err != nil {
+			return fmt.Errorf("Gem %s: %v", id, err)
+		}
+		g := doc.Gem
+		db.Gems[doc.Channel] = append(db.Gems[doc.Channel], &g)
 	}
-	defer f.Close()
-	y, err := yaml.Marshal(db)
-	if err != nil {
-		return err
+	for _, list := range db.Gems {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].ID < list[j].ID
+		})
 	}
-	f.Write(y)
-	log.Printf("Saved %s", db.fn)	
+	db.Count = coll.Seq()
+	logging.Debugf("Loaded %d gems from %s", len(coll.IDs()), db.store.Dir())
 	return nil
 }
 
-func (db *GemDB) Load() error {
-	b, err := ioutil.ReadFile(db.fn)
-	if err != nil {
-		return err
-	}
-	err = yaml.Unmarshal(b, db)
-	if err == nil {
-		log.Printf("Loaded %s", db.fn)
-	}
-	return err	
+// gemMigrations upgrade the Gem plugin's store.  Version 1 moves gems
+// out of the gems.yml file used before plugins had stores.
+var gemMigrations = []Migration{
+	func(s *Store) error {
+		fn := filepath.Join(s.Dir(), "gems.yml")
+		b, err := ioutil.ReadFile(fn)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		legacy := &GemDB{}
+		if err = yaml.Unmarshal(b, legacy); err != nil {
+			return err
+		}
+		coll := s.Collection(gemCollection)
+		for channelid, list := range legacy.Gems {
+			for _, g := range list {
+				if err = coll.Put(strconv.Itoa(g.ID), &gemDoc{channelid, *g}); err != nil {
+					return err
+				}
+			}
+		}
+		if err = coll.SetSeq(legacy.Count); err != nil {
+			return err
+		}
+		logging.Infof("Moved gems from %s into the plugin store", fn)
+		return os.Rename(fn, fn+".bak")
+	},
 }
 
-func NewGemDB(fn string) (*GemDB, error) {
+// OpenGemDB loads the gems kept in s, upgrading old data first.
+func OpenGemDB(s *Store) (*GemDB, error) {
 	d := &GemDB{
-		fn: fn,
+		store: s,
 		Gems: make(map[string][]*Gem),
 	}
-	err := d.Load()
-	return d, err
+	if err := s.Migrate(gemMigrations); err != nil {
+		return d, err
+	}
+	return d, d.load()
+}
+
+func init() {
+	RegisterPlugin("Gem", func(b *Bot) Plugin {
+		return NewPluginGem(b)
+	})
+}
+
+// OpenGemStore opens the Gem plugin's store of the bot with cfg, for
+// tools that work on gems while the bot is stopped.
+func OpenGemStore(cfg *config.Config) (*Store, error) {
+	return OpenStore(cfg.GetDataPath("Gem"), cfg.Storage)
+}
+
+// Import adds every gem in other to db, giving each a new ID.  It
+// returns the number of gems added.
+func (db *GemDB) Import(other *GemDB) (int, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	n := 0
+	for channelid, list := range other.Gems {
+		for _, g := range list {
+			ng := *g
+			ng.ID = db.Count
+			if err := db.put(channelid, &ng); err != nil {
+				return n, err
+			}
+			db.Gems[channelid] = append(db.Gems[channelid], &ng)
+			n++
+		}
+	}
+	return n, nil
 }
 
 type PluginGem struct {
 	PluginBase
 	db *GemDB
+	loadErr error
+}
+
+// Health is unhealthy if the gem database exists but could not be read.
+func (p *PluginGem) Health() *HealthStatus {
+	h := &HealthStatus{
+		Healthy: p.loadErr == nil,
+		Details: map[string]interface{}{
+			"loaded": p.loadErr == nil,
+		},
+	}
+	if p.loadErr != nil {
+		h.Details["error"] = p.loadErr.Error()
+	}
+	return h
 }
 
 func (p *PluginGem) Init() {
 	//
-	log.Printf("Init for plugin %s", p.Name()) 
-	datafile := p.ConfigPath() + "/gems.yml"
-	p.db, _ = NewGemDB(datafile)
+	p.Log().Infof("Init for plugin %s", p.Name()) 
+	s, err := p.Store()
+	if err == nil {
+		p.db, err = OpenGemDB(s)
+	}
+	if err != nil {
+		p.Log().Errorf("Loading gems failed: %v", err)
+		p.loadErr = err
+	}
 }
 
 func (p *PluginGem) Done() {
@@ -183,84 +297,48 @@ func (p *PluginGem) Name() string {
 }
 
 func (p *PluginGem) Handle( b *Bot, req *BotRequest ) (*BotResponse, bool) {
-
-	command, args := req.CommandAndArgs(2)
-
-	log.Printf("Command: %s, Args: %+v", command, args)
-	
-	if command != "gem" {
+	if p.loadErr != nil {
+		if name, _ := nextWord(commandText(req)); name == "gem" {
+			return gemResponse("Gems", gemsUnavailable), true
+		}
 		return nil, false
 	}
+	return p.HandleCommands(p.Commands(), b, req)
+}
 
-	channelid := req.ChannelID
-	text := ""
-	title := "Gems"
-
-	r := &BotResponse{
-	}
-
-	if len(args) == 0 {
-		// do gem
-		g := p.db.Random(req.ChannelID)
-		if g == nil {
-			text = "No gems for this channel.  Add one with /gem add ..."
-		} else {
-			title = fmt.Sprintf("#%d (posted by %s on %s)", g.ID, g.Creator, g.Date.Format("02/01/2006 15:04 MST"))
-			text = g.Text
-		}
-	} else {
-		switch args[0] {
-		case "help":
-			text = "```Help:\n" +
-				    "/gem add <text>    Adds a gem.\n" +
-				    "/gem remove <id>   Remove a gem if you own it.\n" +
-				    "/gem <id>          Show specific gem.\n" +
-				    "/gem               Show a random gem.```\n"
-		case "add":
-			t := ""
-			if len(args) > 1 {
-				t = args[1]
-			}
-			if t != "" {
-				id, err := p.db.Add(req.ChannelID, req.UserName, time.Now(), t)
-				if err == nil {
-					title = fmt.Sprintf("#%d (posted by %s on %s)", id, req.UserName, time.Now().Format("02/01/2006 15:04 MST"))
-					text = t
-				} else {
-					text = "Failed to add gem."
-				}
-			}
-		case "remove":
-			// maybe a number
-			i, _ := strconv.ParseInt(args[1], 10, 64)
-			g := p.db.Get(channelid, int(i))
-			if g == nil {
-				text = "No such gem.  Add one with /gem add ..."
-			} else {
-				if g.Creator != req.UserName {
-					text = "Not owner of gem."
-				} else {
-					err := p.db.Remove(channelid, int(i))
-					if err == nil {
-						text = "Removed gem."
-					} else {
-						text = fmt.Sprintf("Failed to remove gem: %v", err)
-					}
-				}
-			}
-		default: 
-			// maybe a number
-			i, _ := strconv.ParseInt(args[0], 10, 64)
-			g := p.db.Get(channelid, int(i))
-			if g == nil {
-				text = "No such gem.  Add one with /gem add ..."
-			} else {
-				title = fmt.Sprintf("#%d (posted by %s on %s)", g.ID, g.Creator, g.Date.Format("02/01/2006 15:04 MST"))
-				text = g.Text
-			}
-		}
+func (p *PluginGem) Commands() []*Command {
+	return []*Command{
+		{
+			Name: "gem",
+			Usage: "Show a random gem, or a specific one.",
+			Args: []Arg{
+				{Name: "id", Type: ArgInt, Optional: true},
+			},
+			Run: p.show,
+			Subcommands: []*Command{
+				{
+					Name: "add",
+					Usage: "Adds a gem, or opens a form for one without text.",
+					Args: []Arg{
+						{Name: "text", Optional: true, Rest: true},
+					},
+					Run: p.add,
+				},
+				{
+					Name: "remove",
+					Usage: "Remove a gem you own, or any gem as a moderator.",
+					Args: []Arg{
+						{Name: "id", Type: ArgInt},
+					},
+					Run: p.remove,
+				},
+			},
+		},
 	}
+}
 
+func gemResponse( title string, text string ) *BotResponse {
+	r := &BotResponse{}
 	r.AddAttachment(
 		&BotResponseAttachment{
 			Color: "#0000ff",	
@@ -268,7 +346,143 @@ func (p *PluginGem) Handle( b *Bot, req *BotRequest ) (*BotResponse, bool) {
 			Title: title,
 		},
 	)
-	return r, true
+	return r
+}
+
+func gemTitle( g *Gem ) string {
+	return fmt.Sprintf("#%d (posted by %s on %s)", g.ID, g.Creator, g.Date.Format("02/01/2006 15:04 MST"))
+}
+
+func (p *PluginGem) show( ctx *CommandContext ) *BotResponse {
+	var g *Gem
+	if ctx.Has("id") {
+		g = p.db.Get(ctx.Request.ChannelID, ctx.Int("id"))
+		if g == nil {
+			return gemResponse("Gems", "No such gem.  Add one with /gem add ...")
+		}
+	} else {
+		return p.random(ctx.Request.ChannelID)
+	}
+	return gemResponse(gemTitle(g), g.Text)
+}
+
+// random shows a random gem with a button for another.
+func (p *PluginGem) random( channelid string ) *BotResponse {
+	g := p.db.Random(channelid)
+	if g == nil {
+		return gemResponse("Gems", "No gems for this channel.  Add one with /gem add ...")
+	}
+	r := gemResponse(gemTitle(g), g.Text)
+	r.Attachments[0].Actions = []*AttachmentAction{
+		p.Bot.Button(p, channelid, "random", "Another", nil),
+	}
+	return r
+}
+
+func (p *PluginGem) add( ctx *CommandContext ) *BotResponse {
+	if !ctx.Has("text") {
+		if err := p.Bot.OpenDialog(p, ctx.Request, p.Dialog("add")); err != nil {
+			p.Log().Debugf("No form for gem add: %v", err)
+			return ctx.Command.usageError(ctx.Path, "Missing <text...>.")
+		}
+		return &BotResponse{ResponseType: "ephemeral"}
+	}
+	return p.addGem(ctx.Request, ctx.Arg("text"))
+}
+
+func (p *PluginGem) addGem( req *BotRequest, t string ) *BotResponse {
+	now := p.Bot.Now()
+	id, err := p.db.Add(req.ChannelID, req.UserName, req.UserID, now, t)
+	if err != nil {
+		return gemResponse("Gems", "Failed to add gem.")
+	}
+	return gemResponse(fmt.Sprintf("#%d (posted by %s on %s)", id, req.UserName, now.Format("02/01/2006 15:04 MST")), t)
+}
+
+// Dialog declares the form for adding a gem, which is easier than one
+// line for quotes spanning several.
+func (p *PluginGem) Dialog( id string ) *Dialog {
+	if id != "add" {
+		return nil
+	}
+	return &Dialog{
+		ID: "add",
+		Title: "Add a gem",
+		SubmitLabel: "Add",
+		Fields: []*DialogField{
+			{Name: "who", Label: "Who said it", Optional: true, MaxLength: 64},
+			{Name: "text", Label: "Gem", Type: FieldTextarea, MaxLength: 3000},
+		},
+	}
+}
+
+// HandleDialog adds the submitted gem, under the same rules as gem add.
+func (p *PluginGem) HandleDialog( b *Bot, sub *DialogSubmission ) *DialogResponse {
+	if p.loadErr != nil || p.db == nil {
+		return &DialogResponse{Error: gemsUnavailable}
+	}
+	if err := b.Authorize(sub.Request, "gem add", RoleUser); err != nil {
+		return &DialogResponse{Error: err.Error()}
+	}
+	t := sub.String("text")
+	if sub.Has("who") {
+		t = "<" + sub.String("who") + "> " + t
+	}
+	return &DialogResponse{Post: p.addGem(sub.Request, t)}
+}
+
+func (p *PluginGem) remove( ctx *CommandContext ) *BotResponse {
+	channelid := ctx.Request.ChannelID
+	id := ctx.Int("id")
+	g := p.db.Get(channelid, id)
+	if g == nil {
+		return gemResponse("Gems", "No such gem.  Add one with /gem add ...")
+	}
+	if !p.mayRemove(ctx.Request, g) {
+		return gemResponse("Gems", "Not owner of gem.")
+	}
+	r := gemResponse(fmt.Sprintf("Remove gem #%d?", id), g.Text)
+	confirm := p.Bot.Button(p, channelid, "remove", "Remove", ActionContext{"id": id})
+	confirm.Style = "danger"
+	r.Attachments[0].Actions = []*AttachmentAction{
+		confirm,
+		p.Bot.Button(p, channelid, "keep", "Keep", ActionContext{"id": id}),
+	}
+	return r
+}
+
+func (p *PluginGem) mayRemove( req *BotRequest, g *Gem ) bool {
+	return g.OwnedBy(req) || p.Bot.HasRole(req.UserID, RoleModerator)
+}
+
+// HandleAction answers the buttons on random gems and on the question
+// asked before removing one.  Removal checks ownership again, as the
+// click may come from someone other than who asked.
+func (p *PluginGem) HandleAction( b *Bot, act *ActionRequest ) *ActionResponse {
+	if p.loadErr != nil || p.db == nil {
+		return &ActionResponse{Ephemeral: gemsUnavailable}
+	}
+	channelid := act.Request.ChannelID
+	switch act.ID {
+	case "random":
+		return &ActionResponse{Update: p.random(channelid)}
+	case "keep":
+		return &ActionResponse{Update: gemResponse("Gems", fmt.Sprintf("Kept gem #%d.", act.Int("id")))}
+	case "remove":
+		id := act.Int("id")
+		g := p.db.Get(channelid, id)
+		if g == nil {
+			return &ActionResponse{Update: gemResponse("Gems", "No such gem.  Add one with /gem add ...")}
+		}
+		if !p.mayRemove(act.Request, g) {
+			return &ActionResponse{Ephemeral: "Not owner of gem."}
+		}
+		if err := p.db.Remove(channelid, id); err != nil {
+			return &ActionResponse{Ephemeral: fmt.Sprintf("Failed to remove gem: %v", err)}
+		}
+		return &ActionResponse{Update: gemResponse("Gems", fmt.Sprintf("Removed gem #%d.", id))}
+	}
+	return nil
 }
 
 func NewPluginGem(b *Bot) *PluginGem {
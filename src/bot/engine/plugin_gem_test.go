@@ -0,0 +1,243 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+func gemBot(t *testing.T) *enginetest.Harness {
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Gem"}},
+	})
+}
+
+func TestGemLifecycle(t *testing.T) {
+	h := gemBot(t)
+	steps := []struct {
+		name string
+		text string
+	}{
+		{"gem_empty", "gem"},
+		{"gem_add", "gem add <alice> the build is green"},
+		{"gem_show", "gem 0"},
+		{"gem_remove", "gem remove 0"},
+	}
+	var resp *engine.BotResponse
+	for _, s := range steps {
+		resp = h.Send(enginetest.Message(s.text))
+		if resp == nil {
+			t.Fatalf("%s: no response to %q", s.name, s.text)
+		}
+		enginetest.AssertGolden(t, s.name, resp)
+		h.Clock.Advance(time.Hour)
+	}
+	enginetest.AssertGolden(t, "gem_remove_confirmed", h.Click(resp, "Remove"))
+	enginetest.AssertGolden(t, "gem_missing", h.Send(enginetest.Message("gem 0")))
+}
+
+func TestGemRandomButton(t *testing.T) {
+	h := gemBot(t)
+	h.Send(enginetest.Message("gem add only one"))
+	resp := h.Send(enginetest.Message("gem"))
+	out := h.Click(resp, "Another")
+	if out.Update == nil || out.Update.Attachments[0].Text != "only one" {
+		t.Errorf("Got %+v, want the gem again", out.Update)
+	}
+}
+
+func TestGemKeep(t *testing.T) {
+	h := gemBot(t)
+	h.Send(enginetest.Message("gem add keeper"))
+	out := h.Click(h.Send(enginetest.Message("gem remove 0")), "Keep")
+	enginetest.AssertGolden(t, "gem_keep", out)
+	if resp := h.Send(enginetest.Message("gem 0")); resp.Attachments[0].Text != "keeper" {
+		t.Errorf("Gem gone after keep: %+v", resp.Attachments[0])
+	}
+}
+
+func TestGemSurvivesRestart(t *testing.T) {
+	h := gemBot(t)
+	h.Send(enginetest.Message("gem add first"))
+	h.Send(enginetest.Message("gem add second"))
+	h.Restart()
+	resp := h.Send(enginetest.Message("gem 1"))
+	if resp == nil {
+		t.Fatal("No response after restart")
+	}
+	enginetest.AssertGolden(t, "gem_restart", resp)
+	resp = h.Send(enginetest.Message("gem add third"))
+	enginetest.AssertGolden(t, "gem_restart_add", resp)
+}
+
+func TestGemRemoveOthers(t *testing.T) {
+	h := gemBot(t)
+	h.Send(enginetest.Message("gem add mine"))
+	resp := h.Send(enginetest.Message("gem remove 0", enginetest.From("mallory", "mallory-id")))
+	if resp == nil {
+		t.Fatal("No response to remove")
+	}
+	enginetest.AssertGolden(t, "gem_remove_forbidden", resp)
+
+	// the owner asks, someone else clicks
+	resp = h.Send(enginetest.Message("gem remove 0"))
+	out := h.Click(resp, "Remove", enginetest.From("mallory", "mallory-id"))
+	if out.Update != nil || out.Ephemeral != "Not owner of gem." {
+		t.Errorf("Got %+v, want refusal", out)
+	}
+}
+
+func TestGemForgedAction(t *testing.T) {
+	h := gemBot(t)
+	h.Send(enginetest.Message("gem add mine"))
+	resp := h.Send(enginetest.Message("gem remove 0"))
+	act := resp.Attachments[0].Actions[0]
+	act.Integration.Context["id"] = 1
+	if _, err := h.Bot.Click(act, enginetest.Message(""), ""); err != engine.ErrActionSignature {
+		t.Errorf("Got %v, want a signature error", err)
+	}
+}
+
+// A captured button only works where it was posted, and not forever.
+func TestGemActionBound(t *testing.T) {
+	h := gemBot(t)
+	h.Send(enginetest.Message("gem add mine"))
+	act := h.Send(enginetest.Message("gem")).Attachments[0].Actions[0]
+	if _, err := h.Bot.Click(act, enginetest.Message("", enginetest.In("other", "other-id")), ""); err != engine.ErrActionSignature {
+		t.Errorf("Got %v in another channel, want a signature error", err)
+	}
+	act.Integration.Context["_channel_id"] = "other-id"
+	if _, err := h.Bot.Click(act, enginetest.Message("", enginetest.In("other", "other-id")), ""); err != engine.ErrActionSignature {
+		t.Errorf("Got %v for a rebound action, want a signature error", err)
+	}
+
+	act = h.Send(enginetest.Message("gem")).Attachments[0].Actions[0]
+	h.Clock.Advance(8 * 24 * time.Hour)
+	out, err := h.Bot.Click(act, enginetest.Message(""), "")
+	if err != nil || out.Update != nil || out.Ephemeral != engine.ErrActionExpired.Error() {
+		t.Errorf("Got %+v, %v a week later", out, err)
+	}
+}
+
+func TestGemUnavailableAction(t *testing.T) {
+	good := gemBot(t)
+	good.Send(enginetest.Message("gem add mine"))
+	act := good.Send(enginetest.Message("gem remove 0")).Attachments[0].Actions[0]
+	// the plugin's data directory is a file, so its store can't open
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Gem"}},
+		Files: map[string]string{"Gem": "not a directory"},
+	})
+	out, err := h.Bot.Click(act, enginetest.Message(""), "")
+	if err != nil || out.Ephemeral != "Gems are unavailable, see the bot's log." {
+		t.Errorf("Got %+v, %v", out, err)
+	}
+}
+
+func TestGemAddDialog(t *testing.T) {
+	h := gemBot(t)
+	sink := enginetest.NewSink(t)
+
+	// a webhook message can't open a form
+	resp := h.Send(enginetest.Message("gem add"))
+	if resp == nil || !strings.HasPrefix(resp.Text, "Missing <text...>.") {
+		t.Fatalf("Got %+v, want usage", resp)
+	}
+
+	h.Send(enginetest.Slash("/gem add", enginetest.WithResponseURL(sink.URL())))
+	dialogs := h.Dialogs()
+	if len(dialogs) != 1 {
+		t.Fatalf("Got %d dialogs, want 1", len(dialogs))
+	}
+	d := dialogs[0]
+	enginetest.AssertGolden(t, "gem_dialog", d.Dialog.Elements)
+
+	out := h.Submit(d, map[string]interface{}{"who": "bob"})
+	if out.Errors["text"] != "This field is required." {
+		t.Errorf("Got %+v, want text required", out)
+	}
+	out = h.Submit(d, map[string]interface{}{"who": "bob", "text": "two\nlines"})
+	if len(out.Errors) != 0 {
+		t.Fatalf("Got errors %+v", out.Errors)
+	}
+	posts := sink.Wait(t, 1, 5*time.Second)
+	enginetest.AssertGolden(t, "gem_dialog_post", posts)
+
+	// the response_url travels in the state, so changing it must fail
+	state := strings.Replace(d.Dialog.State, sink.URL(), "http://evil.example.com/", 1)
+	if _, err := h.Bot.SubmitDialog(enginetest.Message(""), d.Dialog.CallbackID, state, nil); err != engine.ErrActionSignature {
+		t.Errorf("Got %v for a changed state, want a signature error", err)
+	}
+}
+
+// The rules are checked again on submission, as they may have changed
+// while the form was open.
+func TestGemDialogAuthorized(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Gem"}},
+		Config: func(cfg *config.Config) {
+			cfg.Filename = filepath.Join(t.TempDir(), "bot.yml")
+		},
+	})
+	sink := enginetest.NewSink(t)
+	h.Send(enginetest.Slash("/gem add", enginetest.WithResponseURL(sink.URL())))
+	d := h.Dialogs()[0]
+	writeConfig(t, h, func(cfg *config.Config) {
+		cfg.Auth.Rules = []config.AuthRule{{Command: "gem add", Role: "moderator"}}
+	})
+	if err := h.Bot.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	out := h.Submit(d, map[string]interface{}{"text": "sneaky"})
+	if out.Error != engine.ErrForbidden.Error() {
+		t.Errorf("Got %+v after gem add was restricted", out)
+	}
+	if resp := h.Send(enginetest.Message("gem 0")); resp != nil && strings.Contains(resp.Text, "sneaky") {
+		t.Errorf("Gem was added: %+v", resp)
+	}
+}
+
+// The state goes through the user's client, so it must not let them
+// submit as somebody else, elsewhere or long after.
+func TestGemDialogBound(t *testing.T) {
+	h := gemBot(t)
+	sink := enginetest.NewSink(t)
+	h.Send(enginetest.Slash("/gem add", enginetest.WithResponseURL(sink.URL())))
+	d := h.Dialogs()[0]
+	values := map[string]interface{}{"text": "sneaky"}
+	for _, req := range []*engine.BotRequest{
+		enginetest.Message("", enginetest.From("tester", "someone-else")),
+		enginetest.Message("", enginetest.In("other", "other-id")),
+	} {
+		if _, err := h.Bot.SubmitDialog(req, d.Dialog.CallbackID, d.Dialog.State, values); err != engine.ErrActionSignature {
+			t.Errorf("Got %v from %s in %s, want a signature error", err, req.UserID, req.ChannelID)
+		}
+	}
+
+	h.Clock.Advance(time.Hour)
+	if out := h.Submit(d, values); out.Error != engine.ErrDialogExpired.Error() {
+		t.Errorf("Got %+v an hour later", out)
+	}
+	if resp := h.Send(enginetest.Message("gem 0")); resp != nil && strings.Contains(resp.Text, "sneaky") {
+		t.Errorf("Gem was added: %+v", resp)
+	}
+}
+
+func TestGemOwnedBy(t *testing.T) {
+	req := enginetest.Message("gem remove 0")
+	for _, c := range []struct {
+		gem engine.Gem
+		owned bool
+	}{
+		{engine.Gem{Creator: enginetest.UserName, CreatorID: enginetest.UserID}, true},
+		{engine.Gem{Creator: enginetest.UserName, CreatorID: "someone-else"}, false},
+		// saved before IDs were recorded; the name may have changed hands
+		{engine.Gem{Creator: enginetest.UserName}, false},
+	} {
+		if got := c.gem.OwnedBy(req); got != c.owned {
+			t.Errorf("%+v owned: %v", c.gem, got)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package engine
+
+import "bot/config"
+import "fmt"
+import "sync"
+import "time"
+
+const limiterSweepSize = 1024
+
+type tokenBucket struct {
+	tokens float64
+	last time.Time
+}
+
+// limiter keeps one token bucket per key.  It is guarded by the
+// rateLimiter that owns it.
+type limiter struct {
+	rate float64
+	burst float64
+	buckets map[string]*tokenBucket
+}
+
+func newLimiter(rl config.RateLimit) *limiter {
+	if rl.PerMinute <= 0 {
+		return nil
+	}
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate: rl.PerMinute / 60,
+		burst: burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// bucket returns key's bucket, refilled up to now.
+func (l *limiter) bucket(key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= limiterSweepSize {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	return b
+}
+
+// wait returns how long until key has a token, 0 if it has one now.
+func (l *limiter) wait(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	b := l.bucket(key, now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// take uses one of key's tokens; wait must have found one.
+func (l *limiter) take(key string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.bucket(key, now).tokens--
+}
+
+// sweep forgets buckets that have refilled completely.
+func (l *limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens + now.Sub(b.last).Seconds() * l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// rateLimiter applies the user, channel and command limits of a bot.
+type rateLimiter struct {
+	m sync.Mutex
+	user *limiter
+	channel *limiter
+	command *limiter
+	exempt map[string]bool
+}
+
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	rl := &rateLimiter{
+		user: newLimiter(cfg.User),
+		channel: newLimiter(cfg.Channel),
+		command: newLimiter(cfg.Command),
+		exempt: make(map[string]bool),
+	}
+	for _, id := range cfg.Exempt {
+		rl.exempt[id] = true
+	}
+	return rl
+}
+
+// check returns the scope that is over its limit and how long to wait,
+// or "" if the request may proceed.  A token is only taken, from every
+// scope, once all of them have one, so that a refused request doesn't
+// count against the others.
+func (rl *rateLimiter) check(req *BotRequest, command string, now time.Time) (string, time.Duration) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if wait := rl.user.wait(req.UserID, now); wait > 0 {
+		return "user", wait
+	}
+	if wait := rl.channel.wait(req.ChannelID, now); wait > 0 {
+		return "channel", wait
+	}
+	if wait := rl.command.wait(command, now); wait > 0 {
+		return "command", wait
+	}
+	rl.user.take(req.UserID, now)
+	rl.channel.take(req.ChannelID, now)
+	rl.command.take(command, now)
+	return "", 0
+}
+
+// throttle answers with a polite ephemeral reply when req is over one of
+// the bot's rate limits, and returns nil otherwise.
+func (b *Bot) throttle(req *BotRequest) *BotResponse {
+	command, _ := nextWord(commandText(req))
+	if !b.knownCommand(command) {
+		return nil
+	}
+	b.m.RLock()
+	rl := b.limiter
+	b.m.RUnlock()
+	if rl.exempt[req.UserID] || b.HasRole(req.UserID, RoleAdmin) {
+		return nil
+	}
+	scope, wait := rl.check(req, command, b.Now())
+	if scope == "" {
+		return nil
+	}
+	b.metrics.rateLimited.Inc(scope)
+	b.Log().Infof("Rate limited %s by %s limit (user %s, channel %s)", command, scope, req.UserID, req.ChannelID)
+	secs := int(wait.Seconds()) + 1
+	return &BotResponse{
+		Text: fmt.Sprintf("Slow down a little, please.  Try again in %d seconds.", secs),
+		ResponseType: "ephemeral",
+	}
+}
+
+// knownCommand reports whether name is a command of the bot or a plugin.
+func (b *Bot) knownCommand(name string) bool {
+	if name == "help" {
+		return true
+	}
+	for _, cmd := range b.allCommands() {
+		if cmd.Name == name {
+			return true
+		}
+	}
+	return false
+}
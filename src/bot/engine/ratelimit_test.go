@@ -0,0 +1,32 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine/enginetest"
+import "strings"
+import "testing"
+
+// A request refused by one limit must not use up tokens of the others.
+func TestRateLimitRefusalIsFree(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+		Config: func(cfg *config.Config) {
+			cfg.RateLimit.User = config.RateLimit{PerMinute: 1, Burst: 3}
+			cfg.RateLimit.Channel = config.RateLimit{PerMinute: 1, Burst: 1}
+		},
+	})
+	roll := func(channel string) bool {
+		resp := h.Send(enginetest.Message("roll 1d1", enginetest.In(channel, channel+"-id")))
+		return resp != nil && !strings.HasPrefix(resp.Text, "Slow down")
+	}
+	if !roll("busy") {
+		t.Fatal("First roll was limited")
+	}
+	for i := 0; i < 3; i++ {
+		if roll("busy") {
+			t.Fatal("Channel limit not applied")
+		}
+	}
+	if !roll("quiet") {
+		t.Error("Refusals by the channel limit used up the user's tokens")
+	}
+}
@@ -0,0 +1,138 @@
+package engine
+
+import "bot/config"
+import "bot/logging"
+import "os"
+import "reflect"
+import "time"
+
+// Reloader is implemented by plugins that can re-read their own
+// configuration without losing runtime state.
+type Reloader interface {
+	// PrepareReload reads and validates the new configuration without
+	// applying it, and returns the function that swaps it in.  On error
+	// the previous configuration stays active.
+	PrepareReload() (func(), error)
+	// ConfigFiles lists the files that Reload reads, for change watching.
+	ConfigFiles() []string
+}
+
+// Reload re-reads the bot's YAML file and the configuration of every
+// plugin that supports it, starting and stopping plugins as the enabled
+// set changes.  Settings that are bound at startup (listen
+// address and data directory) are kept and logged as needing a restart.
+// Nothing is applied unless every configuration is valid.  Reloads run
+// one at a time, so that one can't apply config older than another's.
+func (b *Bot) Reload() error {
+	b.rm.Lock()
+	defer b.rm.Unlock()
+	old := b.Config()
+	cfg, err := config.Load(old.Filename)
+	if err != nil {
+		return err
+	}
+	if err = PrepareConfig(cfg); err != nil {
+		return err
+	}
+	if cfg.BaseURL != old.BaseURL || cfg.Port != old.Port {
+		b.Log().Warnf("Listen address change requires a restart")
+		cfg.BaseURL, cfg.Port = old.BaseURL, old.Port
+	}
+	if b.host != nil && cfg.Username != old.Username {
+		b.Log().Warnf("Username change moves the bot's path on the shared listener, which requires a restart")
+	}
+	if !reflect.DeepEqual(cfg.TLS, old.TLS) {
+		b.Log().Warnf("TLS settings change requires a restart; certificate files are reread on change")
+		cfg.TLS = old.TLS
+	}
+	if cfg.DataDir != old.DataDir {
+		b.Log().Warnf("Datadir change requires a restart")
+		cfg.DataDir = old.DataDir
+	}
+	if cfg.Storage != old.Storage {
+		b.Log().Warnf("Storage change requires a restart")
+		cfg.Storage = old.Storage
+	}
+	enabled := make(map[string]bool)
+	for _, pc := range pluginConfigs(cfg) {
+		enabled[pc.Name] = true
+	}
+	commits := make([]func(), 0)
+	for _, p := range b.activePlugins() {
+		r, ok := p.(Reloader)
+		if !ok || !enabled[p.Name()] {
+			continue
+		}
+		commit, err := r.PrepareReload()
+		if err != nil {
+			p.Log().Warnf("Reload failed, keeping the current config: %v", err)
+			return err
+		}
+		commits = append(commits, commit)
+	}
+
+	for _, d := range cfg.Diff(old) {
+		b.Log().Infof("Config %s", d)
+	}
+	registerSecrets(cfg)
+	b.m.Lock()
+	b.cfg = cfg
+	b.log = logging.With("bot", cfg.Username)
+	if !reflect.DeepEqual(cfg.RateLimit, old.RateLimit) {
+		b.limiter = newRateLimiter(cfg.RateLimit)
+	}
+	if !reflect.DeepEqual(cfg.Triggers, old.Triggers) {
+		b.triggers = newTriggers(cfg.Triggers)
+	}
+	b.m.Unlock()
+	b.applyPlugins(cfg)
+	for _, commit := range commits {
+		commit()
+	}
+	return nil
+}
+
+// watch polls the bot and plugin config files and reloads when any of
+// them is modified.
+func (b *Bot) watch(interval time.Duration) {
+	seen := b.configTimes()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			now := b.configTimes()
+			changed := len(now) != len(seen)
+			for fn, mt := range now {
+				if !seen[fn].Equal(mt) {
+					b.Log().Infof("Config file %s changed", fn)
+					changed = true
+				}
+			}
+			seen = now
+			if changed {
+				if err := b.Reload(); err != nil {
+					b.Log().Warnf("Reload failed: %v", err)
+				}
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+func (b *Bot) configTimes() map[string]time.Time {
+	files := []string{b.Config().Filename}
+	for _, p := range b.activePlugins() {
+		if r, ok := p.(Reloader); ok {
+			files = append(files, r.ConfigFiles()...)
+		}
+	}
+	out := make(map[string]time.Time)
+	for _, fn := range files {
+		if fi, err := os.Stat(fn); err == nil {
+			out[fn] = fi.ModTime()
+		}
+	}
+	return out
+}
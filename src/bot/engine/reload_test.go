@@ -0,0 +1,135 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine/enginetest"
+import "bot/logging"
+import "gopkg.in/yaml.v2"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "testing"
+
+// reloadBot runs the Feed plugin from a bot config file, which
+// writeConfig replaces.
+func reloadBot(t *testing.T) *enginetest.Harness {
+	fn := filepath.Join(t.TempDir(), "bot.yml")
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Feed"}},
+		Files: map[string]string{"Feed/config.yml": "feedlist: []\n"},
+		Config: func(cfg *config.Config) {
+			cfg.Filename = fn
+		},
+	})
+}
+
+func writeConfig(t *testing.T, h *enginetest.Harness, change func(cfg *config.Config)) {
+	t.Helper()
+	cfg := *h.Bot.Config()
+	change(&cfg)
+	bb, err := yaml.Marshal(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, cfg.Filename, bb)
+}
+
+func TestReloadKeepsConfigOnPluginError(t *testing.T) {
+	h := reloadBot(t)
+	writeConfig(t, h, func(cfg *config.Config) {
+		cfg.IconURL = "http://example.com/new.png"
+		cfg.Plugins = append(cfg.Plugins, config.PluginConfig{Name: "Dice"})
+	})
+	feeds := filepath.Join(h.DataDir, "Feed", "config.yml")
+	writeFile(t, feeds, []byte("feedlist:\n- name: Bad\n  url: http://example.com/\n  cron: never\n"))
+	if err := h.Bot.Reload(); err == nil {
+		t.Fatal("Reload accepted a bad feed list")
+	}
+	if got := h.Bot.Config().IconURL; got != "" {
+		t.Errorf("Icon changed to %q", got)
+	}
+	if len(h.Bot.Plugins) != 1 {
+		t.Errorf("Running %d plugins", len(h.Bot.Plugins))
+	}
+
+	writeFile(t, feeds, []byte("feedlist:\n- name: Good\n  url: http://example.com/\n"))
+	if err := h.Bot.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Bot.Config().IconURL; got != "http://example.com/new.png" {
+		t.Errorf("Icon is %q", got)
+	}
+	if len(h.Bot.Plugins) != 2 {
+		t.Errorf("Running %d plugins", len(h.Bot.Plugins))
+	}
+}
+
+func TestDiffHidesSecrets(t *testing.T) {
+	old := &config.Config{
+		Token: "old-token",
+		Plugins: []config.PluginConfig{
+			{Name: "Exec", Settings: map[string]interface{}{"key": "old-secret"}},
+			{Name: "Gem"},
+		},
+		Auth: config.AuthConfig{Admins: []string{"old-admin-id"}},
+	}
+	cur := &config.Config{
+		Token: "new-token",
+		IconURL: "http://example.com/icon.png",
+		Plugins: []config.PluginConfig{
+			{Name: "Exec", Settings: map[string]interface{}{"key": "new-secret"}},
+			{Name: "Dice"},
+		},
+		Auth: config.AuthConfig{
+			Admins: []string{"new-admin-id"},
+			Rules: []config.AuthRule{{Command: "gem add", Role: "moderator"}},
+		},
+	}
+	diff := strings.Join(cur.Diff(old), "\n")
+	for _, want := range []string{
+		"iconurl:  -> http://example.com/icon.png",
+		"token changed",
+		"plugins: Exec settings changed",
+		"plugins: Dice added",
+		"plugins: Gem removed",
+		"auth: admins changed, 1 -> 1",
+		"auth: rules [] -> [{gem add moderator []}]",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("Diff lacks %q:\n%s", want, diff)
+		}
+	}
+	for _, secret := range []string{"secret", "-token", "-id"} {
+		if strings.Contains(diff, secret) {
+			t.Errorf("Diff shows %q:\n%s", secret, diff)
+		}
+	}
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	h := reloadBot(t)
+	writeConfig(t, h, func(cfg *config.Config) {
+		cfg.Plugins = append(cfg.Plugins, config.PluginConfig{Name: "Dice"})
+	})
+	var buf strings.Builder
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(os.Stderr)
+	var wg sync.WaitGroup
+	start := make(chan bool)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			h.Bot.Reload()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := strings.Count(buf.String(), "Plugin Dice enabled"); n != 1 {
+		t.Errorf("Dice started %d times", n)
+	}
+	if len(h.Bot.Plugins) != 2 {
+		t.Errorf("Running %d plugins", len(h.Bot.Plugins))
+	}
+}
@@ -1,20 +1,109 @@
 package engine
 
 import "strings"
+import "encoding/json"
 import "bot/config"
+import "bot/logging"
+import "net/http"
+import "sync"
+
+// RequestSource records which Mattermost integration delivered a request.
+type RequestSource int
+
+const (
+	SourceUnknown RequestSource = iota
+	SourceWebhook
+	SourceSlash
+)
+
+func (s RequestSource) String() string {
+	switch s {
+	case SourceWebhook:
+		return "webhook"
+	case SourceSlash:
+		return "slash"
+	}
+	return "unknown"
+}
+
+// Platform is the chat system a request came from, which decides how
+// the answer is encoded.
+type Platform int
+
+const (
+	PlatformMattermost Platform = iota
+	PlatformSlack
+)
+
+func (p Platform) String() string {
+	if p == PlatformSlack {
+		return "slack"
+	}
+	return "mattermost"
+}
+
+// StringList accepts either a JSON array of strings or a single
+// comma separated string, as Mattermost uses both depending on version.
+type StringList []string
+
+func (sl *StringList) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*sl = StringList(list)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*sl = splitList(s)
+	return nil
+}
+
+func splitList(s string) StringList {
+	out := make(StringList, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
 
 type BotRequest struct {
 	ChannelID string `json:"channel_id"`
 	ChannelName string `json:"channel_name"`
+	ChannelMentions StringList `json:"channel_mentions,omitempty"`
+	ChannelMentionIDs StringList `json:"channel_mentions_ids,omitempty"`
+	Command string `json:"command,omitempty"`
+	FileIDs StringList `json:"file_ids,omitempty"`
+	ResponseURL string `json:"response_url,omitempty"`
 	TeamDomain string `json:"team_domain"`
 	TeamID string `json:"team_id"`
 	PostID string `json:"post_id"`
 	Text string `json:"text"`
 	Timestamp int64 `json:"timestamp"`
 	Token string `json:"token"`
+	TriggerID string `json:"trigger_id,omitempty"`
 	TriggerWord string `json:"trigger_word"`
+	UserEmail string `json:"user_email,omitempty"`
 	UserID string `json:"user_id"`
+	UserMentions StringList `json:"user_mentions,omitempty"`
+	UserMentionIDs StringList `json:"user_mentions_ids,omitempty"`
 	UserName string `json:"user_name"`
+	Source RequestSource `json:"-"`
+	Platform Platform `json:"-"`
+}
+
+// IsSlash reports whether the request arrived through a slash command.
+func (br *BotRequest) IsSlash() bool {
+	return br.Source == SourceSlash
+}
+
+// IsWebhook reports whether the request arrived through an outgoing webhook.
+func (br *BotRequest) IsWebhook() bool {
+	return br.Source == SourceWebhook
 }
 
 func (br *BotRequest) CommandAndArgs(maxArgs int) (string, []string) {
@@ -24,7 +113,11 @@ func (br *BotRequest) CommandAndArgs(maxArgs int) (string, []string) {
 	}
 	s = strings.Trim(s, " \t\n\r")
 	if maxArgs == 0 {
-		return strings.Fields(s)[0], []string(nil)
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			return "", nil
+		}
+		return fields[0], []string(nil)
 	}	
 	fields := strings.SplitN( s, " ", maxArgs+1 )
 	return fields[0], fields[1:]	
@@ -36,6 +129,9 @@ type BotResponse struct {
 	IconURL string `json:"icon_url,omitempty"`
 	ResponseType string `json:"response_type"`
 	Attachments []*BotResponseAttachment
+	// ReplaceOriginal makes a Slack response_url post replace the message
+	// it was made for rather than add one.
+	ReplaceOriginal bool `json:"-" yaml:",omitempty"`
 }
 
 func (br *BotResponse) AddAttachment(a *BotResponseAttachment) {
@@ -57,6 +153,7 @@ type BotResponseAttachment struct {
 	Title string `json:"title,omitempty"`
 	TitleLink string `json:"title_link,omitempty"`
 	Fields []*BotResponseAttachmentField `json:"fields,omitempty"`
+	Actions []*AttachmentAction `json:"actions,omitempty"`
 }
 
 type BotResponseAttachmentField struct {
@@ -66,6 +163,28 @@ type BotResponseAttachmentField struct {
 } 
 
 type Bot struct {
-	Config *config.Config
+	m sync.RWMutex
+	// rm serialises reloads
+	rm sync.Mutex
+	cfg *config.Config
+	log *logging.Logger
+	metrics *botMetrics
+	outbox *Outbox
+	scheduler *Scheduler
+	limiter *rateLimiter
+	triggers []*trigger
+	clock Clock
+	// quiet bots leave their outbox and scheduler stopped.
+	quiet bool
+	lock *DataDirLock
 	Plugins []Plugin
+	quit chan struct{}
+	stopOnce sync.Once
+	server *http.Server
+	redirect *http.Server
+	// host and prefix are set when the bot is served by a shared Host.
+	host *Host
+	prefix string
+	errc chan error
+	work sync.WaitGroup
 }
@@ -0,0 +1,167 @@
+package engine
+
+import "fmt"
+import "strconv"
+import "strings"
+import "time"
+
+// Schedule decides when a job runs next.  Next returns the zero time
+// when the job should not run again.
+type Schedule interface {
+	Next(after time.Time) time.Time
+	String() string
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+// Every runs a job at a fixed interval.
+func Every(interval time.Duration) Schedule {
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return &everySchedule{interval}
+}
+
+func (s *everySchedule) Next(after time.Time) time.Time {
+	return after.Add(s.interval)
+}
+
+func (s *everySchedule) String() string {
+	return "every " + s.interval.String()
+}
+
+type onceSchedule struct {
+	at time.Time
+}
+
+// Once runs a job a single time.
+func Once(at time.Time) Schedule {
+	return &onceSchedule{at}
+}
+
+func (s *onceSchedule) Next(after time.Time) time.Time {
+	if s.at.After(after) {
+		return s.at
+	}
+	return time.Time{}
+}
+
+func (s *onceSchedule) String() string {
+	return "once at " + s.at.Format("02/01/2006 15:04 MST")
+}
+
+// cronSchedule matches the classic five cron fields against local time.
+type cronSchedule struct {
+	expr string
+	minute, hour, dom, month, dow []bool
+	domStar, dowStar bool
+}
+
+const cronSearchYears = 5
+
+// ParseCron parses a five field cron expression: minute, hour, day of
+// month, month and day of week (0 is Sunday).  Fields accept *, lists,
+// ranges and steps such as "*/15" or "1-5".
+func ParseCron(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression %q needs 5 fields", expr)
+	}
+	s := &cronSchedule{
+		expr: expr,
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	var err error
+	if s.minute, err = cronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = cronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = cronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = cronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = cronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 7 is also Sunday
+	s.dow[0] = s.dow[0] || s.dow[7]
+	return s, nil
+}
+
+func cronField(field string, min int, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("Bad step in cron field %q", field)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("Bad cron field %q", field)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("Bad cron field %q", field)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("Cron field %q out of range %d-%d", field, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom[t.Day()]
+	dow := s.dow[int(t.Weekday())]
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !s.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) String() string {
+	return "cron " + s.expr
+}
@@ -0,0 +1,85 @@
+package engine_test
+
+import "bot/engine"
+import "testing"
+import "time"
+
+func TestParseCron(t *testing.T) {
+	// a Wednesday
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		expr string
+		want []string
+	}{
+		{"* * * * *", []string{"01/01 12:01", "01/01 12:02"}},
+		{"*/15 * * * *", []string{"01/01 12:15", "01/01 12:30", "01/01 12:45"}},
+		{"5,10 9 * * *", []string{"02/01 09:05", "02/01 09:10", "03/01 09:05"}},
+		{"0 8-10 * * *", []string{"02/01 08:00", "02/01 09:00", "02/01 10:00", "03/01 08:00"}},
+		{"30 12-18/3 * * *", []string{"01/01 12:30", "01/01 15:30", "01/01 18:30", "02/01 12:30"}},
+		{"0 9 * * 1-5", []string{"02/01 09:00", "03/01 09:00", "06/01 09:00"}},
+		{"0 0 * * 7", []string{"05/01 00:00", "12/01 00:00"}},
+		{"0 0 1 * *", []string{"01/02 00:00", "01/03 00:00"}},
+		{"0 0 29 2 *", []string{"29/02 00:00"}},
+		// day of month and day of week both restricted: either matches
+		{"0 0 13 * 5", []string{"03/01 00:00", "10/01 00:00", "13/01 00:00", "17/01 00:00"}},
+		// one restricted and the other *: only the restricted one counts
+		{"0 0 13 * *", []string{"13/01 00:00", "13/02 00:00"}},
+	} {
+		s, err := engine.ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("%q: %v", c.expr, err)
+			continue
+		}
+		at := start
+		for _, want := range c.want {
+			at = s.Next(at)
+			if got := at.Format("02/01 15:04"); got != want {
+				t.Errorf("%q: got %s, want %s", c.expr, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseCronRejects(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := engine.ParseCron(expr); err == nil {
+			t.Errorf("Accepted %q", expr)
+		}
+	}
+}
+
+func TestParseCronNever(t *testing.T) {
+	s, err := engine.ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("February 31st came on %v", next)
+	}
+}
+
+func TestOnce(t *testing.T) {
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := engine.Once(at)
+	if got := s.Next(at.Add(-time.Minute)); !got.Equal(at) {
+		t.Errorf("Next before is %v", got)
+	}
+	if got := s.Next(at); !got.IsZero() {
+		t.Errorf("Next after is %v", got)
+	}
+}
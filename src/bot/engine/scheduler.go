@@ -0,0 +1,308 @@
+package engine
+
+import "bot/config"
+import "fmt"
+import "io/ioutil"
+import "math/rand"
+import "os"
+import "sort"
+import "sync"
+import "time"
+import "gopkg.in/yaml.v2"
+
+// Job is work that a plugin wants run on a schedule.  Names should be
+// prefixed with the plugin name, e.g. "Feed/poll".  Jitter delays each
+// run by a random amount up to its value so that jobs sharing a schedule
+// don't all fire at once.
+type Job struct {
+	Name string
+	Schedule Schedule
+	Jitter time.Duration
+	Run func()
+}
+
+// JobInfo describes a scheduled job for the jobs command.
+type JobInfo struct {
+	Name string
+	Schedule string
+	Next time.Time
+	Last time.Time
+	Running bool
+}
+
+type scheduledJob struct {
+	job *Job
+	next time.Time
+	last time.Time
+	running bool
+}
+
+// scheduleEntry is the persisted state of one job, so that a restart
+// doesn't postpone (or repeat) daily jobs.
+type scheduleEntry struct {
+	Schedule string
+	Next time.Time
+	Last time.Time
+}
+
+// Scheduler runs the jobs of all of a bot's plugins from one goroutine.
+// A job never overlaps with itself: a run that is due while the previous
+// one is still going is skipped.
+type Scheduler struct {
+	m sync.Mutex
+	fn string
+	jobs map[string]*scheduledJob
+	saved map[string]scheduleEntry
+	bot *Bot
+	wake chan struct{}
+	// active counts running jobs; idle is signalled when it drops to 0.
+	active int
+	idle *sync.Cond
+	quit chan struct{}
+	done chan struct{}
+	running sync.WaitGroup
+}
+
+// SchedulePath returns the file holding the next run times of the bot
+// with cfg.
+func SchedulePath(cfg *config.Config) string {
+	return cfg.GetDataPath("schedule.yml")
+}
+
+func newScheduler(cfg *config.Config, b *Bot) *Scheduler {
+	s := &Scheduler{
+		fn: SchedulePath(cfg),
+		jobs: make(map[string]*scheduledJob),
+		saved: make(map[string]scheduleEntry),
+		bot: b,
+		wake: make(chan struct{}, 1),
+	}
+	s.idle = sync.NewCond(&s.m)
+	return s
+}
+
+func (s *Scheduler) load() error {
+	b, err := ioutil.ReadFile(s.fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, &s.saved)
+}
+
+// save writes the schedule atomically.  The caller must hold s.m.
+func (s *Scheduler) save() {
+	for name, j := range s.jobs {
+		s.saved[name] = scheduleEntry{
+			Schedule: j.job.Schedule.String(),
+			Next: j.next,
+			Last: j.last,
+		}
+	}
+	y, err := yaml.Marshal(s.saved)
+	if err == nil {
+		err = writeFileAtomic(s.fn, y, 0600)
+	}
+	if err != nil {
+		s.bot.Log().Errorf("Saving schedule failed: %v", err)
+	}
+}
+
+// Start begins running jobs in the background.
+func (s *Scheduler) Start() {
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run()
+}
+
+// Stop cancels all pending runs and waits for running jobs to return.
+func (s *Scheduler) Stop() {
+	if s.quit == nil {
+		return
+	}
+	close(s.quit)
+	<-s.done
+	s.quit = nil
+	s.running.Wait()
+}
+
+// Add schedules job, replacing any job of the same name.  A job whose
+// schedule is unchanged since the last run of the bot resumes from its
+// saved next run time, running once straight away if that was missed.
+func (s *Scheduler) Add(job *Job) error {
+	if job.Name == "" || job.Schedule == nil || job.Run == nil {
+		return fmt.Errorf("Job needs a name, schedule and function")
+	}
+	now := s.bot.Now()
+	s.m.Lock()
+	j := &scheduledJob{job: job}
+	if e, ok := s.saved[job.Name]; ok && e.Schedule == job.Schedule.String() {
+		j.next = e.Next
+		j.last = e.Last
+	} else {
+		j.next = s.nextRun(job, now)
+	}
+	if j.next.IsZero() {
+		s.m.Unlock()
+		return fmt.Errorf("Job %s would never run", job.Name)
+	}
+	s.jobs[job.Name] = j
+	s.save()
+	s.m.Unlock()
+	s.signal()
+	return nil
+}
+
+// Remove cancels the job with name.  A run in progress is not
+// interrupted.  Its saved next run time is kept in case the job is added
+// again later.
+func (s *Scheduler) Remove(name string) {
+	s.m.Lock()
+	delete(s.jobs, name)
+	s.m.Unlock()
+	s.signal()
+}
+
+// Jobs lists the scheduled jobs ordered by name.
+func (s *Scheduler) Jobs() []JobInfo {
+	s.m.Lock()
+	defer s.m.Unlock()
+	out := make([]JobInfo, 0, len(s.jobs))
+	for name, j := range s.jobs {
+		out = append(out, JobInfo{
+			Name: name,
+			Schedule: j.job.Schedule.String(),
+			Next: j.next,
+			Last: j.last,
+			Running: j.running,
+		})
+	}
+	sort.Slice(out, func(i, k int) bool {
+		return out[i].Name < out[k].Name
+	})
+	return out
+}
+
+func (s *Scheduler) nextRun(job *Job, after time.Time) time.Time {
+	next := job.Schedule.Next(after)
+	if !next.IsZero() && job.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(job.Jitter))))
+	}
+	return next
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+	for {
+		wait := s.runDue()
+		select {
+		case <-s.bot.clock.After(wait):
+		case <-s.wake:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// runDue starts every job that is due and returns how long to wait until
+// the next one.
+func (s *Scheduler) runDue() time.Duration {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := s.bot.Now()
+	wait := time.Hour
+	changed := false
+	for name, j := range s.jobs {
+		if j.next.After(now) {
+			if d := j.next.Sub(now); d < wait {
+				wait = d
+			}
+			continue
+		}
+		changed = true
+		if j.running {
+			s.bot.Log().Warnf("Job %s is still running, skipping this run", name)
+		} else {
+			j.running = true
+			j.last = now
+			s.active++
+			s.running.Add(1)
+			go s.execute(name, j)
+		}
+		j.next = s.nextRun(j.job, now)
+		if j.next.IsZero() {
+			delete(s.jobs, name)
+			delete(s.saved, name)
+		} else if d := j.next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if changed {
+		s.save()
+	}
+	return wait
+}
+
+func (s *Scheduler) execute(name string, j *scheduledJob) {
+	defer s.running.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			s.bot.Log().Errorf("Job %s panicked: %v", name, r)
+		}
+		s.m.Lock()
+		j.running = false
+		if s.active--; s.active == 0 {
+			s.idle.Broadcast()
+		}
+		s.m.Unlock()
+	}()
+	s.bot.Log().Debugf("Running job %s", name)
+	j.job.Run()
+}
+
+// RunDue starts the jobs that are due by the bot's clock and waits until
+// no job is running.  The scheduler does this by itself; tests that move
+// a fake clock call it so as not to race it.
+func (s *Scheduler) RunDue() {
+	s.runDue()
+	s.m.Lock()
+	defer s.m.Unlock()
+	for s.active > 0 {
+		s.idle.Wait()
+	}
+}
+
+// jobs answers the jobs command with the state of every scheduled job.
+func (b *Bot) jobs( ctx *CommandContext ) *BotResponse {
+	list := b.Scheduler().Jobs()
+	if len(list) == 0 {
+		return &BotResponse{
+			Text: "No jobs are scheduled.",
+			ResponseType: "ephemeral",
+		}
+	}
+	lines := make([][2]string, 0, len(list))
+	for _, j := range list {
+		state := "next " + j.Next.Format("02/01/2006 15:04:05 MST")
+		if j.Running {
+			state = "running, " + state
+		}
+		if !j.Last.IsZero() {
+			state += ", last " + j.Last.Format("02/01/2006 15:04:05 MST")
+		}
+		lines = append(lines, [2]string{j.Name, j.Schedule + ", " + state})
+	}
+	return &BotResponse{
+		Text: tableBlock("Jobs", lines),
+		ResponseType: "ephemeral",
+	}
+}
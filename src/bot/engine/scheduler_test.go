@@ -0,0 +1,134 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "sync"
+import "testing"
+import "time"
+
+// counter is a job function that counts its runs.
+type counter struct {
+	m sync.Mutex
+	n int
+}
+
+func (c *counter) run() {
+	c.m.Lock()
+	c.n++
+	c.m.Unlock()
+}
+
+func (c *counter) runs() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.n
+}
+
+func schedulerBot(t *testing.T) *enginetest.Harness {
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+	})
+}
+
+func addJob(t *testing.T, h *enginetest.Harness, run func()) {
+	t.Helper()
+	err := h.Bot.Scheduler().Add(&engine.Job{
+		Name: "Test/job",
+		Schedule: engine.Every(time.Hour),
+		Run: run,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func nextRun(t *testing.T, h *enginetest.Harness) time.Time {
+	t.Helper()
+	for _, j := range h.Bot.Scheduler().Jobs() {
+		if j.Name == "Test/job" {
+			return j.Next
+		}
+	}
+	t.Fatal("Job is not scheduled")
+	return time.Time{}
+}
+
+func TestSchedulerPersists(t *testing.T) {
+	h := schedulerBot(t)
+	c := &counter{}
+	addJob(t, h, c.run)
+	h.Step(time.Hour)
+	if c.runs() != 1 {
+		t.Fatalf("Ran %d times", c.runs())
+	}
+
+	// a restart resumes from the saved time rather than starting afresh
+	h.Clock.Advance(30 * time.Minute)
+	h.Restart()
+	addJob(t, h, c.run)
+	if got, want := nextRun(t, h), enginetest.Epoch.Add(2*time.Hour); !got.Equal(want) {
+		t.Errorf("Next run at %v, want %v", got, want)
+	}
+
+	// a run missed while down happens once, straight away
+	h.Bot.Done()
+	h.Clock.Advance(5 * time.Hour)
+	h.Restart()
+	addJob(t, h, c.run)
+	h.Bot.Scheduler().RunDue()
+	if c.runs() != 2 {
+		t.Errorf("Ran %d times, want once more after the restart", c.runs())
+	}
+}
+
+func TestSchedulerStopsOnDone(t *testing.T) {
+	h := schedulerBot(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := false
+	c := &counter{}
+	addJob(t, h, func() {
+		c.run()
+		if c.runs() == 1 {
+			close(started)
+			<-release
+			finished = true
+		}
+	})
+	h.Clock.Advance(time.Hour)
+	go h.Bot.Scheduler().RunDue()
+	<-started
+	close(release)
+	// Done waits for the running job
+	h.Bot.Done()
+	if !finished {
+		t.Error("Done returned while the job was running")
+	}
+	// and nothing runs afterwards, however much time passes
+	h.Clock.Advance(10 * time.Hour)
+	if c.runs() != 1 {
+		t.Errorf("Ran %d times after Done", c.runs())
+	}
+}
+
+func TestSchedulerRecoversPanics(t *testing.T) {
+	h := schedulerBot(t)
+	c := &counter{}
+	addJob(t, h, func() {
+		c.run()
+		if c.runs() == 1 {
+			panic("first run fails")
+		}
+	})
+	h.Step(time.Hour)
+	h.Step(time.Hour)
+	if c.runs() != 2 {
+		t.Errorf("Ran %d times, want the job to survive its panic", c.runs())
+	}
+	for _, j := range h.Bot.Scheduler().Jobs() {
+		if j.Running {
+			t.Errorf("Job %s still marked running", j.Name)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package engine
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+import "unicode/utf8"
+
+const slackDefaultMaxSkew = 5 * time.Minute
+const slackMaxBody = 1 << 20
+const slackMaxBlocks = 50
+const slackMaxText = 3000
+const slackMaxFieldText = 2000
+const slackMaxFields = 10
+const slackMaxBlockID = 255
+const slackMaxValue = 2000
+
+var errSlackSignature = errors.New("Bad Slack signature")
+
+// VerifySlackSignature checks the X-Slack-Signature of a request against
+// the app's signing secret.  Requests timestamped more than maxSkew away
+// from now are refused, so a captured request can't be replayed later.
+func VerifySlackSignature(secret string, h http.Header, body []byte, now time.Time, maxSkew time.Duration) error {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Bad Slack timestamp %q", ts)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > maxSkew || d < -maxSkew {
+		return fmt.Errorf("Slack timestamp is %v away", d.Round(time.Second))
+	}
+	sig := h.Get("X-Slack-Signature")
+	if !strings.HasPrefix(sig, "v0=") {
+		return errSlackSignature
+	}
+	got, err := hex.DecodeString(sig[3:])
+	if err != nil {
+		return errSlackSignature
+	}
+	if !hmac.Equal(got, slackSignature(secret, ts, body)) {
+		return errSlackSignature
+	}
+	return nil
+}
+
+func slackSignature(secret string, ts string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// DecodeSlackRequest maps a Slack slash command payload to a BotRequest.
+// The text is prefixed with the command name, as for Mattermost slash
+// commands, so that plugins see "roll 2d6" for "/roll 2d6".
+func DecodeSlackRequest(body []byte) (*BotRequest, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	req := &BotRequest{
+		Source: SourceSlash,
+		Platform: PlatformSlack,
+	}
+	req.fromForm(form)
+	// the deprecated verification token is no use once signed
+	req.Token = ""
+	if req.Command == "" {
+		return nil, errors.New("Slack request has no command")
+	}
+	req.Text = strings.TrimSpace(strings.TrimPrefix(req.Command, "/") + " " + req.Text)
+	return req, nil
+}
+
+// SlackSlash serves the slash commands of a Slack app.
+func (b *Bot) SlackSlash( w http.ResponseWriter, r *http.Request ) {
+	start := time.Now()
+	defer func() {
+		b.metrics.latency.Observe(time.Since(start).Seconds(), "slack")
+	}()
+	body, ok := b.readSlack(w, r)
+	if !ok {
+		return
+	}
+	req, err := DecodeSlackRequest(body)
+	if err != nil {
+		b.Log().Warnf("Failed to decode Slack request: %v", err)
+		return
+	}
+	req.Timestamp, _ = strconv.ParseInt(r.Header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	b.Log().Debugf("Slack request from %s in %s: %q", req.UserName, req.ChannelName, req.Text)
+	b.respond(w, req)
+}
+
+// readSlack returns the body of a Slack request once its signature has
+// been checked, or answers it with an error.
+func (b *Bot) readSlack( w http.ResponseWriter, r *http.Request ) ([]byte, bool) {
+	if r.Method != "POST" {
+		b.Log().Warnf("Invalid request method: %s", r.Method)
+		return nil, false
+	}
+	sc := b.Config().Slack
+	if sc.SigningSecret == "" {
+		b.Log().Warnf("Ignoring Slack request from %s, no signing secret is configured", r.RemoteAddr)
+		http.NotFound(w, r)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, slackMaxBody))
+	if err != nil {
+		b.Log().Warnf("Failed to read Slack request: %v", err)
+		return nil, false
+	}
+	maxSkew := slackDefaultMaxSkew
+	if sc.MaxSkewSeconds > 0 {
+		maxSkew = time.Duration(sc.MaxSkewSeconds) * time.Second
+	}
+	if err = VerifySlackSignature(sc.SigningSecret, r.Header, body, b.Now(), maxSkew); err != nil {
+		b.Log().Warnf("Ignoring Slack request from %s: %v", r.RemoteAddr, err)
+		b.metrics.tokenRejections.Inc("slack")
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// slackActionPayload is the part of a Slack block_actions payload the
+// bot uses.
+type slackActionPayload struct {
+	Type string `json:"type"`
+	TriggerID string `json:"trigger_id"`
+	ResponseURL string `json:"response_url"`
+	User struct {
+		ID string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+		Name string `json:"name"`
+	} `json:"channel"`
+	Team struct {
+		ID string `json:"id"`
+		Domain string `json:"domain"`
+	} `json:"team"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		BlockID string `json:"block_id"`
+		Value string `json:"value"`
+		SelectedOption *struct {
+			Value string `json:"value"`
+		} `json:"selected_option"`
+	} `json:"actions"`
+}
+
+// SlackActions serves clicks on the buttons and menus of a Slack app's
+// messages.  Slack ignores the reply, so updates are posted to the
+// payload's response_url.
+func (b *Bot) SlackActions( w http.ResponseWriter, r *http.Request ) {
+	body, ok := b.readSlack(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		b.Log().Warnf("Failed to decode Slack action: %v", err)
+		return
+	}
+	in := &slackActionPayload{}
+	if err = json.Unmarshal([]byte(form.Get("payload")), in); err != nil {
+		b.Log().Warnf("Failed to decode Slack action: %v", err)
+		return
+	}
+	if in.Type != "block_actions" {
+		b.Log().Debugf("Ignoring Slack %s payload", in.Type)
+		return
+	}
+	req := &BotRequest{
+		ChannelID: in.Channel.ID,
+		ChannelName: in.Channel.Name,
+		ResponseURL: in.ResponseURL,
+		TeamDomain: in.Team.Domain,
+		TeamID: in.Team.ID,
+		TriggerID: in.TriggerID,
+		UserID: in.User.ID,
+		UserName: in.User.Username,
+		Source: SourceSlash,
+		Platform: PlatformSlack,
+	}
+	for _, a := range in.Actions {
+		act := &ActionRequest{
+			Request: req,
+			Context: ActionContext{},
+		}
+		// buttons carry their context as their value, menus in their block
+		ctx := a.Value
+		if a.SelectedOption != nil {
+			ctx = a.BlockID
+			act.Selected = a.SelectedOption.Value
+		}
+		if err = json.Unmarshal([]byte(ctx), &act.Context); err != nil {
+			b.Log().Warnf("Ignoring Slack action %s with bad context: %v", a.ActionID, err)
+			continue
+		}
+		resp, err := b.HandleAction(act)
+		if err != nil {
+			b.Log().Warnf("Ignoring Slack action from %s: %v", r.RemoteAddr, err)
+			continue
+		}
+		b.postActionResponse(req, resp)
+	}
+}
+
+// postActionResponse sends the answer to a Slack click to its
+// response_url.
+func (b *Bot) postActionResponse(req *BotRequest, resp *ActionResponse) {
+	if req.ResponseURL == "" {
+		return
+	}
+	expires := b.Now().Add(deferredExpiry)
+	if resp.Update != nil {
+		u := *resp.Update
+		u.ReplaceOriginal = true
+		if err := b.Outbox().EnqueueFor(PlatformSlack, req.ResponseURL, &u, expires); err != nil {
+			b.Log().Warnf("Queueing action update failed: %v", err)
+		}
+	}
+	if resp.Ephemeral != "" {
+		msg := &BotResponse{
+			Text: resp.Ephemeral,
+			ResponseType: "ephemeral",
+		}
+		if err := b.Outbox().EnqueueFor(PlatformSlack, req.ResponseURL, msg, expires); err != nil {
+			b.Log().Warnf("Queueing action reply failed: %v", err)
+		}
+	}
+}
+
+// encodeResponse returns what to send to a platform for resp.
+func encodeResponse(platform Platform, resp *BotResponse) interface{} {
+	if platform == PlatformSlack {
+		return SlackMessageFor(resp)
+	}
+	return resp
+}
+
+// SlackMessage is a response in Slack's Block Kit format.
+type SlackMessage struct {
+	ResponseType string `json:"response_type,omitempty"`
+	ReplaceOriginal bool `json:"replace_original,omitempty"`
+	Text string `json:"text"`
+	Blocks []*SlackBlock `json:"blocks,omitempty"`
+}
+
+type SlackBlock struct {
+	Type string `json:"type"`
+	BlockID string `json:"block_id,omitempty"`
+	Text *SlackText `json:"text,omitempty"`
+	Fields []*SlackText `json:"fields,omitempty"`
+	Elements []interface{} `json:"elements,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	AltText string `json:"alt_text,omitempty"`
+}
+
+// SlackElement is a button or static select in an actions block.
+type SlackElement struct {
+	Type string `json:"type"`
+	ActionID string `json:"action_id"`
+	Text *SlackText `json:"text,omitempty"`
+	Placeholder *SlackText `json:"placeholder,omitempty"`
+	Value string `json:"value,omitempty"`
+	Style string `json:"style,omitempty"`
+	Options []*SlackOption `json:"options,omitempty"`
+}
+
+type SlackOption struct {
+	Text *SlackText `json:"text"`
+	Value string `json:"value"`
+}
+
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackMrkdwn wraps text that is already in mrkdwn.
+func slackMrkdwn(s string) *SlackText {
+	return &SlackText{Type: "mrkdwn", Text: slackTruncate(s, slackMaxText)}
+}
+
+func slackSection(s string) *SlackBlock {
+	return &SlackBlock{Type: "section", Text: slackMrkdwn(s)}
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackLink is a mrkdwn link to url showing text.
+func slackLink(url string, text string) string {
+	return "<" + slackEscaper.Replace(url) + "|" + slackEscaper.Replace(text) + ">"
+}
+
+var reMarkdownLink = regexp.MustCompile(`\[([^\]]*)\]\(([^)\s]+)\)`)
+var reMarkdownBold = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+var reMarkdownHeading = regexp.MustCompile(`(?m)^#{1,6}\s+(.+)$`)
+
+// slackMarkdown converts the Markdown that Mattermost renders to Slack's
+// mrkdwn, which differs in links, bold and headings, and escapes the
+// characters Slack reserves for its own markup.
+func slackMarkdown(s string) string {
+	s = slackEscaper.Replace(s)
+	s = reMarkdownLink.ReplaceAllString(s, "<$2|$1>")
+	s = reMarkdownBold.ReplaceAllString(s, "*$1*")
+	return reMarkdownHeading.ReplaceAllString(s, "*$1*")
+}
+
+// slackTruncate cuts s to at most max bytes, on a rune boundary.
+func slackTruncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len("…")
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "…"
+}
+
+// SlackMessageFor renders resp as blocks: its text, then each attachment
+// as its pretext, author, linked title and text, fields and image, with
+// dividers between attachments.  Attachment colors have no equivalent
+// and are dropped.  The plain text, needed for notifications, falls back
+// to the first attachment's.
+func SlackMessageFor(resp *BotResponse) *SlackMessage {
+	msg := &SlackMessage{
+		ResponseType: resp.ResponseType,
+		ReplaceOriginal: resp.ReplaceOriginal,
+		Text: slackEscaper.Replace(resp.Text),
+	}
+	blocks := make([]*SlackBlock, 0)
+	if resp.Text != "" {
+		blocks = append(blocks, slackSection(slackMarkdown(resp.Text)))
+	}
+	for _, a := range resp.Attachments {
+		if len(blocks) > 0 {
+			blocks = append(blocks, &SlackBlock{Type: "divider"})
+		}
+		blocks = append(blocks, slackAttachment(a)...)
+		if msg.Text == "" {
+			msg.Text = slackEscaper.Replace(firstNonEmpty(a.Fallback, a.Title, a.Text, a.Pretext))
+		}
+	}
+	if len(blocks) > slackMaxBlocks {
+		blocks = blocks[:slackMaxBlocks]
+	}
+	if len(blocks) > 0 {
+		msg.Blocks = blocks
+	}
+	return msg
+}
+
+func slackAttachment(a *BotResponseAttachment) []*SlackBlock {
+	blocks := make([]*SlackBlock, 0)
+	if a.Pretext != "" {
+		blocks = append(blocks, slackSection(slackMarkdown(a.Pretext)))
+	}
+	if a.AuthorName != "" {
+		author := slackEscaper.Replace(a.AuthorName)
+		if a.AuthorLink != "" {
+			author = slackLink(a.AuthorLink, a.AuthorName)
+		}
+		blocks = append(blocks, &SlackBlock{
+			Type: "context",
+			Elements: []interface{}{&SlackText{Type: "mrkdwn", Text: author}},
+		})
+	}
+	body := make([]string, 0, 2)
+	if a.Title != "" {
+		title := slackEscaper.Replace(a.Title)
+		if a.TitleLink != "" {
+			title = slackLink(a.TitleLink, a.Title)
+		}
+		body = append(body, "*"+title+"*")
+	}
+	if a.Text != "" {
+		body = append(body, slackMarkdown(a.Text))
+	}
+	if len(body) > 0 {
+		blocks = append(blocks, slackSection(strings.Join(body, "\n")))
+	}
+	for i := 0; i < len(a.Fields); i += slackMaxFields {
+		end := i + slackMaxFields
+		if end > len(a.Fields) {
+			end = len(a.Fields)
+		}
+		fields := make([]*SlackText, 0, end-i)
+		for _, f := range a.Fields[i:end] {
+			text := slackTruncate("*"+slackEscaper.Replace(f.Title)+"*\n"+slackMarkdown(f.Value), slackMaxFieldText)
+			fields = append(fields, &SlackText{Type: "mrkdwn", Text: text})
+		}
+		blocks = append(blocks, &SlackBlock{Type: "section", Fields: fields})
+	}
+	if a.ImageURL != "" {
+		blocks = append(blocks, &SlackBlock{
+			Type: "image",
+			ImageURL: a.ImageURL,
+			AltText: firstNonEmpty(a.Title, a.Fallback, "image"),
+		})
+	}
+	return append(blocks, slackActions(a.Actions)...)
+}
+
+// slackStyles maps Mattermost button styles to the two Slack has.
+var slackStyles = map[string]string{
+	"primary": "primary",
+	"good": "primary",
+	"success": "primary",
+	"danger": "danger",
+}
+
+// slackActions renders buttons together in one actions block, with their
+// signed context as their value.  Options have no room for the context,
+// so each menu gets a block of its own that carries it as its block_id.
+// Slack refuses the whole message if a value or block_id is too long, so
+// an action whose context doesn't fit is left out.
+func slackActions(actions []*AttachmentAction) []*SlackBlock {
+	blocks := make([]*SlackBlock, 0)
+	buttons := &SlackBlock{Type: "actions"}
+	for _, a := range actions {
+		if a.Integration == nil {
+			continue
+		}
+		ctx, err := json.Marshal(a.Integration.Context)
+		if err != nil {
+			continue
+		}
+		route, _ := a.Integration.Context[actionKey].(string)
+		el := &SlackElement{
+			ActionID: route,
+		}
+		if a.Type != "select" {
+			if len(ctx) > slackMaxValue {
+				continue
+			}
+			el.Type = "button"
+			el.Text = &SlackText{Type: "plain_text", Text: a.Name}
+			el.Value = string(ctx)
+			el.Style = slackStyles[a.Style]
+			buttons.Elements = append(buttons.Elements, el)
+			continue
+		}
+		if len(a.Options) == 0 {
+			// users and channels menus need Slack's own element types
+			continue
+		}
+		if len(ctx) > slackMaxBlockID {
+			continue
+		}
+		el.Type = "static_select"
+		el.Placeholder = &SlackText{Type: "plain_text", Text: a.Name}
+		for _, o := range a.Options {
+			el.Options = append(el.Options, &SlackOption{
+				Text: &SlackText{Type: "plain_text", Text: o.Text},
+				Value: o.Value,
+			})
+		}
+		blocks = append(blocks, &SlackBlock{
+			Type: "actions",
+			BlockID: string(ctx),
+			Elements: []interface{}{el},
+		})
+	}
+	if len(buttons.Elements) > 0 {
+		blocks = append([]*SlackBlock{buttons}, blocks...)
+	}
+	return blocks
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
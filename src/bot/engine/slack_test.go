@@ -0,0 +1,186 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "strings"
+import "testing"
+import "time"
+import "unicode/utf8"
+
+func slackHeaders(secret string, ts time.Time, body string) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:%s", ts.Unix(), body)
+	h := http.Header{}
+	h.Set("X-Slack-Request-Timestamp", fmt.Sprint(ts.Unix()))
+	h.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return h
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := enginetest.Epoch
+	body := "command=%2Froll&text=2d6"
+	for _, c := range []struct {
+		name string
+		h http.Header
+		body string
+		ok bool
+	}{
+		{"valid", slackHeaders("secret", now, body), body, true},
+		{"wrong secret", slackHeaders("other", now, body), body, false},
+		{"tampered body", slackHeaders("secret", now, body), body + "0", false},
+		{"stale", slackHeaders("secret", now.Add(-10*time.Minute), body), body, false},
+		{"unsigned", http.Header{}, body, false},
+	} {
+		err := engine.VerifySlackSignature("secret", c.h, []byte(c.body), now, 5*time.Minute)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+	}
+}
+
+func TestDecodeSlackRequest(t *testing.T) {
+	req, err := engine.DecodeSlackRequest([]byte("token=old&command=%2Froll&text=2d6&user_name=alice&user_id=U1&channel_id=C1&response_url=https%3A%2F%2Fhooks.slack.com%2Fx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Text != "roll 2d6" || req.UserID != "U1" || req.Token != "" || !req.IsSlash() || req.Platform != engine.PlatformSlack {
+		t.Errorf("Got %+v", req)
+	}
+	if _, err = engine.DecodeSlackRequest([]byte("text=2d6")); err == nil {
+		t.Error("Decoded a request without a command")
+	}
+}
+
+func TestSlackMessageFor(t *testing.T) {
+	resp := &engine.BotResponse{
+		Text: "See **the [docs](https://example.com/?a=1&b=2)** <now>",
+		ResponseType: "ephemeral",
+	}
+	resp.AddAttachment(&engine.BotResponseAttachment{
+		Color: "#00ff00",
+		Pretext: "Before",
+		AuthorName: "alice",
+		Title: "Roll",
+		TitleLink: "https://example.com/roll",
+		Text: "alice rolls 6",
+		Fields: []*engine.BotResponseAttachmentField{
+			{Title: "Total", Value: "6", Short: true},
+		},
+		ImageURL: "https://example.com/d6.png",
+	})
+	enginetest.AssertGolden(t, "slack_message", engine.SlackMessageFor(resp))
+}
+
+func TestSlackActionBlocks(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{Plugins: []config.PluginConfig{{Name: "Dice"}}})
+	p := h.Bot.Plugins[0]
+	options := []*engine.ActionOption{{Text: "One", Value: "1"}, {Text: "Two", Value: "2"}}
+	resp := &engine.BotResponse{}
+	resp.AddAttachment(&engine.BotResponseAttachment{
+		Fields: []*engine.BotResponseAttachmentField{
+			{Title: "Long", Value: strings.Repeat("x", 2500)},
+		},
+		Actions: []*engine.AttachmentAction{
+			h.Bot.Button(p, enginetest.ChannelID, "go", "Go", nil),
+			h.Bot.Menu(p, enginetest.ChannelID, "pick", "Pick", options, nil),
+			// too much context for a block_id
+			h.Bot.Menu(p, enginetest.ChannelID, "big", "Big", options, engine.ActionContext{"note": strings.Repeat("x", 200)}),
+		},
+	})
+	msg := engine.SlackMessageFor(resp)
+	for _, b := range msg.Blocks {
+		for _, f := range b.Fields {
+			if n := utf8.RuneCountInString(f.Text); n > 2000 {
+				t.Errorf("Field text is %d characters", n)
+			}
+		}
+		if len(b.BlockID) > 255 {
+			t.Errorf("Block id is %d characters", len(b.BlockID))
+		}
+	}
+	// the resulting blocks hold the bot's signatures, so only their shape
+	// is compared
+	kinds := make([]string, 0)
+	for _, b := range msg.Blocks {
+		kind := b.Type
+		for _, el := range b.Elements {
+			if el, ok := el.(*engine.SlackElement); ok {
+				kind += " " + el.Type + ":" + el.ActionID
+			}
+		}
+		kinds = append(kinds, kind)
+	}
+	want := "section, actions button:Dice/go, actions static_select:Dice/pick"
+	if got := strings.Join(kinds, ", "); got != want {
+		t.Errorf("Got blocks %s, want %s", got, want)
+	}
+}
+
+// slackClick posts a signed block_actions payload for the first button in
+// msg, as the test user, and returns the status the bot answered with.
+func slackClick(t *testing.T, h *enginetest.Harness, msg *engine.SlackMessage, secret string, responseURL string) int {
+	t.Helper()
+	var el *engine.SlackElement
+	for _, b := range msg.Blocks {
+		for _, e := range b.Elements {
+			if e, ok := e.(*engine.SlackElement); ok && el == nil {
+				el = e
+			}
+		}
+	}
+	if el == nil {
+		t.Fatalf("No button in %+v", msg)
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"type": "block_actions",
+		"response_url": responseURL,
+		"user": map[string]string{"id": enginetest.UserID, "username": enginetest.UserName},
+		"channel": map[string]string{"id": enginetest.ChannelID, "name": enginetest.ChannelName},
+		"actions": []map[string]string{{"action_id": el.ActionID, "value": el.Value}},
+	})
+	body := url.Values{"payload": {string(payload)}}.Encode()
+	r := httptest.NewRequest("POST", "/slack/actions", strings.NewReader(body))
+	r.Header = slackHeaders(secret, h.Clock.Now(), body)
+	w := httptest.NewRecorder()
+	h.Bot.SlackActions(w, r)
+	return w.Code
+}
+
+func TestSlackActions(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Gem"}},
+		Config: func(cfg *config.Config) {
+			cfg.Slack.SigningSecret = "secret"
+		},
+	})
+	sink := enginetest.NewSink(t)
+	h.Send(enginetest.Message("gem add mine"))
+	msg := engine.SlackMessageFor(h.Send(enginetest.Message("gem remove 0")))
+
+	if code := slackClick(t, h, msg, "forged", sink.URL()); code != http.StatusUnauthorized {
+		t.Errorf("Forged click answered with %d", code)
+	}
+	if resp := h.Send(enginetest.Message("gem 0")); !strings.Contains(resp.Attachments[0].Text, "mine") {
+		t.Fatalf("A forged click removed the gem: %+v", resp)
+	}
+	if code := slackClick(t, h, msg, "secret", sink.URL()); code != http.StatusOK {
+		t.Errorf("Click answered with %d", code)
+	}
+	// the update, in blocks that the sink doesn't decode
+	posts := sink.Wait(t, 1, 5*time.Second)
+	if len(posts) != 1 || posts[0].Text != "Gems" {
+		t.Errorf("Posted %+v", posts)
+	}
+	if resp := h.Send(enginetest.Message("gem 0")); strings.Contains(resp.Attachments[0].Text, "mine") {
+		t.Errorf("Gem not removed: %+v", resp)
+	}
+}
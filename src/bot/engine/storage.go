@@ -0,0 +1,303 @@
+package engine
+
+import "bot/logging"
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "gopkg.in/yaml.v2"
+
+const storeVersionKey = "_schema"
+const storeSeqPrefix = "_seq/"
+
+// storeBackend persists a Store's values, which are kept YAML encoded.
+// put and delete are called with the store's lock held and must have the
+// change on disk before the store applies it to data; compact is then
+// called with the updated data.
+type storeBackend interface {
+	path() string
+	load() (map[string][]byte, error)
+	put(key string, value []byte) error
+	delete(key string) error
+	compact(data map[string][]byte) error
+	close() error
+}
+
+var storeBackends = map[string]func(dir string) storeBackend{
+	"yaml": newYAMLBackend,
+	"log": newLogBackend,
+}
+
+// Store is a plugin's persistent data: key/value pairs and named
+// collections of documents, in a namespace of its own.  Values are
+// anything yaml.v2 can marshal.  Every change is on disk by the time Put
+// or Delete returns.
+type Store struct {
+	m sync.Mutex
+	data map[string][]byte
+	backend storeBackend
+}
+
+// OpenStore opens the store kept in dir using the named backend, "yaml"
+// if empty.  Data written by the other backend is carried over the first
+// time a backend is used.
+func OpenStore(dir string, backend string) (*Store, error) {
+	if backend == "" {
+		backend = "yaml"
+	}
+	newBackend, ok := storeBackends[backend]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage %s", backend)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Store{backend: newBackend(dir)}
+	data, err := s.backend.load()
+	if err != nil {
+		return nil, err
+	}
+	s.data = data
+	if len(data) == 0 {
+		if err = s.convert(dir, backend); err != nil {
+			s.backend.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// convert copies in data left by another backend and renames its file so
+// that it is only read once.
+func (s *Store) convert(dir string, backend string) error {
+	for name, newBackend := range storeBackends {
+		if name == backend {
+			continue
+		}
+		other := newBackend(dir)
+		fn := other.path()
+		if _, err := os.Stat(fn); err != nil {
+			continue
+		}
+		data, err := other.load()
+		other.close()
+		if err != nil {
+			return fmt.Errorf("Converting %s: %v", fn, err)
+		}
+		for k, v := range data {
+			if err = s.put(k, v); err != nil {
+				return err
+			}
+		}
+		return os.Rename(fn, fn+".bak")
+	}
+	return nil
+}
+
+// Get decodes the value stored under key into out and reports whether
+// there was one.
+func (s *Store) Get(key string, out interface{}) (bool, error) {
+	s.m.Lock()
+	v, ok := s.data[key]
+	s.m.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, yaml.Unmarshal(v, out)
+}
+
+// Put stores value under key.
+func (s *Store) Put(key string, value interface{}) error {
+	v, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.put(key, v)
+}
+
+// put stores an encoded value.  The caller must hold s.m.
+func (s *Store) put(key string, v []byte) error {
+	if err := s.backend.put(key, v); err != nil {
+		return err
+	}
+	s.data[key] = v
+	s.compact()
+	return nil
+}
+
+// compact lets the backend reclaim space.  The change is already on disk,
+// so a failure here is only logged and tried again after the next one.
+func (s *Store) compact() {
+	if err := s.backend.compact(s.data); err != nil {
+		logging.Warnf("Compacting %s: %v", s.backend.path(), err)
+	}
+}
+
+// Delete removes key.  Deleting a missing key is not an error.
+func (s *Store) Delete(key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	if err := s.backend.delete(key); err != nil {
+		return err
+	}
+	delete(s.data, key)
+	s.compact()
+	return nil
+}
+
+// Keys lists the keys starting with prefix, sorted.
+func (s *Store) Keys(prefix string) []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	out := make([]string, 0)
+	for k := range s.data {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Version returns the schema version of the data, 0 for a new store.
+func (s *Store) Version() int {
+	v := 0
+	s.Get(storeVersionKey, &v)
+	return v
+}
+
+// Migration upgrades a store by one schema version.
+type Migration func(s *Store) error
+
+// Migrate brings the store up to len(migrations), running migrations[n]
+// to go from version n to n+1.  Data written by a newer version of the
+// plugin is refused rather than misread.
+func (s *Store) Migrate(migrations []Migration) error {
+	v := s.Version()
+	if v > len(migrations) {
+		return fmt.Errorf("Store has schema version %d, newer than %d", v, len(migrations))
+	}
+	for ; v < len(migrations); v++ {
+		if err := migrations[v](s); err != nil {
+			return fmt.Errorf("Migrating store to version %d: %v", v+1, err)
+		}
+		if err := s.Put(storeVersionKey, v+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dir returns the directory the store is kept in.
+func (s *Store) Dir() string {
+	return filepath.Dir(s.backend.path())
+}
+
+// Close releases the backend.  The store must not be used afterwards.
+func (s *Store) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.backend.close()
+}
+
+// Collection is a named set of documents within a Store, each stored
+// under its own key so that changing one document doesn't rewrite the
+// others in journalled backends.
+type Collection struct {
+	s *Store
+	name string
+}
+
+// Collection returns the document collection called name.
+func (s *Store) Collection(name string) *Collection {
+	return &Collection{s, name}
+}
+
+func (c *Collection) key(id string) string {
+	return c.name + "/" + id
+}
+
+// Get decodes the document with id into out.
+func (c *Collection) Get(id string, out interface{}) (bool, error) {
+	return c.s.Get(c.key(id), out)
+}
+
+// Put stores doc under id, replacing any document already there.
+func (c *Collection) Put(id string, doc interface{}) error {
+	return c.s.Put(c.key(id), doc)
+}
+
+// Delete removes the document with id.
+func (c *Collection) Delete(id string) error {
+	return c.s.Delete(c.key(id))
+}
+
+// IDs lists the ids of the documents in the collection, sorted.
+func (c *Collection) IDs() []string {
+	prefix := c.key("")
+	keys := c.s.Keys(prefix)
+	for i, k := range keys {
+		keys[i] = k[len(prefix):]
+	}
+	return keys
+}
+
+// Seq returns the id the next Insert will use.
+func (c *Collection) Seq() int {
+	n := 0
+	c.s.Get(storeSeqPrefix+c.name, &n)
+	return n
+}
+
+// SetSeq sets the id the next Insert will use.
+func (c *Collection) SetSeq(n int) error {
+	return c.s.Put(storeSeqPrefix+c.name, n)
+}
+
+// Insert stores doc under the next numeric id and returns that id.
+func (c *Collection) Insert(doc interface{}) (int, error) {
+	v, err := yaml.Marshal(doc)
+	if err != nil {
+		return 0, err
+	}
+	c.s.m.Lock()
+	defer c.s.m.Unlock()
+	n := 0
+	if seq, ok := c.s.data[storeSeqPrefix+c.name]; ok {
+		yaml.Unmarshal(seq, &n)
+	}
+	next, _ := yaml.Marshal(n + 1)
+	if err = c.s.put(storeSeqPrefix+c.name, next); err != nil {
+		return 0, err
+	}
+	return n, c.s.put(c.key(strconv.Itoa(n)), v)
+}
+
+// writeFileAtomic replaces fn with data so that readers see either the
+// old or the new contents, never a partial write.
+func writeFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	tmp := fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
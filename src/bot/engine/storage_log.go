@@ -0,0 +1,229 @@
+package engine
+
+import "bot/logging"
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "hash/crc32"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+
+const logMagic = "RBSTORE1"
+const logOpPut = 'P'
+const logOpDelete = 'D'
+
+// Compaction happens once the journal holds more than twice as many
+// records as there are live keys, and at least this many.
+const logCompactMin = 256
+
+var errLogCorrupt = errors.New("Corrupt store record")
+
+// logBackend keeps a store as an append-only journal of put and delete
+// records.  Each change appends one small record instead of rewriting
+// everything, and the journal is compacted into a snapshot of the live
+// keys when it has grown mostly stale.  A record is an op byte, the key
+// and value with uvarint lengths, and a CRC32 of all of that.  A torn
+// record at the end of the file, left by a crash, is dropped on load; a
+// bad record anywhere else fails the load and leaves the file alone.
+type logBackend struct {
+	fn string
+	f *os.File
+	records int
+}
+
+func newLogBackend(dir string) storeBackend {
+	return &logBackend{
+		fn: filepath.Join(dir, "store.log"),
+	}
+}
+
+func (l *logBackend) path() string {
+	return l.fn
+}
+
+func (l *logBackend) load() (map[string][]byte, error) {
+	data := make(map[string][]byte)
+	f, err := os.OpenFile(l.fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(logMagic))
+	n, err := io.ReadFull(r, magic)
+	if n == 0 && err == io.EOF {
+		// new file
+		_, err = f.Write([]byte(logMagic))
+		return data, err
+	}
+	if err != nil || string(magic) != logMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a store journal", l.fn)
+	}
+	good := int64(len(logMagic))
+	for {
+		op, key, value, size, err := readLogRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == errLogCorrupt && logAtEOF(r) {
+			// drop the torn tail so that appends follow the last good record
+			logging.Warnf("Dropping torn record at offset %d of %s", good, l.fn)
+			if terr := f.Truncate(good); terr != nil {
+				f.Close()
+				return nil, terr
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %v at offset %d", l.fn, err, good)
+		}
+		good += size
+		l.records++
+		if op == logOpPut {
+			data[key] = value
+		} else {
+			delete(data, key)
+		}
+	}
+	if _, err = f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// logAtEOF reports whether nothing follows what r has read so far.
+func logAtEOF(r *bufio.Reader) bool {
+	_, err := r.Peek(1)
+	return err == io.EOF
+}
+
+// readLogRecord returns io.EOF at the end of the journal,
+// io.ErrUnexpectedEOF for a record cut short and errLogCorrupt for one
+// that is complete but bad.
+func readLogRecord(r *bufio.Reader) (byte, string, []byte, int64, error) {
+	var buf bytes.Buffer
+	op, err := r.ReadByte()
+	if err != nil {
+		return 0, "", nil, 0, err
+	}
+	if op != logOpPut && op != logOpDelete {
+		return 0, "", nil, 0, errLogCorrupt
+	}
+	buf.WriteByte(op)
+	fields := make([][]byte, 2)
+	for i := range fields {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, "", nil, 0, logReadErr(err)
+		}
+		if n > 1<<30 {
+			return 0, "", nil, 0, errLogCorrupt
+		}
+		fields[i] = make([]byte, n)
+		if _, err = io.ReadFull(r, fields[i]); err != nil {
+			return 0, "", nil, 0, logReadErr(err)
+		}
+		writeLogField(&buf, fields[i])
+	}
+	sum := make([]byte, 4)
+	if _, err = io.ReadFull(r, sum); err != nil {
+		return 0, "", nil, 0, logReadErr(err)
+	}
+	if binary.BigEndian.Uint32(sum) != crc32.ChecksumIEEE(buf.Bytes()) {
+		return 0, "", nil, 0, errLogCorrupt
+	}
+	return op, string(fields[0]), fields[1], int64(buf.Len() + 4), nil
+}
+
+// logReadErr turns running out of file part way through a record into
+// io.ErrUnexpectedEOF, and passes other read errors through.
+func logReadErr(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func writeLogField(buf *bytes.Buffer, field []byte) {
+	n := make([]byte, binary.MaxVarintLen64)
+	buf.Write(n[:binary.PutUvarint(n, uint64(len(field)))])
+	buf.Write(field)
+}
+
+func logRecord(op byte, key string, value []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(op)
+	writeLogField(&buf, []byte(key))
+	writeLogField(&buf, value)
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum)
+	return buf.Bytes()
+}
+
+func (l *logBackend) append(rec []byte) error {
+	if _, err := l.f.Write(rec); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.records++
+	return nil
+}
+
+func (l *logBackend) put(key string, value []byte) error {
+	return l.append(logRecord(logOpPut, key, value))
+}
+
+func (l *logBackend) delete(key string) error {
+	return l.append(logRecord(logOpDelete, key, nil))
+}
+
+func (l *logBackend) compact(data map[string][]byte) error {
+	if l.records >= logCompactMin && l.records > 2*len(data) {
+		return l.rewrite(data)
+	}
+	return nil
+}
+
+// rewrite replaces the journal with one put record per live key.
+func (l *logBackend) rewrite(data map[string][]byte) error {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(logMagic)
+	for _, k := range keys {
+		buf.Write(logRecord(logOpPut, k, data[k]))
+	}
+	if err := writeFileAtomic(l.fn, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.fn, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	l.records = len(keys)
+	return nil
+}
+
+func (l *logBackend) close() error {
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,152 @@
+package engine_test
+
+import "bot/engine"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func openStore(t *testing.T, dir string, backend string) *engine.Store {
+	t.Helper()
+	s, err := engine.OpenStore(dir, backend)
+	if err != nil {
+		t.Fatalf("OpenStore %s: %v", backend, err)
+	}
+	return s
+}
+
+func expectValue(t *testing.T, s *engine.Store, key string, want string) {
+	t.Helper()
+	got := ""
+	ok, err := s.Get(key, &got)
+	if err != nil || !ok || got != want {
+		t.Errorf("%s = %q, %v, %v, want %q", key, got, ok, err, want)
+	}
+}
+
+func TestStoreJournal(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, "log")
+	s.Put("a", "one")
+	s.Put("b", "two")
+	s.Put("a", "three")
+	s.Delete("b")
+	s.Close()
+
+	s = openStore(t, dir, "log")
+	defer s.Close()
+	expectValue(t, s, "a", "three")
+	if ok, _ := s.Get("b", new(string)); ok {
+		t.Errorf("Deleted key b is back")
+	}
+}
+
+func TestStoreJournalTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, "log")
+	s.Put("a", "one")
+	s.Close()
+	fn := filepath.Join(dir, "store.log")
+	st, _ := os.Stat(fn)
+
+	// the start of a put record, as if the bot died while writing it
+	f, _ := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{'P', 1, 'b', 20, 'x'})
+	f.Close()
+
+	s = openStore(t, dir, "log")
+	expectValue(t, s, "a", "one")
+	if st2, _ := os.Stat(fn); st2.Size() != st.Size() {
+		t.Errorf("Journal is %d bytes after load, want %d", st2.Size(), st.Size())
+	}
+	s.Put("b", "two")
+	s.Close()
+
+	s = openStore(t, dir, "log")
+	defer s.Close()
+	expectValue(t, s, "a", "one")
+	expectValue(t, s, "b", "two")
+}
+
+func TestStoreJournalCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, "log")
+	s.Put("a", "one")
+	s.Put("b", "two")
+	s.Close()
+	fn := filepath.Join(dir, "store.log")
+	bb, _ := ioutil.ReadFile(fn)
+
+	// damage the value of the first record, which is followed by another
+	bad := append([]byte(nil), bb...)
+	bad[len("RBSTORE1")+4] ^= 0xff
+	writeFile(t, fn, bad)
+
+	if s, err := engine.OpenStore(dir, "log"); err == nil {
+		s.Close()
+		t.Fatalf("Opened a journal with a bad record in the middle")
+	}
+	if after, _ := ioutil.ReadFile(fn); len(after) != len(bb) {
+		t.Errorf("Journal is %d bytes after a failed load, want %d", len(after), len(bb))
+	}
+}
+
+func TestStoreJournalCompacts(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, "log")
+	s.Put("keep", "this")
+	for i := 0; i < 1000; i++ {
+		s.Put("n", i)
+	}
+	s.Close()
+
+	// each of those records is at least 10 bytes
+	st, _ := os.Stat(filepath.Join(dir, "store.log"))
+	if st.Size() > 5000 {
+		t.Errorf("Journal is %d bytes, it wasn't compacted", st.Size())
+	}
+	s = openStore(t, dir, "log")
+	defer s.Close()
+	expectValue(t, s, "keep", "this")
+	n := 0
+	if s.Get("n", &n); n != 999 {
+		t.Errorf("n = %d, want 999", n)
+	}
+}
+
+func TestStoreConvert(t *testing.T) {
+	for _, c := range [][]string{{"yaml", "log", "store.yml"}, {"log", "yaml", "store.log"}} {
+		dir := t.TempDir()
+		s := openStore(t, dir, c[0])
+		s.Put("a", "one")
+		s.Collection("things").Insert("two")
+		s.Close()
+
+		s = openStore(t, dir, c[1])
+		expectValue(t, s, "a", "one")
+		expectValue(t, s, "things/0", "two")
+		if s.Collection("things").Seq() != 1 {
+			t.Errorf("%s to %s: sequence not carried over", c[0], c[1])
+		}
+		s.Close()
+		if _, err := os.Stat(filepath.Join(dir, c[2]+".bak")); err != nil {
+			t.Errorf("%s to %s: old file not kept: %v", c[0], c[1], err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, c[2])); err == nil {
+			t.Errorf("%s to %s: old file would be read again", c[0], c[1])
+		}
+	}
+}
+
+func TestStoreFailedWriteKeepsMemory(t *testing.T) {
+	s := openStore(t, t.TempDir(), "log")
+	s.Put("a", "one")
+	s.Close()
+	if err := s.Put("a", "two"); err == nil {
+		t.Fatalf("Put succeeded on a closed journal")
+	}
+	if err := s.Delete("a"); err == nil {
+		t.Fatalf("Delete succeeded on a closed journal")
+	}
+	expectValue(t, s, "a", "one")
+}
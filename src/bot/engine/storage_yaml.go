@@ -0,0 +1,94 @@
+package engine
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "gopkg.in/yaml.v2"
+
+// yamlBackend keeps a store as one readable YAML file, rewritten
+// atomically on every change.  It suits small data that people may want
+// to look at or edit by hand.
+type yamlBackend struct {
+	fn string
+	doc map[string]interface{}
+}
+
+func newYAMLBackend(dir string) storeBackend {
+	return &yamlBackend{
+		fn: filepath.Join(dir, "store.yml"),
+		doc: make(map[string]interface{}),
+	}
+}
+
+func (y *yamlBackend) path() string {
+	return y.fn
+}
+
+func (y *yamlBackend) load() (map[string][]byte, error) {
+	data := make(map[string][]byte)
+	b, err := ioutil.ReadFile(y.fn)
+	if os.IsNotExist(err) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(b, &y.doc); err != nil {
+		return nil, err
+	}
+	for k, v := range y.doc {
+		if data[k], err = yaml.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (y *yamlBackend) put(key string, value []byte) error {
+	var v interface{}
+	if err := yaml.Unmarshal(value, &v); err != nil {
+		return err
+	}
+	old, ok := y.doc[key]
+	y.doc[key] = v
+	if err := y.save(); err != nil {
+		y.restore(key, old, ok)
+		return err
+	}
+	return nil
+}
+
+func (y *yamlBackend) delete(key string) error {
+	old, ok := y.doc[key]
+	delete(y.doc, key)
+	if err := y.save(); err != nil {
+		y.restore(key, old, ok)
+		return err
+	}
+	return nil
+}
+
+// restore undoes a change to doc that couldn't be saved.
+func (y *yamlBackend) restore(key string, old interface{}, ok bool) {
+	if ok {
+		y.doc[key] = old
+	} else {
+		delete(y.doc, key)
+	}
+}
+
+func (y *yamlBackend) compact(data map[string][]byte) error {
+	return nil
+}
+
+func (y *yamlBackend) save() error {
+	b, err := yaml.Marshal(y.doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(y.fn, b, 0600)
+}
+
+func (y *yamlBackend) close() error {
+	return nil
+}
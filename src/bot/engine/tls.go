@@ -0,0 +1,154 @@
+package engine
+
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "os"
+import "strconv"
+import "sync"
+import "time"
+import "bot/config"
+import "bot/logging"
+
+// certLoader hands out a certificate and key pair, reading them again
+// when either file changes so that renewed certificates are picked up
+// without a restart.
+type certLoader struct {
+	certFile string
+	keyFile string
+	log *logging.Logger
+	m sync.Mutex
+	cert *tls.Certificate
+	certMod time.Time
+	keyMod time.Time
+}
+
+func newCertLoader(certFile string, keyFile string, log *logging.Logger) (*certLoader, error) {
+	c := &certLoader{
+		certFile: certFile,
+		keyFile: keyFile,
+		log: log,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func modTime(fn string) time.Time {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func (c *certLoader) load() error {
+	certMod, keyMod := modTime(c.certFile), modTime(c.keyFile)
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.certMod, c.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// GetCertificate serves as tls.Config.GetCertificate.  A pair that fails
+// to load, such as one caught halfway through being replaced, is logged
+// and the previous one kept.
+func (c *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if !modTime(c.certFile).Equal(c.certMod) || !modTime(c.keyFile).Equal(c.keyMod) {
+		if err := c.load(); err != nil {
+			c.log.Warnf("Reloading TLS certificate failed, keeping the old one: %v", err)
+		} else {
+			c.log.Infof("Reloaded TLS certificate %s", c.certFile)
+		}
+	}
+	return c.cert, nil
+}
+
+// newTLSConfig builds the server side of cfg.  The client CAs are read
+// once; changing them needs a restart.
+func newTLSConfig(cfg config.TLSConfig, log *logging.Logger) (*tls.Config, error) {
+	certs, err := newCertLoader(cfg.CertFile, cfg.KeyFile, log)
+	if err != nil {
+		return nil, fmt.Errorf("Loading TLS certificate: %v", err)
+	}
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if cfg.ClientCAFile != "" {
+		bb, err := ioutil.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Loading TLS client CAs: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bb) {
+			return nil, errors.New("Loading TLS client CAs: no certificates found")
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// listen binds addr, serving TLS on it when cfg enables it.
+func listen(addr string, cfg config.TLSConfig, log *logging.Logger) (net.Listener, error) {
+	var tc *tls.Config
+	if cfg.Enabled() {
+		var err error
+		if tc, err = newTLSConfig(cfg, log); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc != nil {
+		ln = tls.NewListener(ln, tc)
+	}
+	return ln, nil
+}
+
+// startRedirect serves plain HTTP on host:port, sending every request
+// to the same path over HTTPS on httpsPort.  308 keeps webhook POSTs
+// POSTs.
+func startRedirect(host string, port int, httpsPort int, errc chan error) (*http.Server, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				name = h
+			}
+			if name == "" {
+				name = host
+			}
+			target := "https://" + net.JoinHostPort(name, strconv.Itoa(httpsPort)) + r.URL.RequestURI()
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+		}),
+	}
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			select {
+			case errc <- err:
+			default:
+			}
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,225 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine"
+import "bot/engine/enginetest"
+import "context"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "io/ioutil"
+import "math/big"
+import "net"
+import "net/http"
+import "os"
+import "path/filepath"
+import "strconv"
+import "testing"
+import "time"
+
+// testCA signs certificates for a TLS test.
+type testCA struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "Test CA"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{
+		cert: cert,
+		key: key,
+		pool: pool,
+		pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a certificate for 127.0.0.1 named name, as PEM.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+func writeFile(t *testing.T, fn string, bb []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(fn, bb, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// tlsHost starts a host serving the bot alpha over mutual TLS, and
+// returns it with the directory holding its certificate files.
+func tlsHost(t *testing.T, ca *testCA, tc config.TLSConfig) (*engine.Host, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cert, key := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	tc.CertFile, tc.KeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	tc.ClientCAFile = filepath.Join(dir, "ca.pem")
+	writeFile(t, tc.CertFile, cert)
+	writeFile(t, tc.KeyFile, key)
+	writeFile(t, tc.ClientCAFile, ca.pem)
+	h, err := engine.NewHost("127.0.0.1:0", tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostedBot(t, h, "alpha")
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Shutdown(context.Background()) })
+	return h, dir
+}
+
+func tlsClient(t *testing.T, ca *testCA, withCert bool) *http.Client {
+	tc := &tls.Config{RootCAs: ca.pool}
+	if withCert {
+		cert, key := ca.issue(t, "mattermost", x509.ExtKeyUsageClientAuth)
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.Certificates = []tls.Certificate{pair}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tc},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestHostMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	redirect := freePort(t)
+	h, _ := tlsHost(t, ca, config.TLSConfig{RedirectPort: redirect})
+	url := "https://" + h.Addr() + "/alpha/healthz"
+
+	resp, err := tlsClient(t, ca, true).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got status %d", resp.StatusCode)
+	}
+	if resp, err := tlsClient(t, ca, false).Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("Served a client without a certificate")
+	}
+
+	resp, err = tlsClient(t, ca, false).Post("http://127.0.0.1:"+strconv.Itoa(redirect)+"/alpha/message?x=1", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != "https://"+h.Addr()+"/alpha/message?x=1" {
+		t.Errorf("Redirected with %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	h, dir := tlsHost(t, ca, config.TLSConfig{})
+	serverName := func() string {
+		t.Helper()
+		resp, err := tlsClient(t, ca, true).Get("https://" + h.Addr() + "/alpha/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if got := serverName(); got != "server" {
+		t.Fatalf("Served %q", got)
+	}
+
+	cert, key := ca.issue(t, "renewed", x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "cert.pem"), cert)
+	writeFile(t, filepath.Join(dir, "key.pem"), key)
+	// make sure the change shows on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "cert.pem"), later, later)
+	if got := serverName(); got != "renewed" {
+		t.Errorf("Served %q after renewal", got)
+	}
+}
+
+func TestExpandUsesHTTPS(t *testing.T) {
+	h := enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+		Config: func(cfg *config.Config) {
+			cfg.TLS = config.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}
+			cfg.IconURL = "http://${baseurl}:${port}/static/bot.png"
+		},
+	})
+	for _, c := range []struct {
+		got string
+		want string
+	}{
+		{h.Bot.Expand(h.Bot.Config().IconURL), "https://localhost:1/static/bot.png"},
+		{h.Bot.Expand("${scheme}://example.com/"), "https://example.com/"},
+		{h.Bot.Expand("http://example.com/"), "http://example.com/"},
+		{h.Bot.URL("/dialog"), "https://localhost:1/dialog"},
+	} {
+		if c.got != c.want {
+			t.Errorf("Got %q, want %q", c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package engine
+
+import "bot/config"
+import "math/rand"
+import "regexp"
+import "strconv"
+import "sync"
+import "time"
+
+// trigger is a compiled TriggerConfig with its cooldown state.
+type trigger struct {
+	cfg config.TriggerConfig
+	re *regexp.Regexp
+	m sync.Mutex
+	last map[string]time.Time
+}
+
+// newTriggers compiles the triggers of a validated config.
+func newTriggers(cfgs []config.TriggerConfig) []*trigger {
+	out := make([]*trigger, 0, len(cfgs))
+	for _, tc := range cfgs {
+		out = append(out, &trigger{
+			cfg: tc,
+			re: regexp.MustCompile(tc.Regex),
+			last: make(map[string]time.Time),
+		})
+	}
+	return out
+}
+
+// cool reports whether the trigger may fire in channel now, and if so
+// starts its cooldown there.
+func (t *trigger) cool(channel string, now time.Time) bool {
+	if t.cfg.CooldownSeconds == 0 {
+		return true
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if now.Sub(t.last[channel]) < time.Duration(t.cfg.CooldownSeconds) * time.Second {
+		return false
+	}
+	t.last[channel] = now
+	return true
+}
+
+// respond renders a randomly chosen response for a match, with the
+// regex's groups as ${0}, ${1}... and ${name}, and all of them as
+// ${match}.
+func (t *trigger) respond(b *Bot, req *BotRequest, match []string) *BotResponse {
+	data := RequestData(req)
+	data["match"] = match
+	for i, name := range t.re.SubexpNames() {
+		data[strconv.Itoa(i)] = match[i]
+		if name != "" {
+			data[name] = match[i]
+		}
+	}
+	text := t.cfg.Responses[rand.Intn(len(t.cfg.Responses))]
+	return &BotResponse{
+		Text: b.Render(text, data),
+		ResponseType: t.cfg.ResponseType,
+	}
+}
+
+// activeTriggers returns the current triggers, which a reload may
+// replace at any time.
+func (b *Bot) activeTriggers() []*trigger {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.triggers
+}
+
+// trigger answers req with the first configured trigger that matches it
+// in its channel and is not cooling down.
+func (b *Bot) trigger(req *BotRequest) *BotResponse {
+	now := b.Now()
+	for _, t := range b.activeTriggers() {
+		if len(t.cfg.Channels) > 0 && !inChannels(req, t.cfg.Channels) {
+			continue
+		}
+		match := t.re.FindStringSubmatch(req.Text)
+		if match == nil || !t.cool(req.ChannelID, now) {
+			continue
+		}
+		b.Log().Debugf("Trigger %q matched %q", t.cfg.Regex, req.Text)
+		return t.respond(b, req, match)
+	}
+	return nil
+}
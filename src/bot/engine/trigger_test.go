@@ -0,0 +1,85 @@
+package engine_test
+
+import "bot/config"
+import "bot/engine/enginetest"
+import "testing"
+import "time"
+
+func triggerBot(t *testing.T, order string, triggers ...config.TriggerConfig) *enginetest.Harness {
+	return enginetest.NewBot(t, enginetest.Options{
+		Plugins: []config.PluginConfig{{Name: "Dice"}},
+		Config: func(cfg *config.Config) {
+			cfg.Triggers = triggers
+			cfg.TriggerOrder = order
+		},
+	})
+}
+
+// said returns what the bot answered text with, "" if it didn't answer.
+func said(h *enginetest.Harness, text string, opts ...enginetest.RequestOption) string {
+	resp := h.Send(enginetest.Message(text, opts...))
+	if resp == nil {
+		return ""
+	}
+	if resp.Text == "" && len(resp.Attachments) > 0 {
+		return resp.Attachments[0].Text
+	}
+	return resp.Text
+}
+
+func TestTriggerResponds(t *testing.T) {
+	h := triggerBot(t, "", config.TriggerConfig{
+		Regex: `(?i)^hello (?P<who>\w+)`,
+		Responses: []string{"Hi ${user}, ${who} says ${1} in ${channel}"},
+	})
+	if got := said(h, "Hello world"); got != "Hi tester, world says world in town-square" {
+		t.Errorf("Got %q", got)
+	}
+	if got := said(h, "goodbye world"); got != "" {
+		t.Errorf("Answered a message that doesn't match with %q", got)
+	}
+}
+
+func TestTriggerChannels(t *testing.T) {
+	h := triggerBot(t, "", config.TriggerConfig{
+		Regex: "ping",
+		Responses: []string{"pong"},
+		Channels: []string{enginetest.ChannelName},
+	})
+	if got := said(h, "ping"); got != "pong" {
+		t.Errorf("Got %q in the trigger's channel", got)
+	}
+	if got := said(h, "ping", enginetest.In("other", "other-id")); got != "" {
+		t.Errorf("Got %q in another channel", got)
+	}
+}
+
+func TestTriggerCooldown(t *testing.T) {
+	h := triggerBot(t, "", config.TriggerConfig{
+		Regex: "ping",
+		Responses: []string{"pong"},
+		CooldownSeconds: 60,
+	})
+	other := enginetest.In("other", "other-id")
+	if said(h, "ping") != "pong" || said(h, "ping", other) != "pong" {
+		t.Fatal("Trigger didn't fire")
+	}
+	h.Clock.Advance(30 * time.Second)
+	if got := said(h, "ping"); got != "" {
+		t.Errorf("Fired during its cooldown: %q", got)
+	}
+	h.Clock.Advance(31 * time.Second)
+	if got := said(h, "ping"); got != "pong" {
+		t.Errorf("Got %q after the cooldown", got)
+	}
+}
+
+func TestTriggerOrder(t *testing.T) {
+	roll := config.TriggerConfig{Regex: "^roll", Responses: []string{"No dice"}}
+	if got := said(triggerBot(t, "", roll), "roll 1d1"); got != "tester rolls 1" {
+		t.Errorf("Commands first: got %q", got)
+	}
+	if got := said(triggerBot(t, "before", roll), "roll 1d1"); got != "No dice" {
+		t.Errorf("Triggers first: got %q", got)
+	}
+}
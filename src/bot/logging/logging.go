@@ -0,0 +1,250 @@
+package logging
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "os"
+import "regexp"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %s", s)
+}
+
+// Format selects how log lines are written.
+type Format int32
+
+const (
+	FormatText Format = iota
+	FormatLogfmt
+	FormatJSON
+)
+
+var formatNames = []string{"text", "logfmt", "json"}
+
+func (f Format) String() string {
+	if f < FormatText || f > FormatJSON {
+		return fmt.Sprintf("format(%d)", int32(f))
+	}
+	return formatNames[f]
+}
+
+func ParseFormat(s string) (Format, error) {
+	for i, name := range formatNames {
+		if strings.EqualFold(s, name) {
+			return Format(i), nil
+		}
+	}
+	return FormatText, fmt.Errorf("Unknown log format %s", s)
+}
+
+var current int32 = int32(LevelInfo)
+var outFormat int32 = int32(FormatText)
+
+var out struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func init() {
+	out.w = os.Stderr
+}
+
+func SetLevel(l Level) {
+	atomic.StoreInt32(&current, int32(l))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&current))
+}
+
+func SetFormat(f Format) {
+	atomic.StoreInt32(&outFormat, int32(f))
+}
+
+func SetOutput(w io.Writer) {
+	out.Lock()
+	defer out.Unlock()
+	out.w = w
+}
+
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+// Secrets and hook URLs are masked in every message and field value.
+var secrets struct {
+	sync.RWMutex
+	values map[string]bool
+}
+
+const redacted = "[REDACTED]"
+
+var reHookURL = regexp.MustCompile(`(/hooks/(commands/)?)[A-Za-z0-9_-]+`)
+// Slack's hook and response URLs are secret from the path on.
+var reSlackHookURL = regexp.MustCompile(`((?i:hooks\.slack\.com)/)[A-Za-z0-9_/.%-]+`)
+var reTokenParam = regexp.MustCompile(`((?i:token)"?\s*[=:]\s*"?)[^\s&",}]+`)
+
+// AddSecret registers a value, such as a webhook token, that must never
+// appear in log output.
+func AddSecret(s string) {
+	if len(s) < 4 {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	if secrets.values == nil {
+		secrets.values = make(map[string]bool)
+	}
+	secrets.values[s] = true
+}
+
+// Redact masks registered secrets, token parameters and the key part of
+// Mattermost and Slack hook URLs in s.
+func Redact(s string) string {
+	secrets.RLock()
+	for v := range secrets.values {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	secrets.RUnlock()
+	s = reHookURL.ReplaceAllString(s, "${1}"+redacted)
+	s = reSlackHookURL.ReplaceAllString(s, "${1}"+redacted)
+	s = reTokenParam.ReplaceAllString(s, "${1}"+redacted)
+	return s
+}
+
+type field struct {
+	key string
+	value interface{}
+}
+
+// Logger writes leveled messages tagged with a fixed set of fields, such
+// as the bot and plugin they concern.
+type Logger struct {
+	fields []field
+}
+
+var std = &Logger{}
+
+// With returns a logger that adds key=value to every line.
+func With(key string, value interface{}) *Logger {
+	return std.With(key, value)
+}
+
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{
+		fields: append(fields, field{key, value}),
+	}
+}
+
+func (l *Logger) logf(lvl Level, format string, v ...interface{}) {
+	if !Enabled(lvl) {
+		return
+	}
+	msg := Redact(fmt.Sprintf(format, v...))
+	now := time.Now()
+	var line string
+	switch Format(atomic.LoadInt32(&outFormat)) {
+	case FormatJSON:
+		m := map[string]interface{}{
+			"time": now.Format(time.RFC3339),
+			"level": lvl.String(),
+			"msg": msg,
+		}
+		for _, f := range l.fields {
+			m[f.key] = Redact(fmt.Sprint(f.value))
+		}
+		b, _ := json.Marshal(m)
+		line = string(b)
+	case FormatLogfmt:
+		parts := []string{
+			"time=" + now.Format(time.RFC3339),
+			"level=" + lvl.String(),
+			"msg=" + logfmtValue(msg),
+		}
+		for _, f := range l.fields {
+			parts = append(parts, f.key + "=" + logfmtValue(Redact(fmt.Sprint(f.value))))
+		}
+		line = strings.Join(parts, " ")
+	default:
+		parts := []string{
+			now.Format("2006/01/02 15:04:05"),
+			strings.ToUpper(lvl.String()),
+		}
+		for _, f := range l.fields {
+			parts = append(parts, "[" + Redact(fmt.Sprint(f.value)) + "]")
+		}
+		line = strings.Join(append(parts, msg), " ")
+	}
+	out.Lock()
+	defer out.Unlock()
+	io.WriteString(out.w, line + "\n")
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logf(LevelDebug, format, v...)
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.logf(LevelInfo, format, v...)
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logf(LevelWarn, format, v...)
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.logf(LevelError, format, v...)
+}
+
+func Debugf(format string, v ...interface{}) {
+	std.logf(LevelDebug, format, v...)
+}
+
+func Infof(format string, v ...interface{}) {
+	std.logf(LevelInfo, format, v...)
+}
+
+func Warnf(format string, v ...interface{}) {
+	std.logf(LevelWarn, format, v...)
+}
+
+func Errorf(format string, v ...interface{}) {
+	std.logf(LevelError, format, v...)
+}
@@ -0,0 +1,38 @@
+package logging_test
+
+import "bot/logging"
+import "os"
+import "strings"
+import "testing"
+
+func TestRedact(t *testing.T) {
+	logging.AddSecret("s3cret-value")
+	for _, c := range []struct {
+		in string
+		want string
+	}{
+		{"POST to http://mm.example.com/hooks/abc123xyz failed", "POST to http://mm.example.com/hooks/[REDACTED] failed"},
+		{"https://mm.example.com/hooks/commands/q9w8e7", "https://mm.example.com/hooks/commands/[REDACTED]"},
+		{"POST to https://hooks.slack.com/services/T0001/B0002/XXXXsecretXXXX failed", "POST to https://hooks.slack.com/[REDACTED] failed"},
+		{"https://hooks.slack.com/commands/T0001/123456/abcSECRET", "https://hooks.slack.com/[REDACTED]"},
+		{"https://hooks.slack.com/actions/T0001/123456/abcSECRET: 404", "https://hooks.slack.com/[REDACTED]: 404"},
+		{"token=abcd1234&user=x", "token=[REDACTED]&user=x"},
+		{`{"token": "abcd1234"}`, `{"token": "[REDACTED]"}`},
+		{"key is s3cret-value.", "key is [REDACTED]."},
+		{"https://example.com/feed.xml", "https://example.com/feed.xml"},
+	} {
+		if got := logging.Redact(c.in); got != c.want {
+			t.Errorf("Redact(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestLogsRedacted(t *testing.T) {
+	var buf strings.Builder
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(os.Stderr)
+	logging.With("hook", "https://hooks.slack.com/services/T1/B2/secret").Warnf("POST to %s failed", "https://hooks.slack.com/commands/T1/2/secret")
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Logged %q", buf.String())
+	}
+}
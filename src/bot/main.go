@@ -1,29 +1,182 @@
 package main
 
-import "bot/config"
 import "bot/engine"
-import "log"
+import "bot/logging"
 import "os"
+import "github.com/codegangsta/cli"
 
 func main() {
-	bots := make([]*engine.Bot, 0)
-	args := os.Args[1:]
-	for _, cfgName := range args {
-		cfg, err := config.Load(cfgName)
+	app := cli.NewApp()
+	app.Name = "retrobot"
+	app.Usage = "Mattermost bot with feed, dice and gem plugins"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name: "log-level",
+			Value: "info",
+			Usage: "minimum level to log: debug, info, warn or error",
+		},
+		cli.StringFlag{
+			Name: "log-format",
+			Value: "text",
+			Usage: "log line format: text, logfmt or json",
+		},
+		cli.StringFlag{
+			Name: "data-dir",
+			Value: engine.DataRoot,
+			Usage: "root directory for data of bots whose config sets no datadir",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		l, err := logging.ParseLevel(c.GlobalString("log-level"))
 		if err != nil {
-			log.Printf("Skipping config %s: %v", cfgName, err)
-			continue		
+			return cli.NewExitError(err.Error(), 2)
 		}
-		bot, err := engine.New(cfg)
+		logging.SetLevel(l)
+		f, err := logging.ParseFormat(c.GlobalString("log-format"))
 		if err != nil {
-			log.Printf("Failed to start bot with config %s: %v", cfgName, err)
-			continue
+			return cli.NewExitError(err.Error(), 2)
 		}
-		bots = append(bots, bot)
+		logging.SetFormat(f)
+		engine.DataRoot = c.GlobalString("data-dir")
+		return nil
 	}
-	if len(bots) == 0 {
-		log.Println("Terminating as zero bots are running...")
-		return
+	app.Commands = []cli.Command{
+		{
+			Name: "run",
+			Usage: "run one bot per config file",
+			ArgsUsage: "<configs...>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "listen",
+					Usage: "serve all bots on this host:port, each under /<username>/, instead of their own ports",
+				},
+				cli.StringFlag{
+					Name: "tls-cert",
+					Usage: "certificate PEM file for the --listen address, reread on change",
+				},
+				cli.StringFlag{
+					Name: "tls-key",
+					Usage: "key PEM file for --tls-cert",
+				},
+				cli.StringFlag{
+					Name: "tls-client-ca",
+					Usage: "CA PEM file that clients of the --listen address must have certificates from",
+				},
+				cli.IntFlag{
+					Name: "tls-redirect-port",
+					Usage: "port on which to redirect plain HTTP to the --listen address",
+				},
+			},
+			Action: runAction,
+		},
+		{
+			Name: "console",
+			Usage: "talk to a bot's plugins from the terminal, or play a transcript, without posting or polling in the background",
+			ArgsUsage: "<config> [transcript]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "datadir",
+					Usage: "data directory to use and change; a scratch copy of the bot's if empty",
+				},
+				cli.StringFlag{
+					Name: "user",
+					Value: "console",
+					Usage: "user name to speak as",
+				},
+				cli.StringFlag{
+					Name: "user-id",
+					Usage: "user ID to speak as, the user name if empty",
+				},
+				cli.StringFlag{
+					Name: "channel",
+					Value: "town-square",
+					Usage: "channel name to speak in",
+				},
+				cli.StringFlag{
+					Name: "channel-id",
+					Usage: "channel ID to speak in, the channel name if empty",
+				},
+			},
+			Action: consoleAction,
+		},
+		{
+			Name: "validate",
+			Usage: "check a bot config without starting it",
+			ArgsUsage: "<config>",
+			Action: validateAction,
+		},
+		{
+			Name: "plugins",
+			Usage: "list registered plugins",
+			Action: pluginsAction,
+		},
+		{
+			Name: "feed",
+			Usage: "feed plugin tools",
+			Subcommands: []cli.Command{
+				{
+					Name: "test",
+					Usage: "fetch a feed and print its items through the template",
+					ArgsUsage: "<url>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "template",
+							Usage: "template to render items with",
+						},
+						cli.IntFlag{
+							Name: "max",
+							Value: 5,
+							Usage: "number of items to show",
+						},
+					},
+					Action: feedTestAction,
+				},
+			},
+		},
+		{
+			Name: "gem",
+			Usage: "gem plugin tools",
+			Subcommands: []cli.Command{
+				{
+					Name: "export",
+					Usage: "write a bot's gems as YAML to a file or stdout",
+					ArgsUsage: "<config> [file]",
+					Action: gemExportAction,
+				},
+				{
+					Name: "import",
+					Usage: "add gems from an exported YAML file to a stopped bot",
+					ArgsUsage: "<config> <file>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name: "force",
+							Usage: "import even though the bot appears to be running, which may lose the import or damage its store",
+						},
+					},
+					Action: gemImportAction,
+				},
+			},
+		},
+		{
+			Name: "outbox",
+			Usage: "inspect undelivered outbound posts of a stopped bot",
+			Subcommands: []cli.Command{
+				{
+					Name: "list",
+					Usage: "list dead letters",
+					ArgsUsage: "<config>",
+					Action: outboxListAction,
+				},
+				{
+					Name: "replay",
+					Usage: "requeue one dead letter, or all of them",
+					ArgsUsage: "<config> [id]",
+					Action: outboxReplayAction,
+				},
+			},
+		},
 	}
-	select{}
-}
\ No newline at end of file
+	// bare config paths still run bots, as before subcommands existed
+	app.Action = runAction
+	app.Run(os.Args)
+}
@@ -0,0 +1,126 @@
+package main
+
+import "bot/config"
+import "bot/engine"
+import "bot/logging"
+import "context"
+import "os"
+import "os/signal"
+import "syscall"
+import "time"
+import "github.com/codegangsta/cli"
+
+const shutdownTimeout = 30 * time.Second
+
+func runAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		cli.ShowAppHelp(c)
+		return cli.NewExitError("No config files given", 2)
+	}
+	var host *engine.Host
+	if addr := c.String("listen"); addr != "" {
+		h, err := engine.NewHost(addr, config.TLSConfig{
+			CertFile: c.String("tls-cert"),
+			KeyFile: c.String("tls-key"),
+			ClientCAFile: c.String("tls-client-ca"),
+			RedirectPort: c.Int("tls-redirect-port"),
+		})
+		if err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+		host = h
+	}
+	bots := make([]*engine.Bot, 0)
+	failed := false
+	for _, cfgName := range c.Args() {
+		cfg, err := config.Load(cfgName)
+		if err != nil {
+			logging.Warnf("Skipping config %s: %v", cfgName, err)
+			continue		
+		}
+		var bot *engine.Bot
+		if host != nil {
+			bot, err = engine.NewHosted(cfg, host)
+		} else {
+			bot, err = engine.New(cfg)
+		}
+		if err != nil {
+			logging.Errorf("Failed to start bot with config %s: %v", cfgName, err)
+			failed = true
+			continue
+		}
+		bots = append(bots, bot)
+	}
+	if len(bots) == 0 {
+		return cli.NewExitError("Terminating as zero bots are running...", 1)
+	}
+
+	if host != nil {
+		if err := host.Start(); err != nil {
+			for _, bot := range bots {
+				bot.Done()
+			}
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	errc := make(chan error, len(bots)+1)
+	for _, bot := range bots {
+		go func(bot *engine.Bot) {
+			if err, ok := <-bot.Errors(); ok {
+				logging.Errorf("Bot %s stopped serving: %v", bot.Config().Username, err)
+				errc <- err
+			}
+		}(bot)
+	}
+
+	if host != nil {
+		go func() {
+			if err, ok := <-host.Errors(); ok {
+				logging.Errorf("Shared listener stopped serving: %v", err)
+				errc <- err
+			}
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	running := true
+	for running {
+		select {
+		case <-hup:
+			logging.Infof("Received hangup, reloading configuration...")
+			for _, bot := range bots {
+				if err := bot.Reload(); err != nil {
+					logging.Warnf("Reload of bot %s: %v", bot.Config().Username, err)
+				}
+			}
+		case s := <-sig:
+			logging.Infof("Received %v, shutting down...", s)
+			running = false
+		case <-errc:
+			failed = true
+			running = false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if host != nil {
+		if err := host.Shutdown(ctx); err != nil {
+			logging.Errorf("Shutdown of shared listener: %v", err)
+		}
+	}
+	for _, bot := range bots {
+		if err := bot.Shutdown(ctx); err != nil {
+			logging.Errorf("Shutdown of bot %s: %v", bot.Config().Username, err)
+		}
+	}
+	if failed {
+		return cli.NewExitError("One or more bots failed", 1)
+	}
+	return nil
+}
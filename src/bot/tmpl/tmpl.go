@@ -0,0 +1,186 @@
+// Package tmpl renders the templates used in bot and plugin configs.
+//
+// Templates are text/template, so {{if}}, {{range}} and the like work,
+// with ${a.b} as a shorthand for {{field "a.b"}}.  A field names a path
+// through the data: map keys, struct fields (matched case-insensitively)
+// and list indexes, separated by dots.  Missing fields render as "".
+// Besides the text/template builtins there are:
+//
+//	now                   the current time
+//	date "2006-01-02" t   t formatted with a Go time layout
+//	upper, lower, trim    change strings
+//	join ", " list        join a list of strings
+//	default "x" v         v, or "x" if v is empty
+package tmpl
+
+import "bytes"
+import "fmt"
+import "reflect"
+import "regexp"
+import "strconv"
+import "strings"
+import "sync"
+import "text/template"
+import "time"
+
+// Data is what a template is rendered against.
+type Data map[string]interface{}
+
+var reShorthand = regexp.MustCompile(`\$\{([^${}]+)\}`)
+
+var funcs = template.FuncMap{
+	"field": func(path string, data Data) interface{} {
+		if v := Field(data, path); v != nil {
+			return v
+		}
+		return ""
+	},
+	"now": time.Now,
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim": strings.TrimSpace,
+	"join": func(sep string, list []string) string {
+		return strings.Join(list, sep)
+	},
+	"default": func(def interface{}, v interface{}) interface{} {
+		if isEmpty(reflect.ValueOf(v)) {
+			return def
+		}
+		return v
+	},
+}
+
+// Template is a parsed template.
+type Template struct {
+	src string
+	t *template.Template
+}
+
+// cacheSize bounds the parse cache, as templates may come from users.
+const cacheSize = 256
+
+var cache = struct {
+	sync.Mutex
+	m map[string]*Template
+}{m: make(map[string]*Template)}
+
+// Parse compiles src, rewriting ${a.b} shorthands first.  Recently
+// parsed templates are cached, so parsing the same source again is
+// cheap.
+func Parse(src string) (*Template, error) {
+	cache.Lock()
+	tt, ok := cache.m[src]
+	cache.Unlock()
+	if ok {
+		return tt, nil
+	}
+	body := reShorthand.ReplaceAllStringFunc(src, func(s string) string {
+		return fmt.Sprintf("{{field %q $}}", strings.TrimSpace(s[2:len(s)-1]))
+	})
+	t, err := template.New("").Funcs(funcs).Option("missingkey=zero").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("Template %q: %v", src, err)
+	}
+	tt = &Template{src, t}
+	cache.Lock()
+	if len(cache.m) >= cacheSize {
+		// evict any one; config templates are parsed again when needed
+		for k := range cache.m {
+			delete(cache.m, k)
+			break
+		}
+	}
+	cache.m[src] = tt
+	cache.Unlock()
+	return tt, nil
+}
+
+// Check reports whether src is a valid template.
+func Check(src string) error {
+	_, err := Parse(src)
+	return err
+}
+
+// Execute renders the template against data.
+func (t *Template) Execute(data Data) (string, error) {
+	var buf bytes.Buffer
+	if err := t.t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (t *Template) String() string {
+	return t.src
+}
+
+// Render parses and executes src in one go.
+func Render(src string, data Data) (string, error) {
+	t, err := Parse(src)
+	if err != nil {
+		return "", err
+	}
+	return t.Execute(data)
+}
+
+// Field looks up a dotted path in data, returning nil if any part of it
+// is missing.  A key containing dots is tried whole before being split.
+func Field(data Data, path string) interface{} {
+	if v, ok := data[path]; ok {
+		return v
+	}
+	v := reflect.ValueOf(map[string]interface{}(data))
+	for _, part := range strings.Split(path, ".") {
+		v = step(v, part)
+		if !v.IsValid() {
+			return nil
+		}
+	}
+	if !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
+
+func step(v reflect.Value, name string) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}
+		}
+		return v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+	case reflect.Struct:
+		return v.FieldByNameFunc(func(f string) bool {
+			return strings.EqualFold(f, name)
+		})
+	case reflect.Slice, reflect.Array:
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 || i >= v.Len() {
+			return reflect.Value{}
+		}
+		return v.Index(i)
+	}
+	return reflect.Value{}
+}
+
+func isEmpty(v reflect.Value) bool {
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
@@ -0,0 +1,76 @@
+package tmpl_test
+
+import "bot/tmpl"
+import "testing"
+
+type item struct {
+	Title string
+	Tags []string
+	Author *item
+}
+
+func TestRender(t *testing.T) {
+	data := tmpl.Data{
+		"user": "tester",
+		"item": &item{Title: "Hello", Tags: []string{"a", "b"}, Author: &item{Title: "Ann"}},
+		"feed": map[string]interface{}{"name": "News"},
+		"a.b": "dotted",
+	}
+	for _, c := range []struct {
+		src string
+		want string
+	}{
+		{"plain", "plain"},
+		{"Hi ${user}!", "Hi tester!"},
+		{"${ user }", "tester"},
+		{"${item.title} in ${feed.name}", "Hello in News"},
+		{"${item.tags.1}, by ${item.author.title}", "b, by Ann"},
+		{"[${missing}${item.nope}${item.tags.5}${item.author.author.title}]", "[]"},
+		{"${a.b}", "dotted"},
+		{"{{if .item}}${item.title}{{end}}", "Hello"},
+		{"{{upper .user}}", "TESTER"},
+	} {
+		got, err := tmpl.Render(c.src, data)
+		if err != nil {
+			t.Errorf("%q: %v", c.src, err)
+		} else if got != c.want {
+			t.Errorf("%q: got %q, want %q", c.src, got, c.want)
+		}
+	}
+}
+
+// Values are not templates: one that looks like a shorthand is output
+// as it is rather than expanded again.
+func TestRenderValuesLiterally(t *testing.T) {
+	data := tmpl.Data{"item": &item{Title: "${item.title} {{.item}}"}}
+	got, err := tmpl.Render("${item.title}", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "${item.title} {{.item}}" {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"${feed.name}: ${item.title}",
+		"{{range .item.tags}}{{.}} {{end}}",
+		`{{date "2006-01-02" now}}`,
+	} {
+		if err := tmpl.Check(src); err != nil {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+	for _, src := range []string{
+		"{{",
+		"{{if .x}}",
+		"{{nosuchfunc}}",
+		`{{env "HOME"}}`,
+	} {
+		if err := tmpl.Check(src); err == nil {
+			t.Errorf("Accepted %q", src)
+		}
+	}
+}